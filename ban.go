@@ -0,0 +1,210 @@
+package libtorrent
+
+import (
+	"crypto/sha1"
+	"net"
+	"sort"
+	"sync"
+)
+
+// maxHashFailures is the number of failed pieces a peer may send blocks for before it is
+// banned.
+const maxHashFailures = 3
+
+// banList keeps track of peers that send us corrupt data. Peers are identified by IP
+// address (or URL, for web seeds), so reconnecting doesn't clear their record.
+//
+// Every peer that sent blocks of a piece that fails its hash check has its failure count
+// increased, and is banned once this reaches maxHashFailures. When several peers sent
+// blocks, the hash of each block is kept and the piece is downloaded again from a single
+// peer ("smart ban"). Once the piece passes, any peer whose block differs from the good
+// copy is banned at once, and the others are forgiven.
+type banList struct {
+	failures map[string]int
+	banned   map[string]bool
+	suspects map[int]map[int64]*suspectBlock // Blocks of failed pieces, by piece and offset
+	mutex    sync.Mutex
+}
+
+type suspectBlock struct {
+	from string // Peer that sent the block that failed
+	bad  [sha1.Size]byte
+	good *[sha1.Size]byte // The block downloaded since, once it arrives
+}
+
+func newBanList() *banList {
+	return &banList{
+		failures: make(map[string]int),
+		banned:   make(map[string]bool),
+		suspects: make(map[int]map[int64]*suspectBlock),
+	}
+}
+
+// addrKey returns the host part of addr, which is what bans apply to.
+func addrKey(addr string) string {
+	if host, _, err := net.SplitHostPort(addr); err == nil {
+		return host
+	}
+	return addr
+}
+
+// peerKey identifies the peer in the ban list.
+func peerKey(p *peer) string {
+	if p.conn == nil {
+		// Web seeds are known by their URL
+		return p.addr
+	}
+	return addrKey(p.addr)
+}
+
+func (bl *banList) Banned(key string) bool {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	return bl.banned[key]
+}
+
+// Failures returns the number of failed pieces the peer has sent blocks for.
+func (bl *banList) Failures(key string) int {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	return bl.failures[key]
+}
+
+// List returns every banned peer, in order.
+func (bl *banList) List() (keys []string) {
+	bl.mutex.Lock()
+	for key := range bl.banned {
+		keys = append(keys, key)
+	}
+	bl.mutex.Unlock()
+	sort.Strings(keys)
+	return
+}
+
+// Failed records a piece that failed its hash check. senders holds the peer that sent
+// each block of the piece, and data the piece's contents. It returns the peers that should
+// now be banned, and whether the piece should be downloaded from a single peer to find
+// the culprit.
+func (bl *banList) Failed(index int, data []byte, senders []string) (ban []string, exclusive bool) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+
+	contributors := make(map[string]bool)
+	for _, key := range senders {
+		if key != "" {
+			contributors[key] = true
+		}
+	}
+	for key := range contributors {
+		bl.failures[key]++
+		if bl.failures[key] >= maxHashFailures && !bl.banned[key] {
+			bl.banned[key] = true
+			ban = append(ban, key)
+		}
+	}
+
+	if blocks, ok := bl.suspects[index]; ok {
+		// The download from a single peer failed too, so it tells us nothing about the
+		// original blocks
+		for _, sb := range blocks {
+			sb.good = nil
+		}
+		return ban, true
+	}
+	if len(contributors) < 2 || data == nil {
+		return
+	}
+	blocks := make(map[int64]*suspectBlock)
+	for i, key := range senders {
+		start, end := int64(i)*blockSize, int64(i+1)*blockSize
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if key != "" && start < end {
+			blocks[start] = &suspectBlock{from: key, bad: sha1.Sum(data[start:end])}
+		}
+	}
+	bl.suspects[index] = blocks
+	return ban, true
+}
+
+// Received notes a block downloaded for a piece that previously failed.
+func (bl *banList) Received(index int, offset int64, data []byte) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	if sb, ok := bl.suspects[index][offset]; ok {
+		sum := sha1.Sum(data)
+		sb.good = &sum
+	}
+}
+
+// Verified records that a piece passed its hash check. It returns the peers found to
+// have sent bad blocks when the piece previously failed, which should now be banned.
+func (bl *banList) Verified(index int) (ban []string) {
+	bl.mutex.Lock()
+	defer bl.mutex.Unlock()
+	blocks, ok := bl.suspects[index]
+	if !ok {
+		return
+	}
+	delete(bl.suspects, index)
+
+	guilty := make(map[string]bool)
+	for _, sb := range blocks {
+		if sb.good != nil && *sb.good != sb.bad {
+			guilty[sb.from] = true
+		}
+	}
+	if len(guilty) == 0 {
+		// The bad blocks weren't downloaded again, so nobody can be blamed
+		return
+	}
+	forgiven := make(map[string]bool)
+	for _, sb := range blocks {
+		switch {
+		case guilty[sb.from] && !bl.banned[sb.from]:
+			bl.banned[sb.from] = true
+			ban = append(ban, sb.from)
+		case !guilty[sb.from] && !forgiven[sb.from]:
+			forgiven[sb.from] = true
+			if bl.failures[sb.from] > 0 {
+				bl.failures[sb.from]--
+			}
+		}
+	}
+	return
+}
+
+// BannedPeers returns the addresses of peers banned for sending corrupt data.
+func (t *Torrent) BannedPeers() []string {
+	return t.bans.List()
+}
+
+// hashFailed blames the peers that sent a piece that failed its hash check.
+func (t *Torrent) hashFailed(index int, data []byte, senders []*peer) {
+	keys := make([]string, len(senders))
+	for i, p := range senders {
+		if p != nil {
+			keys[i] = peerKey(p)
+		}
+	}
+	ban, exclusive := t.bans.Failed(index, data, keys)
+	if exclusive {
+		logger.Debug("Piece %d had blocks from several peers, downloading it again from one", index)
+		t.picker.SetExclusive(index)
+	}
+	for _, key := range ban {
+		t.ban(key)
+	}
+}
+
+// ban disconnects the peer and refuses any further connections from it.
+func (t *Torrent) ban(key string) {
+	logger.Info("Banning peer %s for sending corrupt data", key)
+	t.publish(Event{Type: PeerBannedEvent, Peer: key})
+	for _, p := range t.peers() {
+		if peerKey(p) == key {
+			t.removePeer(p)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+package libtorrent
+
+import (
+	"bytes"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// expectClosed waits for the torrent to close the connection.
+func (rp *testRemotePeer) expectClosed(t *testing.T) {
+	for {
+		select {
+		case _, ok := <-rp.msgs:
+			if !ok {
+				return
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for connection to close")
+		}
+	}
+}
+
+func TestBanListSmartBan(t *testing.T) {
+	bl := newBanList()
+	data := testData(t)[:2*blockSize]
+	bad := append([]byte(nil), data...)
+	bad[blockSize] ^= 0xff
+
+	ban, exclusive := bl.Failed(0, bad, []string{"a", "b"})
+	if len(ban) != 0 || !exclusive {
+		t.Fatal("Incorrect result of first failure: ", ban, exclusive)
+	}
+	if bl.Failures("a") != 1 || bl.Failures("b") != 1 {
+		t.Error("Failures not counted")
+	}
+
+	bl.Received(0, 0, data[:blockSize])
+	bl.Received(0, blockSize, data[blockSize:])
+	if ban = bl.Verified(0); !reflect.DeepEqual(ban, []string{"b"}) {
+		t.Error("Incorrect peers banned: ", ban)
+	}
+	if !bl.Banned("b") || bl.Banned("a") || bl.Failures("a") != 0 {
+		t.Error("Innocent peer not forgiven")
+	}
+
+	// A peer that sends bad pieces on its own is banned once it reaches the limit
+	for i := 1; i <= maxHashFailures; i++ {
+		ban, exclusive = bl.Failed(1, bad, []string{"c", "c"})
+		if exclusive || (i < maxHashFailures) != (len(ban) == 0) {
+			t.Errorf("Failure %d: incorrect result: %v %v", i, ban, exclusive)
+		}
+	}
+	if !reflect.DeepEqual(bl.List(), []string{"b", "c"}) {
+		t.Error("Incorrect ban list: ", bl.List())
+	}
+}
+
+func TestBanRepeatedHashFailures(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	sub := tor.Subscribe(PeerEvents)
+	defer sub.Close()
+	tor.Start()
+
+	data := testData(t)
+	rp := newTestRemotePeerFrom(tor, "-TR2940-abcdefghijkl", "10.0.0.1:6881")
+	rp.seed(t)
+	for failures := 0; failures < maxHashFailures; {
+		req := rp.expectRequest(t)
+		if req.pieceIndex != 1 {
+			rp.respond(t, req, data)
+			continue
+		}
+		rp.send(t, &pieceMessage{pieceIndex: 1, data: make([]byte, req.blockLength)})
+		failures++
+	}
+	rp.expectClosed(t)
+	expectEvents(t, sub, PeerConnectedEvent, PeerBannedEvent, PeerDisconnectedEvent)
+	if banned := tor.BannedPeers(); !reflect.DeepEqual(banned, []string{"10.0.0.1"}) {
+		t.Error("Incorrect banned peers: ", banned)
+	}
+
+	// Banned peers can't reconnect
+	again := newTestRemotePeerFrom(tor, "-TR2940-abcdefghijkl", "10.0.0.1:51413")
+	again.expectClosed(t)
+	if len(tor.Peers()) != 0 {
+		t.Error("Banned peer reconnected")
+	}
+}
+
+func TestSmartBan(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	tor.Start()
+	data := testData(t)
+
+	// The good peer sends every block but one
+	good := newTestRemotePeerFrom(tor, "-TR2940-aaaaaaaaaaaa", "10.0.0.1:6881")
+	good.seed(t)
+	for i := 0; i < 3; i++ {
+		if req := good.expectRequest(t); req.pieceIndex != 0 || req.blockOffset != blockSize {
+			good.respond(t, req, data)
+		}
+	}
+	waitFor(t, "piece 1", func() bool { return tor.havePiece(1) })
+
+	// In endgame the bad peer is asked for the missing block, which it corrupts, and
+	// then chokes us so the piece is downloaded again from the good peer
+	bad := newTestRemotePeerFrom(tor, "-TR2940-bbbbbbbbbbbb", "10.0.0.2:6881")
+	bad.seed(t)
+	if req := bad.expectRequest(t); req.pieceIndex != 0 || req.blockOffset != blockSize {
+		t.Fatalf("Unexpected request: %#v", req)
+	}
+	bad.send(t, &pieceMessage{pieceIndex: 0, blockOffset: blockSize, data: bytes.Repeat([]byte{0xff}, blockSize)})
+	bad.send(t, &chokeMessage{})
+
+	for i := 0; i < 2; i++ {
+		good.respond(t, good.expectRequest(t), data)
+	}
+	bad.expectClosed(t)
+	if banned := tor.BannedPeers(); !reflect.DeepEqual(banned, []string{"10.0.0.2"}) {
+		t.Error("Incorrect banned peers: ", banned)
+	}
+	if s := tor.Status(); s.DoneBytes != int64(len(data)) {
+		t.Error("Download incomplete: ", s.DoneBytes)
+	}
+	if peers := tor.Peers(); len(peers) != 1 || peers[0].HashFailures != 0 {
+		t.Error("Good peer not forgiven: ", peers)
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"io"
 	"io/ioutil"
+	"math/bits"
 )
 
 type Bitfield struct {
@@ -25,6 +26,9 @@ func ParseBitfield(r io.Reader) (bf *Bitfield, err error) {
 	bf = &Bitfield{
 		field: field,
 	}
+	for _, b := range field {
+		bf.sum += bits.OnesCount8(b)
+	}
 	return
 }
 
@@ -47,9 +51,12 @@ func (bf *Bitfield) SumTrue() int {
 func (bf *Bitfield) SetTrue(index int) (err error) {
 	if (bf.length > 0 && index >= bf.length) || (bf.length == 0 && index >= len(bf.field)*8) {
 		err = errors.New("Bitfield error: Index out of range")
+		return
+	}
+	if !bf.Get(index) {
+		bf.field[index>>3] |= 1 << (7 - uint(index)&7)
+		bf.sum++
 	}
-	bf.field[index>>3] |= 1 << (7 - uint(index)&7)
-	bf.sum++
 	return
 }
 
@@ -61,6 +68,15 @@ func (bf *Bitfield) Get(index int) bool {
 	return bf.field[index>>3]&(1<<(7-uint(index)&7)) != 0
 }
 
+// Copy returns an independent copy of the bitfield.
+func (bf *Bitfield) Copy() *Bitfield {
+	return &Bitfield{
+		length: bf.length,
+		sum:    bf.sum,
+		field:  append([]byte(nil), bf.field...),
+	}
+}
+
 func (bf *Bitfield) Bytes() []byte {
 	return bf.field
 }
@@ -33,3 +33,34 @@ func TestBitfieldGet(t *testing.T) {
 		t.Error("Bitfield Get failed")
 	}
 }
+
+func TestBitfieldCopy(t *testing.T) {
+	bf := NewBitfield(14)
+	bf.SetTrue(3)
+	cp := bf.Copy()
+	bf.SetTrue(4)
+
+	if !cp.Get(3) || cp.Get(4) {
+		t.Error("Bitfield copy not independent of original")
+	}
+	if cp.Length() != 14 || cp.SumTrue() != 1 {
+		t.Errorf("Bitfield copy incorrect, length: %d sum: %d", cp.Length(), cp.SumTrue())
+	}
+}
+
+func TestBitfieldSum(t *testing.T) {
+	bf := NewBitfield(14)
+	bf.SetTrue(3)
+	bf.SetTrue(3)
+	if bf.SumTrue() != 1 {
+		t.Error("Setting a bit twice changed the sum, got: ", bf.SumTrue())
+	}
+	if err := bf.SetTrue(14); err == nil || bf.SumTrue() != 1 {
+		t.Error("Out of range SetTrue should fail without changing the sum")
+	}
+
+	parsed, _ := ParseBitfield(bytes.NewReader([]byte{0xf0, 0x01}))
+	if parsed.SumTrue() != 5 {
+		t.Error("Parsed bitfield sum incorrect, got: ", parsed.SumTrue())
+	}
+}
@@ -1,6 +1,68 @@
 package libtorrent
 
+import (
+	"github.com/torrance/libtorrent/filestore"
+	"github.com/torrance/libtorrent/ipfilter"
+)
+
 type Config struct {
 	RootDirectory string
 	Port          int16
+	// Identifies our client in the peer ids of torrents. Zero uses DefaultFingerprint.
+	Fingerprint Fingerprint
+
+	// Where torrents' files are stored. Nil stores them beneath RootDirectory.
+	Storage filestore.StorageProvider
+	// How files beneath RootDirectory are allocated, and what to do with existing files
+	// that are too large. Ignored when Storage is set.
+	Allocation     filestore.Allocation
+	OversizedFiles filestore.OversizedPolicy
+
+	// Limits shared by every torrent in a Session. Zero means unlimited.
+	MaxConnections    int
+	UploadRateLimit   int64 // Bytes per second
+	DownloadRateLimit int64 // Bytes per second
+	// Connection attempts each torrent may have in progress at once. Zero uses a default
+	// of 8.
+	MaxHalfOpen int
+
+	// Number of auto-managed torrents in a Session that may be active at once, downloading,
+	// seeding and in total. The rest are queued. Zero means unlimited.
+	MaxActiveDownloads int
+	MaxActiveSeeds     int
+	MaxActive          int
+	// Auto-managed torrents transferring less than this many bytes per second, after their
+	// first minute, don't count as active, so that they don't hold up the queue. Zero
+	// counts every running torrent.
+	SlowTorrentRate int64
+
+	// When finished torrents stop seeding, and what they do then. Torrents may override
+	// these with SetSeedingGoals.
+	SeedingGoals SeedingGoals
+	// Reveal pieces to peers one at a time whilst seeding (BEP 16), for a new torrent with
+	// a single seed. Torrents may change this with SetSuperSeeding.
+	SuperSeeding bool
+	// Whilst seeding, keep dialing peers until this many that still need pieces are
+	// connected, for small swarms where peers won't find us. Zero only dials whilst
+	// leeching.
+	DialWhileSeeding int
+
+	// Find peers on the local network by multicast (BEP 14). Private torrents are never
+	// announced.
+	LocalDiscovery bool
+	// Map the listening port on the local network's gateway by UPnP, NAT-PMP or PCP, so
+	// that peers outside it can connect. Torrents then announce the mapped port.
+	PortMapping bool
+
+	// Addresses we never connect to or accept connections from. Nil allows all. The
+	// filter may be changed whilst in use.
+	IPFilter *ipfilter.Filter
+
+	// Memory used to cache pieces read for peers and to buffer downloaded blocks until
+	// their piece is complete, split evenly between the two. Zero uses a default of
+	// 16 MiB.
+	DiskCacheSize int64
+	// Number of goroutines reading, writing and hashing pieces for each torrent. Zero
+	// uses a default of 4.
+	DiskWorkers int
 }
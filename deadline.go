@@ -0,0 +1,31 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+	"time"
+)
+
+// SetPieceDeadline asks for the piece to be downloaded within d. Pieces with deadlines
+// are requested before any others, from the fastest peers first, and once late are
+// requested from every peer that has them. A DeadlineFinished event is sent when the
+// piece has been verified, or straight away if we already have it.
+func (t *Torrent) SetPieceDeadline(index int, d time.Duration) error {
+	if index < 0 || index >= t.meta.PieceCount {
+		return errors.New(fmt.Sprintf("SetPieceDeadline: piece index %d out of range", index))
+	}
+	if !t.picker.SetDeadline(index, time.Now().Add(d)) {
+		t.publish(Event{Type: DeadlineFinishedEvent, Piece: index})
+		return nil
+	}
+	t.repick()
+	// Wake the peer loop again once the piece is late, so it is requested from other peers
+	time.AfterFunc(d, t.repick)
+	return nil
+}
+
+// ClearPieceDeadlines removes all piece deadlines. No DeadlineFinished events are sent
+// for them.
+func (t *Torrent) ClearPieceDeadlines() {
+	t.picker.ClearDeadlines()
+}
@@ -0,0 +1,38 @@
+package libtorrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestPieceDeadline(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	sub := tor.Subscribe(PieceEvents)
+	defer sub.Close()
+	tor.Start()
+
+	if err := tor.SetPieceDeadline(2, time.Second); err == nil {
+		t.Error("Expected error for out of range piece")
+	}
+	if err := tor.SetPieceDeadline(1, time.Minute); err != nil {
+		t.Fatal("Failed to set deadline: ", err)
+	}
+
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.seed(t)
+	req := rp.expectRequest(t)
+	if req.pieceIndex != 1 {
+		t.Errorf("Expected piece with deadline to be requested first, got piece %d", req.pieceIndex)
+	}
+	rp.respond(t, req, testData(t))
+
+	expectEvents(t, sub, PieceFinishedEvent, DeadlineFinishedEvent)
+
+	// Pieces we already have finish straight away
+	tor.SetPieceDeadline(1, time.Minute)
+	ev := <-sub.C
+	if ev.Type != DeadlineFinishedEvent || ev.Piece != 1 || ev.Late {
+		t.Errorf("Incorrect event: %v", ev)
+	}
+}
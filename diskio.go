@@ -0,0 +1,304 @@
+package libtorrent
+
+import (
+	"container/list"
+	"errors"
+	"github.com/torrance/libtorrent/filestore"
+	"sync"
+)
+
+const (
+	defaultDiskCacheSize = 16 * 1024 * 1024
+	defaultDiskWorkers   = 4
+
+	// diskQueueSize is the number of jobs that may wait for a worker. Once the queue is
+	// full, submitting a job blocks, which stops the receive loop reading from peers.
+	diskQueueSize = 64
+)
+
+var errDiskClosed = errors.New("Disk I/O closed")
+
+// diskIO performs a torrent's disk access on a pool of worker goroutines, so that slow
+// disks never hold up the receive loop.
+//
+// Downloaded blocks are buffered in memory until their piece is complete, then hashed
+// and (if good) written to disk in one go; bad pieces never reach the disk. If the
+// buffer grows beyond its share of the cache, the largest partial piece is written out
+// early and checked from disk once complete. Pieces read for peers are kept in an LRU
+// cache, since peers tend to ask for every block of a piece.
+type diskIO struct {
+	fs     *filestore.FileStore
+	jobs   chan func()
+	active sync.WaitGroup // Jobs submitted and not yet finished
+
+	writes     map[int]*writeBuffer
+	writeSize  int64
+	writeLimit int64
+
+	reads     map[int]*list.Element
+	readOrder *list.List // Most recently used at the front
+	readSize  int64
+	readLimit int64
+
+	closed bool
+	mutex  sync.Mutex
+	// closeLock is held for reading whilst submitting jobs, so Close can wait for
+	// submissions in progress to finish
+	closeLock sync.RWMutex
+}
+
+// writeBuffer holds the blocks of a piece that have not yet been written to disk.
+type writeBuffer struct {
+	blocks   map[int64][]byte
+	size     int64
+	flushed  bool           // Some blocks have already been written to disk
+	flushing sync.WaitGroup // Early writes still in progress
+	err      error          // First error writing blocks early
+}
+
+type cachedPiece struct {
+	index int
+	data  []byte
+}
+
+// newDiskIO starts workers goroutines performing I/O on fs, using up to cacheSize bytes
+// of memory for caching.
+func newDiskIO(fs *filestore.FileStore, cacheSize int64, workers int) *diskIO {
+	if cacheSize == 0 {
+		cacheSize = defaultDiskCacheSize
+	}
+	if workers <= 0 {
+		workers = defaultDiskWorkers
+	}
+	dio := &diskIO{
+		fs:         fs,
+		jobs:       make(chan func(), diskQueueSize),
+		writes:     make(map[int]*writeBuffer),
+		writeLimit: cacheSize / 2,
+		reads:      make(map[int]*list.Element),
+		readOrder:  list.New(),
+		readLimit:  cacheSize / 2,
+	}
+	for i := 0; i < workers; i++ {
+		go func() {
+			for job := range dio.jobs {
+				job()
+				dio.active.Done()
+			}
+		}()
+	}
+	return dio
+}
+
+// submit queues job for a worker, blocking if the queue is full. It returns false if
+// the disk has been closed.
+func (dio *diskIO) submit(job func()) bool {
+	dio.closeLock.RLock()
+	defer dio.closeLock.RUnlock()
+	if dio.closed {
+		return false
+	}
+	dio.active.Add(1)
+	dio.jobs <- job
+	return true
+}
+
+// Wait blocks until every submitted job has finished.
+func (dio *diskIO) Wait() {
+	dio.active.Wait()
+}
+
+// Close waits for outstanding jobs and stops the workers. Blocks still buffered are
+// discarded.
+func (dio *diskIO) Close() {
+	dio.closeLock.Lock()
+	defer dio.closeLock.Unlock()
+	if dio.closed {
+		return
+	}
+	dio.closed = true
+	dio.active.Wait()
+	close(dio.jobs)
+
+	dio.mutex.Lock()
+	dio.writes = make(map[int]*writeBuffer)
+	dio.writeSize = 0
+	dio.mutex.Unlock()
+}
+
+// ReadBlock reads a block of a verified piece on a worker, calling done with the result.
+func (dio *diskIO) ReadBlock(index int, offset int64, length int64, done func(block []byte, err error)) {
+	ok := dio.submit(func() {
+		done(dio.readBlock(index, offset, length))
+	})
+	if !ok {
+		done(nil, errDiskClosed)
+	}
+}
+
+// Read reads a block of a verified piece, waiting for the result.
+func (dio *diskIO) Read(index int, offset int64, length int64) (block []byte, err error) {
+	result := make(chan struct{})
+	dio.ReadBlock(index, offset, length, func(b []byte, e error) {
+		block, err = b, e
+		close(result)
+	})
+	<-result
+	return
+}
+
+func (dio *diskIO) readBlock(index int, offset int64, length int64) (block []byte, err error) {
+	dio.mutex.Lock()
+	if elem, ok := dio.reads[index]; ok {
+		dio.readOrder.MoveToFront(elem)
+		data := elem.Value.(*cachedPiece).data
+		dio.mutex.Unlock()
+		if offset+length > int64(len(data)) {
+			return nil, errors.New("Requested block overran piece length")
+		}
+		return data[offset : offset+length], nil
+	}
+	dio.mutex.Unlock()
+
+	// Read and cache the whole piece, as the rest of it is likely to be wanted soon
+	pieceLength := dio.fs.PieceLength(index)
+	if pieceLength > dio.readLimit {
+		return dio.fs.GetBlock(index, offset, length)
+	}
+	data, err := dio.fs.GetBlock(index, 0, pieceLength)
+	if err != nil {
+		return
+	}
+	if offset+length > pieceLength {
+		return nil, errors.New("Requested block overran piece length")
+	}
+
+	dio.mutex.Lock()
+	if _, ok := dio.reads[index]; !ok {
+		dio.reads[index] = dio.readOrder.PushFront(&cachedPiece{index: index, data: data})
+		dio.readSize += pieceLength
+		for dio.readSize > dio.readLimit {
+			oldest := dio.readOrder.Remove(dio.readOrder.Back()).(*cachedPiece)
+			delete(dio.reads, oldest.index)
+			dio.readSize -= int64(len(oldest.data))
+		}
+	}
+	dio.mutex.Unlock()
+	return data[offset : offset+length], nil
+}
+
+// WriteBlock buffers a downloaded block. It only blocks if the buffer is full and the
+// job queue is too.
+func (dio *diskIO) WriteBlock(index int, offset int64, data []byte) {
+	dio.mutex.Lock()
+	buf, ok := dio.writes[index]
+	if !ok {
+		buf = &writeBuffer{blocks: make(map[int64][]byte)}
+		dio.writes[index] = buf
+	}
+	if _, ok := buf.blocks[offset]; !ok {
+		buf.blocks[offset] = data
+		buf.size += int64(len(data))
+		dio.writeSize += int64(len(data))
+	}
+
+	// Make room by writing out the largest partial piece
+	var evict int
+	var evicted map[int64][]byte
+	if dio.writeSize > dio.writeLimit {
+		var largest *writeBuffer
+		for i, b := range dio.writes {
+			if largest == nil || b.size > largest.size {
+				evict, largest = i, b
+			}
+		}
+		evicted = largest.blocks
+		dio.writeSize -= largest.size
+		largest.blocks = make(map[int64][]byte)
+		largest.size = 0
+		largest.flushed = true
+		largest.flushing.Add(1)
+		buf = largest
+	}
+	dio.mutex.Unlock()
+
+	if evicted == nil {
+		return
+	}
+	ok = dio.submit(func() {
+		for offset, data := range evicted {
+			if err := dio.fs.SetBlock(evict, offset, data); err != nil {
+				dio.mutex.Lock()
+				if buf.err == nil {
+					buf.err = err
+				}
+				dio.mutex.Unlock()
+			}
+		}
+		buf.flushing.Done()
+	})
+	if !ok {
+		buf.flushing.Done()
+	}
+}
+
+// VerifyPiece hashes a piece whose blocks have all been passed to WriteBlock, writing it
+// to disk if it is good, and calls done with the result on a worker. If the piece is bad
+// its contents are passed to done, so the culprit can be found.
+func (dio *diskIO) VerifyPiece(index int, done func(ok bool, bad []byte, err error)) {
+	dio.mutex.Lock()
+	buf := dio.writes[index]
+	delete(dio.writes, index)
+	if buf != nil {
+		dio.writeSize -= buf.size
+	}
+	dio.mutex.Unlock()
+
+	ok := dio.submit(func() {
+		done(dio.verifyPiece(index, buf))
+	})
+	if !ok {
+		done(false, nil, errDiskClosed)
+	}
+}
+
+func (dio *diskIO) verifyPiece(index int, buf *writeBuffer) (ok bool, bad []byte, err error) {
+	if buf == nil {
+		return dio.validatePiece(index)
+	}
+
+	if !buf.flushed {
+		// The whole piece is in memory, so it can be checked before it is written
+		data := make([]byte, dio.fs.PieceLength(index))
+		for offset, block := range buf.blocks {
+			copy(data[offset:], block)
+		}
+		if !dio.fs.CheckPiece(index, data) {
+			return false, data, nil
+		}
+		return true, nil, dio.fs.SetBlock(index, 0, data)
+	}
+
+	buf.flushing.Wait()
+	dio.mutex.Lock()
+	err = buf.err
+	dio.mutex.Unlock()
+	if err != nil {
+		return
+	}
+	for offset, block := range buf.blocks {
+		if err = dio.fs.SetBlock(index, offset, block); err != nil {
+			return
+		}
+	}
+	return dio.validatePiece(index)
+}
+
+// validatePiece checks a piece on disk, returning its contents if it is bad.
+func (dio *diskIO) validatePiece(index int) (ok bool, bad []byte, err error) {
+	if ok, err = dio.fs.ValidatePiece(index); ok || err != nil {
+		return
+	}
+	bad, err = dio.fs.GetBlock(index, 0, dio.fs.PieceLength(index))
+	return
+}
@@ -0,0 +1,123 @@
+package libtorrent
+
+import (
+	"bytes"
+	"github.com/torrance/libtorrent/filestore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestDiskIO returns disk I/O over an empty copy of the test torrent's file.
+func newTestDiskIO(t *testing.T, cacheSize int64) (dio *diskIO, path string, cleanup func()) {
+	tmpDir, removeDir := tempDir(t)
+	m := testMetainfo()
+	tfile, err := filestore.NewTorrentFile(tmpDir, "test.txt", 36880)
+	if err != nil {
+		removeDir()
+		t.Fatal("Failed to create file: ", err)
+	}
+	fs, _ := filestore.NewFileStore([]filestore.TorrentStorer{tfile}, m.Pieces, m.PieceLength)
+	dio = newDiskIO(fs, cacheSize, 2)
+	return dio, filepath.Join(tmpDir, "test.txt"), func() {
+		dio.Close()
+		fs.Close()
+		removeDir()
+	}
+}
+
+func verify(dio *diskIO, index int) (ok bool, err error) {
+	done := make(chan struct{})
+	dio.VerifyPiece(index, func(o bool, _ []byte, e error) {
+		ok, err = o, e
+		close(done)
+	})
+	<-done
+	return
+}
+
+func TestDiskIOWritesWholePieces(t *testing.T) {
+	dio, path, cleanup := newTestDiskIO(t, 0)
+	defer cleanup()
+	data := testData(t)
+
+	// Bad pieces never reach the disk
+	dio.WriteBlock(1, 0, make([]byte, 4112))
+	if ok, err := verify(dio, 1); ok || err != nil {
+		t.Error("Bad piece verified: ", ok, err)
+	}
+
+	dio.WriteBlock(0, 16384, data[16384:32768])
+	dio.WriteBlock(0, 0, data[:16384])
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b[:32768], make([]byte, 32768)) {
+		t.Error("Blocks written before their piece was complete")
+	}
+	if ok, err := verify(dio, 0); !ok || err != nil {
+		t.Fatal("Good piece failed to verify: ", err)
+	}
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b[:32768], data[:32768]) {
+		t.Error("Verified piece not written")
+	}
+	if dio.writeSize != 0 || len(dio.writes) != 0 {
+		t.Error("Write buffer not emptied: ", dio.writeSize)
+	}
+}
+
+func TestDiskIOWriteBufferFull(t *testing.T) {
+	// Room for only one block, so the first piece is written out early
+	dio, path, cleanup := newTestDiskIO(t, 2*16384)
+	defer cleanup()
+	data := testData(t)
+
+	dio.WriteBlock(0, 0, data[:16384])
+	dio.WriteBlock(0, 16384, data[16384:32768])
+	dio.Wait()
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b[:32768], data[:32768]) {
+		t.Error("Full buffer not written out")
+	}
+	if ok, err := verify(dio, 0); !ok || err != nil {
+		t.Error("Piece written early failed to verify: ", err)
+	}
+
+	// The largest piece is written out first, leaving smaller ones buffered
+	bad := bytes.Repeat([]byte{0xff}, 4112)
+	dio.WriteBlock(1, 0, bad)
+	dio.WriteBlock(0, 0, data[:16384])
+	dio.Wait()
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b[32768:], make([]byte, 4112)) {
+		t.Error("Smaller piece written out")
+	}
+	if ok, _ := verify(dio, 1); ok {
+		t.Error("Bad piece verified")
+	}
+}
+
+func TestDiskIOReadCache(t *testing.T) {
+	dio, path, cleanup := newTestDiskIO(t, 0)
+	defer cleanup()
+	data := testData(t)
+	ioutil.WriteFile(path, data, os.ModePerm)
+
+	block, err := dio.Read(1, 100, 200)
+	if err != nil || !bytes.Equal(block, data[32868:33068]) {
+		t.Fatal("Incorrect block read: ", err)
+	}
+
+	// Later reads of the piece come from the cache rather than the disk
+	ioutil.WriteFile(path, make([]byte, len(data)), os.ModePerm)
+	if block, _ = dio.Read(1, 0, 4112); !bytes.Equal(block, data[32768:]) {
+		t.Error("Piece not cached")
+	}
+	if block, _ = dio.Read(0, 0, 10); !bytes.Equal(block, make([]byte, 10)) {
+		t.Error("Uncached piece not read from disk")
+	}
+	if _, err = dio.Read(1, 4000, 200); err == nil {
+		t.Error("Expected error reading beyond the piece")
+	}
+
+	dio.Close()
+	if _, err = dio.Read(0, 0, 10); err != errDiskClosed {
+		t.Error("Expected closed error, got: ", err)
+	}
+}
@@ -0,0 +1,149 @@
+package libtorrent
+
+import (
+	"time"
+)
+
+// updateInterest tells the peer whether it has any pieces we want. It must be called
+// whenever either our bitfield or the peer's changes, and only sends a message when
+// our interest actually changes.
+func (t *Torrent) updateInterest(p *peer) {
+	interested := t.State() == Leeching && t.picker.Interesting(p.Bitfield())
+	if interested == p.GetAmInterested() {
+		return
+	}
+	p.SetAmInterested(interested)
+	if interested {
+		logger.Debug("Peer %s has pieces we want, sending interested", p.name)
+		p.Send(&interestedMessage{})
+	} else {
+		logger.Debug("Peer %s has no pieces we want, sending uninterested", p.name)
+		p.Send(&uninterestedMessage{})
+	}
+}
+
+// rechoke unchokes the peer if it is interested in us, and chokes it once it is not.
+// TODO: Implement maximum unchoked peers
+// TODO: Implement optimistic unchoking algorithm
+func (t *Torrent) rechoke(p *peer) {
+	interested, choking := p.GetPeerInterested(), p.GetAmChoking()
+	if interested && choking {
+		logger.Debug("Unchoking peer %s", p.name)
+		p.SetAmChoking(false)
+		p.Send(&unchokeMessage{})
+	} else if !interested && !choking {
+		logger.Debug("Choking uninterested peer %s", p.name)
+		p.SetAmChoking(true)
+		p.Send(&chokeMessage{})
+	}
+}
+
+// requestBlocks tops up the peer's outstanding block requests.
+func (t *Torrent) requestBlocks(p *peer) {
+	if t.State() != Leeching || p.GetPeerChoking() || !p.GetAmInterested() {
+		return
+	}
+
+	for _, b := range t.picker.Pick(p, p.Bitfield(), maxPeerRequests-p.RequestCount()) {
+		p.AddRequest(b)
+		p.Send(&requestMessage{
+			pieceIndex:  uint32(b.piece),
+			blockOffset: uint32(b.offset),
+			blockLength: uint32(b.length),
+		})
+	}
+}
+
+// receiveBlock stores a block sent to us by the peer, verifying the piece once all of
+// its blocks have arrived.
+func (t *Torrent) receiveBlock(p *peer, msg *pieceMessage) {
+	b := block{piece: int(msg.pieceIndex), offset: int64(msg.blockOffset), length: int64(len(msg.data))}
+	p.RemoveRequest(b)
+
+	others, complete, ok := t.picker.Received(p, b)
+	if !ok {
+		logger.Debug("Peer %s sent a block we don't need (%d, %d, %d)", p.name, b.piece, b.offset, b.length)
+		return
+	}
+
+	// In endgame others may also have been asked for this block
+	for _, q := range others {
+		if q.RemoveRequest(b) {
+			logger.Debug("Cancelling request for block (%d, %d, %d) from peer %s", b.piece, b.offset, b.length, q.name)
+			q.Send(&cancelMessage{
+				pieceIndex:  msg.pieceIndex,
+				blockOffset: msg.blockOffset,
+				blockLength: uint32(b.length),
+			})
+			t.requestBlocks(q)
+		}
+	}
+
+	t.bans.Received(b.piece, b.offset, msg.data)
+	t.disk.WriteBlock(b.piece, b.offset, msg.data)
+	if complete {
+		t.disk.VerifyPiece(b.piece, func(ok bool, bad []byte, err error) {
+			t.pieceVerified(b.piece, ok, bad, err)
+		})
+	}
+}
+
+// pieceVerified is called by the disk workers once a fully downloaded piece has been
+// checked against its hash. Good pieces are announced to all peers; bad pieces are
+// discarded so they will be downloaded again, and the peers that sent them blamed.
+func (t *Torrent) pieceVerified(index int, ok bool, bad []byte, err error) {
+	if err != nil {
+		logger.Error("Failed to write or validate piece %d: %s", index, err)
+		t.publish(Event{Type: FileErrorEvent, Piece: index, Err: err})
+		t.picker.Failed(index)
+		t.repick()
+		return
+	} else if !ok {
+		logger.Info("Piece %d failed hash check", index)
+		t.publish(Event{Type: HashFailedEvent, Piece: index})
+		t.hashFailed(index, bad, t.picker.Failed(index))
+		t.repick()
+		return
+	}
+
+	// Pieces are verified concurrently, so check for completion whilst holding the lock
+	// to be sure only the last piece finishes the torrent
+	t.bitfLock.Lock()
+	t.bitf.SetTrue(index)
+	complete := t.bitf.SumTrue() == t.bitf.Length()
+	t.notifyPieces()
+	t.bitfLock.Unlock()
+	deadline, hadDeadline := t.picker.Finished(index)
+	for _, key := range t.bans.Verified(index) {
+		t.ban(key)
+	}
+
+	logger.Debug("Piece %d complete", index)
+	t.publish(Event{Type: PieceFinishedEvent, Piece: index})
+	if hadDeadline {
+		t.publish(Event{Type: DeadlineFinishedEvent, Piece: index, Late: time.Now().After(deadline)})
+	}
+	if complete {
+		t.finished()
+	}
+
+	for _, p := range t.peers() {
+		p.Send(&haveMessage{pieceIndex: uint32(index)})
+		// We may no longer need anything this peer has
+		t.updateInterest(p)
+	}
+}
+
+// finished moves a torrent that has just completed its download into seeding.
+func (t *Torrent) finished() {
+	logger.Info("Torrent finished: %s", t.meta.Name)
+	t.setState(Seeding)
+	t.publish(Event{Type: TorrentFinishedEvent})
+
+	t.stateLock.Lock()
+	trackers := t.trackers
+	t.stateLock.Unlock()
+	for _, tkr := range trackers {
+		tkr.Completed()
+	}
+}
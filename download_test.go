@@ -0,0 +1,290 @@
+package libtorrent
+
+import (
+	"bytes"
+	"github.com/torrance/libtorrent/bitfield"
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func testData(t *testing.T) []byte {
+	data, err := ioutil.ReadFile(filepath.Join("testData", "test.txt"))
+	if err != nil {
+		t.Fatal("Failed to read test data: ", err)
+	}
+	return data
+}
+
+func fullBitfield(n int) *bitfield.Bitfield {
+	bitf := bitfield.NewBitfield(n)
+	for i := 0; i < n; i++ {
+		bitf.SetTrue(i)
+	}
+	return bitf
+}
+
+// seed sends a full bitfield and unchokes the torrent.
+func (rp *testRemotePeer) seed(t *testing.T) {
+	if _, ok := rp.expect(t).(*bitfieldMessage); !ok {
+		t.Fatal("Expected bitfield on connect")
+	}
+	rp.send(t, &bitfieldMessage{bitf: fullBitfield(2)})
+	if _, ok := rp.expect(t).(*interestedMessage); !ok {
+		t.Fatal("Expected interested after sending bitfield")
+	}
+	rp.send(t, &unchokeMessage{})
+}
+
+// expectRequest waits for the torrent to request a block.
+func (rp *testRemotePeer) expectRequest(t *testing.T) *requestMessage {
+	for {
+		switch msg := rp.expect(t).(type) {
+		case *requestMessage:
+			return msg
+		case *haveMessage, *cancelMessage:
+			// Ignore
+		default:
+			t.Fatalf("Expected request, got %#v", msg)
+		}
+	}
+}
+
+// respond sends the requested block, taken from data.
+func (rp *testRemotePeer) respond(t *testing.T, req *requestMessage, data []byte) {
+	start := int64(req.pieceIndex)*32768 + int64(req.blockOffset)
+	rp.send(t, &pieceMessage{
+		pieceIndex:  req.pieceIndex,
+		blockOffset: req.blockOffset,
+		data:        data[start : start+int64(req.blockLength)],
+	})
+}
+
+func TestDownload(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	sub := tor.Subscribe(StatusEvents | PieceEvents)
+	defer sub.Close()
+	tor.Start()
+
+	data := testData(t)
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.seed(t)
+
+	// 36880 bytes is three blocks: two in the first piece and one in the second
+	for i := 0; i < 3; i++ {
+		rp.respond(t, rp.expectRequest(t), data)
+	}
+
+	expectEvents(t, sub, StateChangedEvent, PieceFinishedEvent, PieceFinishedEvent, StateChangedEvent, TorrentFinishedEvent)
+	if tor.State() != Seeding {
+		t.Error("Torrent not seeding after download, state: ", tor.State())
+	}
+
+	// Once complete, the peer is told about both pieces and that we're no longer interested
+	haves := make(map[uint32]bool)
+	uninterested := false
+	for len(haves) < 2 || !uninterested {
+		switch msg := rp.expect(t).(type) {
+		case *haveMessage:
+			haves[msg.pieceIndex] = true
+		case *uninterestedMessage:
+			uninterested = true
+		}
+	}
+
+	block, err := tor.fileStore.GetBlock(1, 0, 4112)
+	if err != nil || !bytes.Equal(block, data[32768:]) {
+		t.Error("Downloaded data incorrect: ", err)
+	}
+	if tor.Downloaded() != 36880 || tor.Left() != 0 {
+		t.Error("Incorrect downloaded or left: ", tor.Downloaded(), tor.Left())
+	}
+}
+
+func TestDownloadHashFailure(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	sub := tor.Subscribe(PieceEvents)
+	defer sub.Close()
+	tor.Start()
+
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.seed(t)
+
+	// Send garbage for the second piece, then the real data when it is requested again
+	data := testData(t)
+	bad := make([]byte, len(data))
+	for i := 0; i < 3; i++ {
+		rp.respond(t, rp.expectRequest(t), bad)
+	}
+	for i := 0; i < 3; i++ {
+		rp.respond(t, rp.expectRequest(t), data)
+	}
+
+	expectEvents(t, sub, HashFailedEvent, HashFailedEvent, PieceFinishedEvent, PieceFinishedEvent)
+}
+
+func TestEndgame(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	tor.Start()
+
+	// The first peer is asked for every block
+	first := newTestRemotePeer(tor, "-TR2940-aaaaaaaaaaaa")
+	first.seed(t)
+	var reqs []*requestMessage
+	for i := 0; i < 3; i++ {
+		reqs = append(reqs, first.expectRequest(t))
+	}
+	if tor.picker.InEndgame() {
+		t.Error("Endgame started before all blocks were requested")
+	}
+
+	// With nothing left to request, the second peer is sent duplicate requests
+	second := newTestRemotePeer(tor, "-TR2940-bbbbbbbbbbbb")
+	second.seed(t)
+	for i := 0; i < 3; i++ {
+		second.expectRequest(t)
+	}
+	if !tor.picker.InEndgame() {
+		t.Error("Torrent not in endgame")
+	}
+
+	// The second peer must be told to cancel blocks as the first delivers them
+	data := testData(t)
+	first.respond(t, reqs[0], data)
+	for {
+		if msg, ok := second.expect(t).(*cancelMessage); ok {
+			if msg.pieceIndex != reqs[0].pieceIndex || msg.blockOffset != reqs[0].blockOffset || msg.blockLength != reqs[0].blockLength {
+				t.Errorf("Incorrect cancel: %#v", msg)
+			}
+			break
+		}
+	}
+	waitFor(t, "request to be cancelled", func() bool {
+		for _, info := range tor.Peers() {
+			if string(info.PeerId) == "-TR2940-bbbbbbbbbbbb" {
+				return info.OutstandingRequests == 2
+			}
+		}
+		return false
+	})
+}
+
+func TestCancelDropsQueuedPiece(t *testing.T) {
+	p := &peer{queued: make(chan struct{}, 1), closed: make(chan struct{})}
+	p.Send(&pieceMessage{pieceIndex: 1, blockOffset: 16384, data: make([]byte, 100)})
+	p.Send(&haveMessage{pieceIndex: 2})
+
+	if p.CancelPiece(1, 16384, 99) {
+		t.Error("Cancelled piece with mismatched length")
+	}
+	if !p.CancelPiece(1, 16384, 100) {
+		t.Error("Failed to cancel queued piece")
+	}
+	if msg, ok := p.dequeue().(*haveMessage); !ok || msg.pieceIndex != 2 {
+		t.Error("Other queued messages disturbed by cancel")
+	}
+	if p.dequeue() != nil {
+		t.Error("Cancelled piece still queued")
+	}
+}
+
+func TestQueuedPiecesLimit(t *testing.T) {
+	defer func(n int) { maxQueuedPieces = n }(maxQueuedPieces)
+	maxQueuedPieces = 2
+
+	p := &peer{queued: make(chan struct{}, 1), closed: make(chan struct{})}
+	if !p.reservePiece() || !p.reservePiece() || p.reservePiece() {
+		t.Fatal("Reservations not limited")
+	}
+	// Writing, cancelling or abandoning a piece each free a slot
+	p.Send(&pieceMessage{pieceIndex: 0, data: make([]byte, 100)})
+	p.Send(&pieceMessage{pieceIndex: 1, data: make([]byte, 100)})
+	p.dequeue()
+	p.CancelPiece(1, 0, 100)
+	if !p.reservePiece() || !p.reservePiece() || p.reservePiece() {
+		t.Fatal("Slots not freed by writing and cancelling")
+	}
+	p.releasePiece()
+	if !p.reservePiece() {
+		t.Error("Slot not freed by release")
+	}
+}
+
+func TestQueuedPiecesLimitRefusesRequests(t *testing.T) {
+	defer func(n int) { maxQueuedPieces = n }(maxQueuedPieces)
+	maxQueuedPieces = 2
+
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, tmpDir)
+	defer tor.Stop()
+	tor.Start()
+
+	// The test peer buffers 100 messages before it stops reading, so most of these
+	// requests arrive whilst its connection is backed up
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.send(t, &interestedMessage{})
+	const requests = 200
+	for i := 0; i < requests; i++ {
+		rp.send(t, &requestMessage{pieceIndex: 0, blockOffset: 0, blockLength: blockSize})
+	}
+
+	pieces := 0
+	for {
+		select {
+		case msg := <-rp.msgs:
+			if _, ok := msg.(*pieceMessage); ok {
+				pieces++
+			}
+			continue
+		case <-time.After(time.Millisecond * 200):
+		}
+		break
+	}
+	if pieces == 0 || pieces >= requests {
+		t.Error("Requests not limited whilst backed up: ", pieces)
+	}
+}
+
+func TestInterestChangesChoke(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	tor.Start()
+
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.expect(t)
+
+	// We have nothing, so an interested peer is unchoked and then choked when it loses interest
+	rp.send(t, &interestedMessage{})
+	if _, ok := rp.expect(t).(*unchokeMessage); !ok {
+		t.Fatal("Interested peer not unchoked")
+	}
+	rp.send(t, &uninterestedMessage{})
+	if _, ok := rp.expect(t).(*chokeMessage); !ok {
+		t.Fatal("Uninterested peer not choked")
+	}
+	infos := tor.Peers()
+	if len(infos) != 1 || infos[0].PeerInterested || !infos[0].AmChoking {
+		t.Errorf("Incorrect peer state: %#v", infos)
+	}
+
+	// A peer that only has pieces we already have isn't interesting
+	bitf := bitfield.NewBitfield(2)
+	bitf.SetTrue(1)
+	rp.send(t, &bitfieldMessage{bitf: bitf})
+	if _, ok := rp.expect(t).(*interestedMessage); !ok {
+		t.Fatal("Expected interested")
+	}
+	rp.send(t, &unchokeMessage{})
+	rp.respond(t, rp.expectRequest(t), testData(t))
+	if _, ok := rp.expect(t).(*haveMessage); !ok {
+		t.Fatal("Expected have")
+	}
+	if _, ok := rp.expect(t).(*uninterestedMessage); !ok {
+		t.Fatal("Expected uninterested once we have every piece the peer has")
+	}
+}
@@ -0,0 +1,178 @@
+package libtorrent
+
+import (
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+type EventType int
+
+const (
+	StateChangedEvent EventType = iota
+	TorrentFinishedEvent
+	TorrentAddedEvent
+	TorrentRemovedEvent
+	MetadataReceivedEvent // Not currently sent: torrents are always created with their metainfo
+	PieceFinishedEvent
+	HashFailedEvent
+	PeerConnectedEvent
+	PeerDisconnectedEvent
+	TrackerAnnounceEvent
+	TrackerErrorEvent
+	FileErrorEvent
+	DeadlineFinishedEvent
+	PeerBannedEvent
+	SeedingGoalReachedEvent
+)
+
+var eventNames = []string{
+	"StateChanged",
+	"TorrentFinished",
+	"TorrentAdded",
+	"TorrentRemoved",
+	"MetadataReceived",
+	"PieceFinished",
+	"HashFailed",
+	"PeerConnected",
+	"PeerDisconnected",
+	"TrackerAnnounce",
+	"TrackerError",
+	"FileError",
+	"DeadlineFinished",
+	"PeerBanned",
+	"SeedingGoalReached",
+}
+
+func (et EventType) String() string {
+	if int(et) < 0 || int(et) >= len(eventNames) {
+		return fmt.Sprintf("EventType(%d)", int(et))
+	}
+	return eventNames[et]
+}
+
+// EventCategory is a bitmask used to select which events a subscriber receives.
+type EventCategory uint
+
+const (
+	StatusEvents EventCategory = 1 << iota
+	PieceEvents
+	PeerEvents
+	TrackerEvents
+	StorageEvents
+
+	AllEvents = StatusEvents | PieceEvents | PeerEvents | TrackerEvents | StorageEvents
+)
+
+func (et EventType) Category() EventCategory {
+	switch et {
+	case PieceFinishedEvent, HashFailedEvent, DeadlineFinishedEvent:
+		return PieceEvents
+	case PeerConnectedEvent, PeerDisconnectedEvent, PeerBannedEvent:
+		return PeerEvents
+	case TrackerAnnounceEvent, TrackerErrorEvent:
+		return TrackerEvents
+	case FileErrorEvent:
+		return StorageEvents
+	}
+	return StatusEvents
+}
+
+// Event describes something that happened to a torrent. Only the fields relevant to
+// the event's Type are set.
+type Event struct {
+	Type     EventType
+	Time     time.Time
+	InfoHash []byte
+	State    int    // StateChanged
+	Piece    int    // PieceFinished, HashFailed, DeadlineFinished
+	Late     bool   // DeadlineFinished: the piece was verified after its deadline
+	Peer     string // PeerConnected, PeerDisconnected, PeerBanned (by address)
+	Tracker  string // TrackerAnnounce, TrackerError
+	Peers    int    // TrackerAnnounce: number of peers received
+	Err      error  // TrackerError, FileError
+}
+
+func (ev Event) String() string {
+	return fmt.Sprintf("[%s %x state: %d piece: %d peer: %s tracker: %s err: %v]", ev.Type, ev.InfoHash, ev.State, ev.Piece, ev.Peer, ev.Tracker, ev.Err)
+}
+
+// EventBufferSize is the number of events buffered for each subscriber. Events are
+// dropped, rather than blocking the torrent, if a subscriber falls this far behind.
+const EventBufferSize = 256
+
+// Subscription receives events on C until it is closed.
+type Subscription struct {
+	C       <-chan Event
+	c       chan Event
+	filter  EventCategory
+	dropped int64
+	bus     *eventBus
+}
+
+// Dropped returns the number of events discarded because C was full.
+func (sub *Subscription) Dropped() int64 {
+	return atomic.LoadInt64(&sub.dropped)
+}
+
+// Close unsubscribes. C is closed once no more events will be delivered on it.
+func (sub *Subscription) Close() {
+	sub.bus.unsubscribe(sub)
+}
+
+// eventBus fans events out to subscribers without ever blocking the publisher. Events
+// are also passed on to parent, if set, so that a session sees its torrents' events.
+type eventBus struct {
+	subs   map[*Subscription]bool
+	parent *eventBus
+	mutex  sync.RWMutex
+}
+
+func newEventBus(parent *eventBus) *eventBus {
+	return &eventBus{
+		subs:   make(map[*Subscription]bool),
+		parent: parent,
+	}
+}
+
+func (bus *eventBus) subscribe(filter EventCategory) *Subscription {
+	c := make(chan Event, EventBufferSize)
+	sub := &Subscription{C: c, c: c, filter: filter, bus: bus}
+	bus.mutex.Lock()
+	bus.subs[sub] = true
+	bus.mutex.Unlock()
+	return sub
+}
+
+func (bus *eventBus) unsubscribe(sub *Subscription) {
+	bus.mutex.Lock()
+	if bus.subs[sub] {
+		delete(bus.subs, sub)
+		close(sub.c)
+	}
+	bus.mutex.Unlock()
+}
+
+func (bus *eventBus) publish(ev Event) {
+	if ev.Time.IsZero() {
+		ev.Time = time.Now()
+	}
+
+	bus.mutex.RLock()
+	for sub := range bus.subs {
+		if sub.filter&ev.Type.Category() == 0 {
+			continue
+		}
+		select {
+		case sub.c <- ev:
+		default:
+			atomic.AddInt64(&sub.dropped, 1)
+		}
+	}
+	bus.mutex.RUnlock()
+
+	if bus.parent != nil {
+		bus.parent.publish(ev)
+	}
+}
@@ -0,0 +1,126 @@
+package libtorrent
+
+import (
+	"testing"
+	"time"
+)
+
+// expectEvents reads len(want) events from sub, failing if their types don't match.
+func expectEvents(t *testing.T, sub *Subscription, want ...EventType) {
+	for i, et := range want {
+		select {
+		case ev := <-sub.C:
+			if ev.Type != et {
+				t.Fatalf("Event %d: expected %s, got %s", i, et, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %d: timed out waiting for %s", i, et)
+		}
+	}
+	select {
+	case ev := <-sub.C:
+		t.Fatalf("Unexpected event: %s", ev)
+	default:
+	}
+}
+
+func TestTorrentEvents(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+
+	all := tor.Subscribe(AllEvents)
+	peers := tor.Subscribe(PeerEvents)
+	defer all.Close()
+
+	tor.Start()
+	connectTestPeer(tor)
+	tor.Pause()
+	tor.Resume()
+	tor.Stop()
+
+	expectEvents(t, all,
+		StateChangedEvent, PeerConnectedEvent, PeerDisconnectedEvent, StateChangedEvent,
+		StateChangedEvent, StateChangedEvent)
+	expectEvents(t, peers, PeerConnectedEvent, PeerDisconnectedEvent)
+
+	peers.Close()
+	if _, ok := <-peers.C; ok {
+		t.Error("Subscription channel not closed")
+	}
+	peers.Close() // Must be safe to call twice
+}
+
+func TestStateChangedEventSequence(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+
+	sub := tor.Subscribe(StatusEvents)
+	defer sub.Close()
+
+	tor.Start()
+	tor.Pause()
+	tor.Stop()
+	tor.Start()
+
+	for i, state := range []int{Leeching, Paused, Stopped, Checking, Leeching} {
+		select {
+		case ev := <-sub.C:
+			if ev.Type != StateChangedEvent || ev.State != state {
+				t.Errorf("Event %d: expected state %d, got %s", i, state, ev)
+			}
+			if ev.Time.IsZero() || string(ev.InfoHash) != string(tor.InfoHash()) {
+				t.Errorf("Event %d: time or infohash not set: %s", i, ev)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("Event %d: timed out", i)
+		}
+	}
+}
+
+func TestEventBusDoesNotBlock(t *testing.T) {
+	bus := newEventBus(nil)
+	sub := bus.subscribe(AllEvents)
+
+	done := make(chan struct{})
+	go func() {
+		for i := 0; i < EventBufferSize+10; i++ {
+			bus.publish(Event{Type: PieceFinishedEvent, Piece: i})
+		}
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Publishing blocked on a full subscriber")
+	}
+	if sub.Dropped() != 10 {
+		t.Error("Incorrect dropped count: ", sub.Dropped())
+	}
+	if ev := <-sub.C; ev.Piece != 0 {
+		t.Error("Oldest event not delivered first: ", ev)
+	}
+}
+
+func TestSessionEvents(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	s, err := NewSession(&Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+
+	sub := s.Subscribe(StatusEvents)
+	defer sub.Close()
+
+	m := testMetainfo()
+	if _, err = s.AddTorrent(m); err != nil {
+		t.Fatal("Failed to add torrent: ", err)
+	}
+	s.RemoveTorrent(m.InfoHash, false)
+
+	// Queued, Leeching, then Stopped
+	expectEvents(t, sub, TorrentAddedEvent, StateChangedEvent, StateChangedEvent, StateChangedEvent, TorrentRemovedEvent)
+}
@@ -0,0 +1,68 @@
+package libtorrent
+
+import (
+	"net/netip"
+	"sync"
+)
+
+// externalAddrs records our address in each family as seen from outside, which may
+// differ from the addresses we listen on when behind NAT, and our listening port as
+// mapped on the gateway.
+type externalAddrs struct {
+	v4    netip.Addr
+	v6    netip.Addr
+	port  uint16 // Zero until mapped
+	mutex sync.Mutex
+}
+
+func (ea *externalAddrs) get() (v4 netip.Addr, v6 netip.Addr) {
+	ea.mutex.Lock()
+	defer ea.mutex.Unlock()
+	return ea.v4, ea.v6
+}
+
+// set records addr as our address in its family. Private and unspecified addresses are
+// ignored, as they can't be reached from outside.
+func (ea *externalAddrs) set(addr netip.Addr) {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return
+	}
+	ea.mutex.Lock()
+	if addr.Is4() {
+		ea.v4 = addr
+	} else {
+		ea.v6 = addr
+	}
+	ea.mutex.Unlock()
+}
+
+func (ea *externalAddrs) getPort() uint16 {
+	ea.mutex.Lock()
+	defer ea.mutex.Unlock()
+	return ea.port
+}
+
+func (ea *externalAddrs) setPort(port uint16) {
+	ea.mutex.Lock()
+	ea.port = port
+	ea.mutex.Unlock()
+}
+
+// ExternalAddrs returns our IPv4 and IPv6 addresses as last reported by a tracker or
+// gateway. An address is invalid if it isn't known.
+func (t *Torrent) ExternalAddrs() (v4 netip.Addr, v6 netip.Addr) {
+	return t.limits.external.get()
+}
+
+// ExternalAddrs returns our IPv4 and IPv6 addresses as last reported by a tracker or
+// gateway. An address is invalid if it isn't known.
+func (s *Session) ExternalAddrs() (v4 netip.Addr, v6 netip.Addr) {
+	return s.limits.external.get()
+}
+
+// ExternalPort returns our listening port as mapped on the gateway, or zero if it hasn't
+// been mapped.
+func (s *Session) ExternalPort() uint16 {
+	return s.limits.external.getPort()
+}
@@ -0,0 +1,47 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/portmap"
+	"net/netip"
+	"testing"
+)
+
+func TestExternalAddrs(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+
+	obs := trackerObserver{tor}
+	obs.SetExternalAddr(netip.MustParseAddr("::ffff:203.0.113.5"))
+	obs.SetExternalAddr(netip.MustParseAddr("2001:db8::1"))
+	obs.SetExternalAddr(netip.MustParseAddr("192.168.1.2")) // Private, so ignored
+	v4, v6 := tor.ExternalAddrs()
+	if v4.String() != "203.0.113.5" || v6.String() != "2001:db8::1" {
+		t.Error("Incorrect external addresses: ", v4, v6)
+	}
+}
+
+func TestSessionPortMapped(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := NewSession(&Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+	tor, err := s.AddTorrent(testMetainfo())
+	if err != nil {
+		t.Fatal("Failed to add torrent: ", err)
+	}
+
+	if tor.Port() != 0 || s.ExternalPort() != 0 {
+		t.Error("Incorrect port before mapping: ", tor.Port(), s.ExternalPort())
+	}
+	s.portMapped(portmap.UDP, netip.MustParseAddrPort("203.0.113.5:7000"))
+	s.portMapped(portmap.TCP, netip.MustParseAddrPort("203.0.113.5:51413"))
+	if v4, _ := s.ExternalAddrs(); v4.String() != "203.0.113.5" {
+		t.Error("Incorrect external address: ", v4)
+	}
+	if uint16(tor.Port()) != 51413 || s.ExternalPort() != 51413 {
+		t.Error("Mapped port not announced: ", uint16(tor.Port()), s.ExternalPort())
+	}
+}
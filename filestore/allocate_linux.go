@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package filestore
+
+import (
+	"os"
+	"syscall"
+)
+
+// allocate reserves the file's space from offset to length with fallocate, falling back
+// to writing zeros on filesystems that don't support it.
+func allocate(fd *os.File, offset int64, length int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), 0, offset, length-offset)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return fillZeros(fd, offset, length)
+	}
+	return err
+}
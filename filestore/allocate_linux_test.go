@@ -0,0 +1,32 @@
+package filestore
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+func TestFallocate(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tfile, err := OpenTorrentFile(tmpDir, "file.txt", 1<<20, AllocateFull, OversizedFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tfile.Close()
+
+	var stat syscall.Stat_t
+	if err := syscall.Stat(filepath.Join(tmpDir, "file.txt"), &stat); err != nil {
+		t.Fatal(err)
+	}
+	// Blocks are counted in 512 byte units
+	if stat.Size != 1<<20 || stat.Blocks*512 < 1<<20 {
+		t.Error("File not fully allocated: ", stat.Size, stat.Blocks)
+	}
+}
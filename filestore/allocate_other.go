@@ -0,0 +1,13 @@
+//go:build !linux
+// +build !linux
+
+package filestore
+
+import (
+	"os"
+)
+
+// allocate reserves the file's space from offset to length by writing zeros.
+func allocate(fd *os.File, offset int64, length int64) error {
+	return fillZeros(fd, offset, length)
+}
@@ -9,6 +9,7 @@ import (
 	"io"
 	"os"
 	"path/filepath"
+	"sync"
 )
 
 type FileStore struct {
@@ -37,7 +38,7 @@ func (fs *FileStore) Validate() (bitf *bitfield.Bitfield, err error) {
 
 	for i, _ := range fs.hashes {
 		var ok bool
-		ok, err = fs.validatePiece(i)
+		ok, err = fs.ValidatePiece(i)
 		if err != nil {
 			return
 		} else if ok {
@@ -47,30 +48,34 @@ func (fs *FileStore) Validate() (bitf *bitfield.Bitfield, err error) {
 	return
 }
 
-func (fs *FileStore) validatePiece(index int) (ok bool, err error) {
-	block, err := fs.GetBlock(index, 0, fs.getPieceLength(index))
+// ValidatePiece reads the piece from disk and checks it against its hash.
+func (fs *FileStore) ValidatePiece(index int) (ok bool, err error) {
+	block, err := fs.GetBlock(index, 0, fs.PieceLength(index))
 	if err != nil {
 		return
 	}
+	ok = fs.CheckPiece(index, block)
+	return
+}
 
+// CheckPiece checks the complete data of a piece against its hash, without touching
+// the disk.
+func (fs *FileStore) CheckPiece(index int, data []byte) bool {
 	h := sha1.New()
-	h.Write(block)
-	if bytes.Equal(h.Sum(nil), fs.hashes[index]) {
-		ok = true
-	}
-	return
+	h.Write(data)
+	return bytes.Equal(h.Sum(nil), fs.hashes[index])
 }
 
-func (fs *FileStore) getPieceLength(index int) int64 {
+func (fs *FileStore) PieceLength(index int) int64 {
 	if index == len(fs.hashes)-1 {
-		return fs.totalLength % fs.pieceLength
+		return fs.totalLength - int64(index)*fs.pieceLength
 	} else {
 		return fs.pieceLength
 	}
 }
 
 func (fs *FileStore) GetBlock(pieceIndex int, offset int64, length int64) (block []byte, err error) {
-	if length+offset > fs.getPieceLength(pieceIndex) {
+	if length+offset > fs.PieceLength(pieceIndex) {
 		err = errors.New("Requested block overran piece length")
 		return
 	}
@@ -104,18 +109,100 @@ func (fs *FileStore) GetBlock(pieceIndex int, offset int64, length int64) (block
 	return
 }
 
+// SetBlock writes block into the piece at the given offset, spanning files as required.
+func (fs *FileStore) SetBlock(pieceIndex int, offset int64, block []byte) (err error) {
+	if int64(len(block))+offset > fs.PieceLength(pieceIndex) {
+		err = errors.New("Block overran piece length")
+		return
+	}
+
+	offset = int64(pieceIndex)*fs.pieceLength + offset
+
+	// fileStart is the offset of the current file within the torrent
+	var fileStart int64
+	for _, tfile := range fs.tfiles {
+		if len(block) == 0 {
+			break
+		}
+		fileEnd := fileStart + tfile.Length()
+		if offset < fileEnd {
+			n := fileEnd - offset
+			if n > int64(len(block)) {
+				n = int64(len(block))
+			}
+			if _, err = tfile.WriteAt(block[:n], offset-fileStart); err != nil {
+				return
+			}
+			block = block[n:]
+			offset += n
+		}
+		fileStart = fileEnd
+	}
+	return
+}
+
+// Close closes any underlying storers that hold open resources.
+func (fs *FileStore) Close() (err error) {
+	for _, tfile := range fs.tfiles {
+		if closer, ok := tfile.(io.Closer); ok {
+			if e := closer.Close(); e != nil {
+				err = e
+			}
+		}
+	}
+	return
+}
+
 type TorrentStorer interface {
 	io.ReaderAt
+	io.WriterAt
 	Length() int64
 }
 
+// Allocation controls how disk space is reserved for torrent files.
+type Allocation int
+
+const (
+	// AllocateSparse extends files to their full length without writing to them, which
+	// leaves holes on most filesystems.
+	AllocateSparse Allocation = iota
+	// AllocateFull reserves every byte up front to avoid fragmentation, using fallocate
+	// on Linux and writing zeros elsewhere.
+	AllocateFull
+	// AllocateLazy doesn't create files until their first block is written.
+	AllocateLazy
+)
+
+// OversizedPolicy decides what happens to an existing file that is larger than the
+// torrent says it should be.
+type OversizedPolicy int
+
+const (
+	// OversizedFail refuses to open the file.
+	OversizedFail OversizedPolicy = iota
+	// OversizedTruncate cuts the file down to size.
+	OversizedTruncate
+	// OversizedForeign treats the file as belonging to someone else: it is used, but
+	// never resized, and the data beyond the torrent's length is left untouched.
+	OversizedForeign
+)
+
 type TorrentFile struct {
-	lth  int64
-	path string
-	fd   *os.File
+	lth        int64
+	path       string
+	absPath    string
+	allocation Allocation
+	fd         *os.File // Nil until first written when allocating lazily
+	mutex      sync.Mutex
 }
 
 func NewTorrentFile(rootDirectory string, path string, length int64) (tfile *TorrentFile, err error) {
+	return OpenTorrentFile(rootDirectory, path, length, AllocateSparse, OversizedFail)
+}
+
+// OpenTorrentFile opens or creates the file at path beneath rootDirectory, allocating
+// space as described by allocation. Existing data is kept.
+func OpenTorrentFile(rootDirectory string, path string, length int64, allocation Allocation, oversized OversizedPolicy) (tfile *TorrentFile, err error) {
 	if len(path) == 0 {
 		err = errors.New("Path must have at least 1 component.")
 		return
@@ -131,47 +218,141 @@ func NewTorrentFile(rootDirectory string, path string, length int64) (tfile *Tor
 		return
 	}
 
-	absPath := filepath.Join(rootDirectory, path)
+	tfile = &TorrentFile{
+		path:       path,
+		absPath:    filepath.Join(rootDirectory, path),
+		lth:        length,
+		allocation: allocation,
+	}
 
-	// Create any required parent directories
-	dirs := filepath.Dir(absPath)
-	if err = os.MkdirAll(dirs, 0755); err != nil {
+	stat, err := os.Stat(tfile.absPath)
+	if os.IsNotExist(err) {
+		err = nil
+		if allocation == AllocateLazy {
+			return
+		}
+	} else if err != nil {
+		tfile = nil
 		return
+	} else if stat.Size() > length {
+		switch oversized {
+		case OversizedFail:
+			err = errors.New("File already exists and is larger than expected size. Aborting.")
+		case OversizedTruncate:
+			err = os.Truncate(tfile.absPath, length)
+		}
+		if err != nil {
+			tfile = nil
+			return
+		}
 	}
 
-	// Create or open file
-	fd, err := os.OpenFile(absPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err = tfile.open(); err != nil {
+		tfile = nil
+	}
+	return
+}
 
-	// Stat for size of file
-	stat, err := fd.Stat()
-	if err != nil {
+// open creates or opens the file and allocates its space. The caller must hold mutex,
+// or be the only user of the file.
+func (tf *TorrentFile) open() (err error) {
+	// Create any required parent directories
+	if err = os.MkdirAll(filepath.Dir(tf.absPath), 0755); err != nil {
 		return
 	}
-	if length-stat.Size() < 0 {
-		err = errors.New("File already exists and is larger than expected size. Aborting.")
+
+	// Create or open file
+	fd, err := os.OpenFile(tf.absPath, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
 		return
 	}
-
-	// Now pad the file from the end until it matches required size
-	err = fd.Truncate(length)
+	stat, err := fd.Stat()
 	if err != nil {
+		fd.Close()
 		return
 	}
 
-	tfile = &TorrentFile{
-		path: path,
-		lth:  length,
-		fd:   fd,
+	// Now pad the file from the end until it matches required size. Oversized files have
+	// already been dealt with.
+	if stat.Size() < tf.lth {
+		if tf.allocation == AllocateFull {
+			err = allocate(fd, stat.Size(), tf.lth)
+		} else {
+			err = fd.Truncate(tf.lth)
+		}
+		if err != nil {
+			fd.Close()
+			return
+		}
 	}
+	tf.fd = fd
+	return
+}
 
+// fillZeros allocates the file from offset to length by writing zeros.
+func fillZeros(fd *os.File, offset int64, length int64) (err error) {
+	zeros := make([]byte, 64*1024)
+	for offset < length {
+		n := int64(len(zeros))
+		if length-offset < n {
+			n = length - offset
+		}
+		if _, err = fd.WriteAt(zeros[:n], offset); err != nil {
+			return
+		}
+		offset += n
+	}
 	return
 }
 
 func (tf *TorrentFile) ReadAt(p []byte, off int64) (n int, err error) {
-	n, err = tf.fd.ReadAt(p, off)
+	tf.mutex.Lock()
+	fd := tf.fd
+	tf.mutex.Unlock()
+	// A foreign file may run on past the torrent's file, so never read beyond its length
+	if off >= tf.lth {
+		return 0, io.EOF
+	}
+	var eof error
+	if remaining := tf.lth - off; int64(len(p)) > remaining {
+		p, eof = p[:remaining], io.EOF
+	}
+	if fd == nil {
+		// Nothing has been written yet, so the file is all zeros
+		for i := range p {
+			p[i] = 0
+		}
+		return len(p), eof
+	}
+	if n, err = fd.ReadAt(p, off); err == nil {
+		err = eof
+	}
+	return
+}
+
+func (tf *TorrentFile) WriteAt(p []byte, off int64) (n int, err error) {
+	tf.mutex.Lock()
+	if tf.fd == nil {
+		if err = tf.open(); err != nil {
+			tf.mutex.Unlock()
+			return
+		}
+	}
+	fd := tf.fd
+	tf.mutex.Unlock()
+	n, err = fd.WriteAt(p, off)
 	return
 }
 
+func (tf *TorrentFile) Close() error {
+	tf.mutex.Lock()
+	defer tf.mutex.Unlock()
+	if tf.fd == nil {
+		return nil
+	}
+	return tf.fd.Close()
+}
+
 func (tf *TorrentFile) Length() int64 {
 	return tf.lth
 }
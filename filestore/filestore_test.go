@@ -2,6 +2,8 @@ package filestore
 
 import (
 	"bytes"
+	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"os"
@@ -29,7 +31,7 @@ func TestGetBlockWithSingleFile(t *testing.T) {
 		t.Errorf("Block contained incorrect values, got [1]: %x", block)
 	}
 
-	pieceLength := fs.getPieceLength(1)
+	pieceLength := fs.PieceLength(1)
 	t.Logf("Piece length: %d", pieceLength)
 	if block, err = fs.GetBlock(1, 0, pieceLength); err != nil {
 		t.Fatalf("Failed to get block [2]: %s", err)
@@ -84,7 +86,7 @@ func TestGetBlockWithMultipleFiles(t *testing.T) {
 	}
 
 	// Test 4: select last piece
-	if block, err = fs.GetBlock(4, 0, fs.getPieceLength(4)); err != nil {
+	if block, err = fs.GetBlock(4, 0, fs.PieceLength(4)); err != nil {
 		t.Fatalf("Failed to get block [4]: %s", err)
 	}
 	if !bytes.Equal(block, []byte{13}) {
@@ -100,6 +102,10 @@ func (stor testTorrentStorer) ReadAt(b []byte, off int64) (n int, err error) {
 	return stor.reader.ReadAt(b, off)
 }
 
+func (stor testTorrentStorer) WriteAt(b []byte, off int64) (n int, err error) {
+	return 0, errors.New("testTorrentStorer is read only")
+}
+
 func (stor testTorrentStorer) Length() int64 {
 	return int64(stor.reader.Len())
 }
@@ -174,7 +180,7 @@ func TestGetBlockWithRealFile(t *testing.T) {
 	}
 
 	// Test loading final piece
-	block, err = fs.GetBlock(1, 0, fs.getPieceLength(1))
+	block, err = fs.GetBlock(1, 0, fs.PieceLength(1))
 	if err != nil {
 		t.Error("Error calling getBlock: ", err)
 	}
@@ -277,3 +283,184 @@ func TestFileStoreWithMultipleFiles(t *testing.T) {
 		t.Errorf("Incorrect bitfield, got: %x", bitf.Bytes())
 	}
 }
+
+func TestSetBlockWithMultipleFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	var tfiles []TorrentStorer
+	for i, length := range []int64{4, 3, 6} {
+		tfile, err := NewTorrentFile(tmpDir, fmt.Sprintf("file%d", i), length)
+		if err != nil {
+			t.Fatal("Failed to create file: ", err)
+		}
+		tfiles = append(tfiles, tfile)
+	}
+
+	b := []byte{1}
+	fs, err := NewFileStore(tfiles, [][]byte{b, b, b, b, b}, 3)
+	if err != nil {
+		t.Fatal("Failed to create filestore: ", err)
+	}
+
+	// Write each piece, with the second spanning the first two files
+	pieces := [][]byte{{1, 2, 3}, {4, 5, 6}, {7, 8, 9}, {10, 11, 12}, {13}}
+	for i, piece := range pieces {
+		if err = fs.SetBlock(i, 0, piece); err != nil {
+			t.Fatalf("Failed to set piece %d: %s", i, err)
+		}
+	}
+	if err = fs.SetBlock(4, 0, []byte{13, 14}); err == nil {
+		t.Error("Block overrunning the final piece should fail")
+	}
+
+	for i, want := range [][]byte{{1, 2, 3, 4}, {5, 6, 7}, {8, 9, 10, 11, 12, 13}} {
+		got, err := ioutil.ReadFile(filepath.Join(tmpDir, fmt.Sprintf("file%d", i)))
+		if err != nil {
+			t.Fatal("Failed to read file: ", err)
+		}
+		if !bytes.Equal(got, want) {
+			t.Errorf("File %d incorrect, got: %v", i, got)
+		}
+	}
+
+	// Partial block in the middle of a piece
+	if err = fs.SetBlock(1, 1, []byte{50}); err != nil {
+		t.Fatal("Failed to set partial block: ", err)
+	}
+	if block, _ := fs.GetBlock(1, 0, 3); !bytes.Equal(block, []byte{4, 50, 6}) {
+		t.Errorf("Partial block not written, got: %v", block)
+	}
+}
+
+func TestAllocateLazy(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "dir", "file.txt")
+
+	tfile, err := OpenTorrentFile(tmpDir, filepath.Join("dir", "file.txt"), 100, AllocateLazy, OversizedFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tfile.Close()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("Lazy file created before being written")
+	}
+
+	buf := bytes.Repeat([]byte{1}, 10)
+	if n, err := tfile.ReadAt(buf, 95); n != 5 || err != io.EOF || !bytes.Equal(buf[:5], make([]byte, 5)) {
+		t.Error("Incorrect read of unwritten file: ", n, err, buf)
+	}
+
+	if _, err := tfile.WriteAt([]byte("hello"), 50); err != nil {
+		t.Fatal("Failed to write: ", err)
+	}
+	if fi, err := os.Stat(path); err != nil || fi.Size() != 100 {
+		t.Error("File not created at full size on first write: ", err)
+	}
+	if n, err := tfile.ReadAt(buf[:5], 50); n != 5 || err != nil || string(buf[:5]) != "hello" {
+		t.Error("Incorrect read after write: ", n, err)
+	}
+}
+
+func TestAllocateFull(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Existing data is kept
+	path := filepath.Join(tmpDir, "file.txt")
+	ioutil.WriteFile(path, []byte("existing"), 0644)
+
+	tfile, err := OpenTorrentFile(tmpDir, "file.txt", 200000, AllocateFull, OversizedFail)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer tfile.Close()
+	b, _ := ioutil.ReadFile(path)
+	if len(b) != 200000 || string(b[:8]) != "existing" || !bytes.Equal(b[8:], make([]byte, 200000-8)) {
+		t.Error("Incorrect contents after full allocation")
+	}
+}
+
+func TestOversizedFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	path := filepath.Join(tmpDir, "file.txt")
+	data := []byte("0123456789")
+
+	ioutil.WriteFile(path, data, 0644)
+	if _, err := OpenTorrentFile(tmpDir, "file.txt", 5, AllocateSparse, OversizedFail); err == nil {
+		t.Error("Expected error opening oversized file")
+	}
+
+	tfile, err := OpenTorrentFile(tmpDir, "file.txt", 5, AllocateSparse, OversizedForeign)
+	if err != nil {
+		t.Fatal("Failed to open foreign file: ", err)
+	}
+	buf := make([]byte, 5)
+	if n, _ := tfile.ReadAt(buf, 0); n != 5 || string(buf) != "01234" {
+		t.Error("Incorrect read of foreign file: ", string(buf))
+	}
+	tfile.Close()
+	if b, _ := ioutil.ReadFile(path); !bytes.Equal(b, data) {
+		t.Error("Foreign file modified")
+	}
+
+	tfile, err = OpenTorrentFile(tmpDir, "file.txt", 5, AllocateLazy, OversizedTruncate)
+	if err != nil {
+		t.Fatal("Failed to open and truncate file: ", err)
+	}
+	tfile.Close()
+	if b, _ := ioutil.ReadFile(path); string(b) != "01234" {
+		t.Error("File not truncated: ", string(b))
+	}
+}
+
+func TestOversizedForeignMultipleFiles(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ioutil.WriteFile(filepath.Join(tmpDir, "file1.txt"), []byte("AAAAXXXX"), 0644)
+	ioutil.WriteFile(filepath.Join(tmpDir, "file2.txt"), []byte("BBBB"), 0644)
+
+	file1, err := OpenTorrentFile(tmpDir, "file1.txt", 4, AllocateSparse, OversizedForeign)
+	if err != nil {
+		t.Fatal("Failed to open foreign file: ", err)
+	}
+	file2, err := OpenTorrentFile(tmpDir, "file2.txt", 4, AllocateSparse, OversizedForeign)
+	if err != nil {
+		t.Fatal("Failed to open file: ", err)
+	}
+	fs, err := NewFileStore([]TorrentStorer{file1, file2}, [][]byte{[]byte{1}}, 8)
+	if err != nil {
+		t.Fatalf("Failed to create filestore: %s", err)
+	}
+	defer fs.Close()
+
+	// Reads stop at the end of the torrent's file, not the end of the foreign one
+	block, err := fs.GetBlock(0, 0, 8)
+	if err != nil {
+		t.Fatalf("Failed to get block: %s", err)
+	}
+	if string(block) != "AAAABBBB" {
+		t.Errorf("Block read past the end of the first file: %s", block)
+	}
+	buf := make([]byte, 4)
+	if n, err := file1.ReadAt(buf, 2); n != 2 || err != io.EOF || string(buf[:n]) != "AA" {
+		t.Error("Incorrect read across end of foreign file: ", n, err, string(buf[:n]))
+	}
+}
@@ -0,0 +1,236 @@
+package filestore
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sync"
+)
+
+// StorageProvider creates the storage for each of a torrent's files. Paths are relative
+// to the torrent's root and use the OS path separator.
+type StorageProvider interface {
+	// Open returns the storage for the file at path, creating it if need be. Any data
+	// already stored for the file is kept.
+	Open(path string, length int64) (TorrentStorer, error)
+	// Remove deletes the file at path. Removing a file that doesn't exist is not an error.
+	Remove(path string) error
+}
+
+// Renamer is implemented by storage providers that can rename files.
+type Renamer interface {
+	// Rename moves the file at oldPath to newPath. Renaming a file that doesn't exist is
+	// not an error, as it may not have been created yet.
+	Rename(oldPath string, newPath string) error
+}
+
+// DirectoryStorage stores files beneath a directory of the OS filesystem.
+type DirectoryStorage struct {
+	Root       string
+	Allocation Allocation
+	Oversized  OversizedPolicy
+}
+
+func NewDirectoryStorage(root string) *DirectoryStorage {
+	return &DirectoryStorage{Root: root}
+}
+
+func (ds *DirectoryStorage) Open(path string, length int64) (TorrentStorer, error) {
+	tfile, err := OpenTorrentFile(ds.Root, path, length, ds.Allocation, ds.Oversized)
+	if err != nil {
+		return nil, err
+	}
+	return tfile, nil
+}
+
+// Remove deletes the file, along with any parent directories left empty beneath Root.
+func (ds *DirectoryStorage) Remove(path string) error {
+	root := filepath.Clean(ds.Root)
+	path = filepath.Join(root, path)
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	// os.Remove fails on non-empty directories, which is where we want to stop
+	for dir := filepath.Dir(path); dir != root && os.Remove(dir) == nil; dir = filepath.Dir(dir) {
+	}
+	return nil
+}
+
+func (ds *DirectoryStorage) Rename(oldPath string, newPath string) error {
+	src, dst := filepath.Join(ds.Root, oldPath), filepath.Join(ds.Root, newPath)
+	if _, err := os.Stat(src); os.IsNotExist(err) {
+		return nil
+	}
+	if _, err := os.Stat(dst); err == nil {
+		return errors.New(fmt.Sprintf("Rename: %s already exists", newPath))
+	}
+	if err := os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return err
+	}
+	if err := os.Rename(src, dst); err != nil {
+		return err
+	}
+	// Clear up any directories left empty
+	return ds.Remove(oldPath)
+}
+
+// rename is replaced in tests to force MoveFile to copy.
+var rename = os.Rename
+
+// MoveFile moves the file at path beneath oldRoot to the same path beneath newRoot. The
+// file is renamed if possible; otherwise (eg. across filesystems) it is copied, checked
+// against the original and then removed. Missing files are ignored.
+func MoveFile(oldRoot string, newRoot string, path string) (err error) {
+	src, dst := filepath.Join(oldRoot, path), filepath.Join(newRoot, path)
+	if _, err = os.Stat(src); os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return
+	}
+	if _, err = os.Stat(dst); err == nil {
+		return errors.New(fmt.Sprintf("MoveFile: %s already exists", dst))
+	}
+	if err = os.MkdirAll(filepath.Dir(dst), 0755); err != nil {
+		return
+	}
+
+	if err = rename(src, dst); err != nil {
+		if err = copyFile(src, dst); err != nil {
+			os.Remove(dst)
+			return
+		}
+	}
+	// Clear up the original, and any directories left empty
+	return (&DirectoryStorage{Root: oldRoot}).Remove(path)
+}
+
+// copyFile copies src to the new file dst, and checks that the copy matches.
+func copyFile(src string, dst string) (err error) {
+	in, err := os.Open(src)
+	if err != nil {
+		return
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_RDWR|os.O_CREATE|os.O_EXCL, 0644)
+	if err != nil {
+		return
+	}
+	defer out.Close()
+
+	srcHash := sha1.New()
+	if _, err = io.Copy(io.MultiWriter(out, srcHash), in); err != nil {
+		return
+	}
+	if err = out.Sync(); err != nil {
+		return
+	}
+
+	// Read the copy back to make sure it arrived intact
+	dstHash := sha1.New()
+	if _, err = io.Copy(dstHash, io.NewSectionReader(out, 0, 1<<62)); err != nil {
+		return
+	}
+	if !bytes.Equal(srcHash.Sum(nil), dstHash.Sum(nil)) {
+		err = errors.New(fmt.Sprintf("copyFile: copy of %s does not match the original", src))
+	}
+	return
+}
+
+// MemoryStorage keeps files in memory. Files outlive the torrents that open them, so a
+// torrent that is stopped and started again finds its data, until they are removed.
+type MemoryStorage struct {
+	files map[string]*MemoryFile
+	mutex sync.Mutex
+}
+
+func NewMemoryStorage() *MemoryStorage {
+	return &MemoryStorage{files: make(map[string]*MemoryFile)}
+}
+
+func (ms *MemoryStorage) Open(path string, length int64) (TorrentStorer, error) {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	if mf, ok := ms.files[path]; ok {
+		if mf.Length() != length {
+			return nil, errors.New(fmt.Sprintf("%s already exists with length %d", path, mf.Length()))
+		}
+		return mf, nil
+	}
+	mf := &MemoryFile{data: make([]byte, length)}
+	ms.files[path] = mf
+	return mf, nil
+}
+
+func (ms *MemoryStorage) Rename(oldPath string, newPath string) error {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	mf, ok := ms.files[oldPath]
+	if !ok {
+		return nil
+	}
+	if _, ok := ms.files[newPath]; ok {
+		return errors.New(fmt.Sprintf("Rename: %s already exists", newPath))
+	}
+	delete(ms.files, oldPath)
+	ms.files[newPath] = mf
+	return nil
+}
+
+func (ms *MemoryStorage) Remove(path string) error {
+	ms.mutex.Lock()
+	delete(ms.files, path)
+	ms.mutex.Unlock()
+	return nil
+}
+
+// File returns the file at path, or nil if it doesn't exist.
+func (ms *MemoryStorage) File(path string) *MemoryFile {
+	ms.mutex.Lock()
+	defer ms.mutex.Unlock()
+	return ms.files[path]
+}
+
+// MemoryFile is a fixed length file held in memory.
+type MemoryFile struct {
+	data  []byte
+	mutex sync.RWMutex
+}
+
+func (mf *MemoryFile) ReadAt(p []byte, off int64) (n int, err error) {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
+	if off < 0 {
+		return 0, errors.New("MemoryFile.ReadAt: negative offset")
+	}
+	if off < int64(len(mf.data)) {
+		n = copy(p, mf.data[off:])
+	}
+	if n < len(p) {
+		err = io.EOF
+	}
+	return
+}
+
+func (mf *MemoryFile) WriteAt(p []byte, off int64) (n int, err error) {
+	mf.mutex.Lock()
+	defer mf.mutex.Unlock()
+	if off < 0 || off+int64(len(p)) > int64(len(mf.data)) {
+		return 0, errors.New("MemoryFile.WriteAt: write beyond end of file")
+	}
+	return copy(mf.data[off:], p), nil
+}
+
+func (mf *MemoryFile) Length() int64 {
+	return int64(len(mf.data))
+}
+
+// Bytes returns a copy of the file's contents.
+func (mf *MemoryFile) Bytes() []byte {
+	mf.mutex.RLock()
+	defer mf.mutex.RUnlock()
+	return append([]byte(nil), mf.data...)
+}
@@ -0,0 +1,164 @@
+package filestore
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMemoryStorage(t *testing.T) {
+	ms := NewMemoryStorage()
+	a, _ := ms.Open(filepath.Join("dir", "a"), 5)
+	b, _ := ms.Open(filepath.Join("dir", "b"), 7)
+
+	// Pieces of length 4 spanning both files
+	fs, _ := NewFileStore([]TorrentStorer{a, b}, make([][]byte, 3), 4)
+	if err := fs.SetBlock(1, 0, []byte("efgh")); err != nil {
+		t.Fatal("Failed to write block: ", err)
+	}
+	if err := fs.SetBlock(2, 1, []byte("jkl")); err != nil {
+		t.Fatal("Failed to write block: ", err)
+	}
+	if block, err := fs.GetBlock(1, 0, 4); err != nil || string(block) != "efgh" {
+		t.Error("Incorrect block: ", string(block), err)
+	}
+	if got := ms.File(filepath.Join("dir", "b")).Bytes(); !bytes.Equal(got, []byte("fgh\x00jkl")) {
+		t.Errorf("Incorrect file contents: %q", got)
+	}
+
+	// Reads past the end behave like os.File
+	buf := make([]byte, 4)
+	if n, err := a.ReadAt(buf, 3); n != 2 || err != io.EOF {
+		t.Error("Incorrect short read: ", n, err)
+	}
+	if _, err := a.WriteAt(buf, 3); err == nil {
+		t.Error("Expected error writing beyond end of file")
+	}
+
+	// Files are kept until removed
+	if again, _ := ms.Open(filepath.Join("dir", "b"), 7); again != b {
+		t.Error("Reopened file is not the same")
+	}
+	if _, err := ms.Open(filepath.Join("dir", "b"), 8); err == nil {
+		t.Error("Expected error reopening file with a different length")
+	}
+	ms.Remove(filepath.Join("dir", "b"))
+	if ms.File(filepath.Join("dir", "b")) != nil {
+		t.Error("File not removed")
+	}
+}
+
+func TestDirectoryStorageRemove(t *testing.T) {
+	root, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+
+	ds := NewDirectoryStorage(root)
+	for _, path := range []string{"t/sub/a", "t/b"} {
+		tfile, err := ds.Open(filepath.FromSlash(path), 10)
+		if err != nil {
+			t.Fatal("Failed to open file: ", err)
+		}
+		tfile.(io.Closer).Close()
+	}
+
+	ds.Remove(filepath.FromSlash("t/sub/a"))
+	if _, err := os.Stat(filepath.Join(root, "t", "sub")); !os.IsNotExist(err) {
+		t.Error("Empty directory not removed")
+	}
+	if _, err := os.Stat(filepath.Join(root, "t", "b")); err != nil {
+		t.Error("Other file removed: ", err)
+	}
+	if err := ds.Remove(filepath.FromSlash("t/missing")); err != nil {
+		t.Error("Removing missing file failed: ", err)
+	}
+	ds.Remove(filepath.FromSlash("t/b"))
+	if _, err := os.Stat(root); err != nil {
+		t.Error("Root directory removed: ", err)
+	}
+}
+
+func TestMoveFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	oldRoot, newRoot := filepath.Join(tmpDir, "old"), filepath.Join(tmpDir, "new")
+	path := filepath.Join("dir", "a")
+	os.MkdirAll(filepath.Join(oldRoot, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(oldRoot, path), []byte("abcde"), 0644)
+
+	if err := MoveFile(oldRoot, newRoot, path); err != nil {
+		t.Fatal("Failed to move file: ", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(newRoot, path)); string(data) != "abcde" {
+		t.Errorf("Incorrect moved file: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(oldRoot, "dir")); !os.IsNotExist(err) {
+		t.Error("Empty directory left behind")
+	}
+
+	// Moving between filesystems falls back to copying
+	rename = func(string, string) error { return &os.LinkError{Op: "rename", Err: os.ErrInvalid} }
+	defer func() { rename = os.Rename }()
+	if err := MoveFile(newRoot, oldRoot, path); err != nil {
+		t.Fatal("Failed to copy file: ", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(oldRoot, path)); string(data) != "abcde" {
+		t.Errorf("Incorrect copied file: %q", data)
+	}
+	if _, err := os.Stat(filepath.Join(newRoot, path)); !os.IsNotExist(err) {
+		t.Error("Original not removed after copying")
+	}
+
+	// Missing files are skipped, and existing files are never overwritten
+	if err := MoveFile(newRoot, oldRoot, "missing"); err != nil {
+		t.Error("Error moving missing file: ", err)
+	}
+	os.MkdirAll(filepath.Join(newRoot, "dir"), 0755)
+	ioutil.WriteFile(filepath.Join(newRoot, path), []byte("xyz"), 0644)
+	if err := MoveFile(oldRoot, newRoot, path); err == nil {
+		t.Error("Expected error moving over an existing file")
+	}
+}
+
+func TestRename(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory: ", err)
+	}
+	defer os.RemoveAll(tmpDir)
+	ds := NewDirectoryStorage(tmpDir)
+	ms := NewMemoryStorage()
+	for _, storage := range []StorageProvider{ds, ms} {
+		f, _ := storage.Open(filepath.Join("dir", "a"), 3)
+		f.WriteAt([]byte("abc"), 0)
+		if c, ok := f.(io.Closer); ok {
+			c.Close()
+		}
+		renamer := storage.(Renamer)
+		if err := renamer.Rename(filepath.Join("dir", "a"), filepath.Join("other", "b")); err != nil {
+			t.Fatal("Failed to rename: ", err)
+		}
+		f, _ = storage.Open(filepath.Join("other", "b"), 3)
+		buf := make([]byte, 3)
+		if f.ReadAt(buf, 0); string(buf) != "abc" {
+			t.Errorf("Incorrect renamed file: %q", buf)
+		}
+		if c, ok := f.(io.Closer); ok {
+			c.Close()
+		}
+		if err := renamer.Rename("missing", "c"); err != nil {
+			t.Error("Error renaming missing file: ", err)
+		}
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "dir")); !os.IsNotExist(err) {
+		t.Error("Empty directory left behind")
+	}
+}
@@ -0,0 +1,65 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/ipfilter"
+	"net/netip"
+	"sync/atomic"
+)
+
+// BlockedCounts are the connection attempts and peer addresses rejected by
+// Config.IPFilter. The counts are shared by every torrent in a Session.
+type BlockedCounts struct {
+	Incoming int64 // Connections from blocked addresses, which were closed
+	Outgoing int64 // Connections to blocked addresses, which were not attempted
+	Peers    int64 // Peer addresses received from trackers that were discarded
+}
+
+// peerFilter applies the IP filter, counting what it blocks.
+type peerFilter struct {
+	filter   *ipfilter.Filter
+	incoming int64
+	outgoing int64
+	peers    int64
+}
+
+// blocked returns true if the host of addr ("host:port", or just "host") is blocked,
+// adding one to count if so. Addresses that aren't IPs are never blocked.
+func (pf *peerFilter) blocked(addr string, count *int64) bool {
+	if pf.filter == nil {
+		return false
+	}
+	var ip netip.Addr
+	if addrPort, err := netip.ParseAddrPort(addr); err == nil {
+		ip = addrPort.Addr()
+	} else if ip, err = netip.ParseAddr(addr); err != nil {
+		return false
+	}
+	return pf.blockedAddr(ip, count)
+}
+
+// blockedAddr returns true if ip is blocked, adding one to count if so.
+func (pf *peerFilter) blockedAddr(ip netip.Addr, count *int64) bool {
+	if pf.filter == nil || !pf.filter.Blocked(ip) {
+		return false
+	}
+	atomic.AddInt64(count, 1)
+	return true
+}
+
+func (pf *peerFilter) counts() BlockedCounts {
+	return BlockedCounts{
+		Incoming: atomic.LoadInt64(&pf.incoming),
+		Outgoing: atomic.LoadInt64(&pf.outgoing),
+		Peers:    atomic.LoadInt64(&pf.peers),
+	}
+}
+
+// BlockedCounts returns the number of peers rejected by the IP filter.
+func (t *Torrent) BlockedCounts() BlockedCounts {
+	return t.limits.filter.counts()
+}
+
+// BlockedCounts returns the number of peers rejected by the IP filter.
+func (s *Session) BlockedCounts() BlockedCounts {
+	return s.limits.filter.counts()
+}
@@ -0,0 +1,69 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/ipfilter"
+	"net"
+	"net/netip"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestIPFilterPeers(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	filter := ipfilter.NewFilter()
+	filter.AddRule("10.0.0.0/8")
+	tor, err := NewTorrent(testMetainfo(), &Config{RootDirectory: tmpDir, IPFilter: filter})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer tor.Stop()
+	tor.Start()
+
+	blocked := newTestRemotePeerFrom(tor, "-TR2940-abcdefghijkl", "10.1.2.3:6881")
+	blocked.expectClosed(t)
+	allowed := newTestRemotePeerFrom(tor, "-TR2940-abcdefghijkl", "192.168.1.1:6881")
+	allowed.expect(t)
+	if len(tor.Peers()) != 1 {
+		t.Error("Incorrect peers: ", tor.Peers())
+	}
+
+	// Blocked addresses from trackers are discarded, and not dialed
+	tor.incomingPeerAddr <- netip.MustParseAddrPort("10.0.0.1:6881")
+	tor.incomingPeerAddr <- netip.MustParseAddrPort("[::ffff:10.0.0.2]:6881")
+	waitFor(t, "tracker peers blocked", func() bool { return tor.BlockedCounts().Peers == 2 })
+	if counts := tor.BlockedCounts(); counts.Incoming != 1 || counts.Outgoing != 0 {
+		t.Error("Incorrect counts: ", counts)
+	}
+
+	// The filter can be changed whilst in use
+	filter.AddRule("192.168.0.0/16")
+	again := newTestRemotePeerFrom(tor, "-TR2940-abcdefghijkl", "192.168.1.1:6882")
+	again.expectClosed(t)
+}
+
+func TestIPFilterListener(t *testing.T) {
+	filter := ipfilter.NewFilter()
+	filter.AddRule("127.0.0.0/8")
+	l := NewListener(0)
+	l.filter = &peerFilter{filter: filter}
+	if err := l.Listen(); err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer l.Close()
+
+	port := l.Addr().(*net.TCPAddr).Port
+	conn, err := net.Dial("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		t.Fatal("Failed to connect: ", err)
+	}
+	defer conn.Close()
+	conn.SetReadDeadline(time.Now().Add(time.Second * 5))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("Blocked connection not closed")
+	}
+	if l.filter.counts().Incoming != 1 {
+		t.Error("Blocked connection not counted")
+	}
+}
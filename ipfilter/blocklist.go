@@ -0,0 +1,108 @@
+package ipfilter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// datBlockLevel is the access level below which entries of a DAT blocklist are blocked,
+// as in eMule.
+const datBlockLevel = 128
+
+// lineParser returns the rule described by a blocklist line, and whether its addresses
+// should be blocked.
+type lineParser func(line string) (rule string, block bool, err error)
+
+// LoadP2P adds the ranges of a PeerGuardian text (P2P) blocklist, with lines of the form:
+//
+//	Some organisation:1.2.3.0-1.2.3.255
+//
+// It returns the number of rules added.
+func (f *Filter) LoadP2P(r io.Reader) (n int, err error) {
+	return f.load(r, p2pLine)
+}
+
+// LoadDAT adds the ranges of a DAT blocklist, the ipfilter.dat format used by eMule, with
+// lines of the form:
+//
+//	001.002.003.000 - 001.002.003.255 , 100 , Some organisation
+//
+// As in eMule, ranges with an access level of 128 or more are allowed and skipped. It
+// returns the number of rules added.
+func (f *Filter) LoadDAT(r io.Reader) (n int, err error) {
+	return f.load(r, datLine)
+}
+
+// Load adds the ranges of a blocklist in any of the supported formats, detected line by
+// line: DAT, P2P, or plain CIDR prefixes, ranges and addresses, one per line. It returns
+// the number of rules added.
+func (f *Filter) Load(r io.Reader) (n int, err error) {
+	return f.load(r, func(line string) (string, bool, error) {
+		if strings.Contains(line, ",") {
+			return datLine(line)
+		}
+		if _, _, err := parseRule(line); err == nil {
+			return line, true, nil
+		}
+		return p2pLine(line)
+	})
+}
+
+// load adds the rules of each line of r. Blank lines and comments, starting with '#' or
+// "//", are skipped.
+func (f *Filter) load(r io.Reader, parse lineParser) (n int, err error) {
+	scanner := bufio.NewScanner(r)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") || strings.HasPrefix(line, "//") {
+			continue
+		}
+		rule, block, err := parse(line)
+		if err == nil && block {
+			err = f.AddRule(rule)
+		}
+		if err != nil {
+			return n, errors.New(fmt.Sprintf("Blocklist line %d: %s", lineNum, err))
+		}
+		if block {
+			n++
+		}
+	}
+	return n, scanner.Err()
+}
+
+func p2pLine(line string) (rule string, block bool, err error) {
+	// The description may itself contain colons, as may IPv6 addresses, so take the first
+	// split that leaves a valid range
+	for i := 0; i < len(line); i++ {
+		if line[i] != ':' {
+			continue
+		}
+		rule = line[i+1:]
+		if _, _, err := parseRule(rule); err == nil && strings.Contains(rule, "-") {
+			return rule, true, nil
+		}
+	}
+	return "", false, errors.New("no address range")
+}
+
+func datLine(line string) (rule string, block bool, err error) {
+	fields := strings.SplitN(line, ",", 3)
+	if len(fields) >= 2 {
+		level, err := strconv.Atoi(strings.TrimSpace(fields[1]))
+		if err != nil {
+			return "", false, errors.New("invalid access level")
+		}
+		if level >= datBlockLevel {
+			return "", false, nil
+		}
+	}
+	if _, _, err = parseRule(fields[0]); err != nil {
+		return
+	}
+	return fields[0], true, nil
+}
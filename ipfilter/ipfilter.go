@@ -0,0 +1,198 @@
+// Package ipfilter blocks ranges of IPv4 and IPv6 addresses, as loaded from blocklists.
+package ipfilter
+
+import (
+	"errors"
+	"fmt"
+	"net/netip"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// Filter is a set of blocked address ranges. It is safe for concurrent use, so rules may
+// be added whilst it is in use.
+//
+// Ranges are kept sorted and merged, one list per address family, so a lookup is a
+// binary search. Rules added since the last lookup are merged in by the next one, which
+// makes loading large blocklists cheap.
+type Filter struct {
+	v4, v6 []addrRange
+	dirty  bool // Ranges have been added but not yet sorted and merged
+	mutex  sync.RWMutex
+}
+
+type addrRange struct {
+	first, last netip.Addr
+}
+
+func NewFilter() *Filter {
+	return &Filter{}
+}
+
+// AddRange blocks every address from first to last inclusive, which must be of the same
+// family. IPv4-mapped IPv6 addresses are treated as IPv4.
+func (f *Filter) AddRange(first netip.Addr, last netip.Addr) error {
+	first, last = first.Unmap(), last.Unmap()
+	if !first.IsValid() || !last.IsValid() || first.Is4() != last.Is4() {
+		return errors.New(fmt.Sprintf("AddRange: invalid range %s-%s", first, last))
+	}
+	if last.Less(first) {
+		first, last = last, first
+	}
+	first, last = first.WithZone(""), last.WithZone("")
+
+	f.mutex.Lock()
+	if first.Is4() {
+		f.v4 = append(f.v4, addrRange{first, last})
+	} else {
+		f.v6 = append(f.v6, addrRange{first, last})
+	}
+	f.dirty = true
+	f.mutex.Unlock()
+	return nil
+}
+
+// AddPrefix blocks every address in the prefix.
+func (f *Filter) AddPrefix(prefix netip.Prefix) error {
+	prefix = prefix.Masked()
+	if !prefix.IsValid() {
+		return errors.New("AddPrefix: invalid prefix")
+	}
+	return f.AddRange(prefix.Addr(), lastAddr(prefix))
+}
+
+// AddRule blocks the addresses described by rule, which is either a CIDR prefix
+// ("10.0.0.0/8"), a range ("10.0.0.0-10.255.255.255") or a single address.
+func (f *Filter) AddRule(rule string) error {
+	first, last, err := parseRule(rule)
+	if err != nil {
+		return err
+	}
+	return f.AddRange(first, last)
+}
+
+// Blocked returns true if addr lies in a blocked range.
+func (f *Filter) Blocked(addr netip.Addr) bool {
+	if !addr.IsValid() {
+		return false
+	}
+	addr = addr.Unmap().WithZone("")
+	f.compact()
+
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	ranges := f.v6
+	if addr.Is4() {
+		ranges = f.v4
+	}
+	// Find the last range starting at or before addr
+	i := sort.Search(len(ranges), func(i int) bool {
+		return addr.Less(ranges[i].first)
+	}) - 1
+	return i >= 0 && !ranges[i].last.Less(addr)
+}
+
+// Len returns the number of distinct blocked ranges, after overlapping and adjacent
+// ranges have been merged.
+func (f *Filter) Len() int {
+	f.compact()
+	f.mutex.RLock()
+	defer f.mutex.RUnlock()
+	return len(f.v4) + len(f.v6)
+}
+
+// compact sorts and merges any newly added ranges.
+func (f *Filter) compact() {
+	f.mutex.RLock()
+	dirty := f.dirty
+	f.mutex.RUnlock()
+	if !dirty {
+		return
+	}
+
+	f.mutex.Lock()
+	if f.dirty {
+		f.v4 = merge(f.v4)
+		f.v6 = merge(f.v6)
+		f.dirty = false
+	}
+	f.mutex.Unlock()
+}
+
+// merge sorts ranges and combines those that overlap or touch.
+func merge(ranges []addrRange) []addrRange {
+	if len(ranges) == 0 {
+		return ranges
+	}
+	sort.Slice(ranges, func(i, j int) bool {
+		return ranges[i].first.Less(ranges[j].first)
+	})
+	merged := ranges[:1]
+	for _, r := range ranges[1:] {
+		last := &merged[len(merged)-1]
+		if next := last.last.Next(); !next.IsValid() || !next.Less(r.first) {
+			// Overlapping or adjacent (or last already ends at the top of the family)
+			if last.last.Less(r.last) {
+				last.last = r.last
+			}
+			continue
+		}
+		merged = append(merged, r)
+	}
+	return merged
+}
+
+// lastAddr returns the highest address in the prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	b := prefix.Addr().AsSlice()
+	for bit := prefix.Bits(); bit < len(b)*8; bit++ {
+		b[bit/8] |= 0x80 >> (bit % 8)
+	}
+	addr, _ := netip.AddrFromSlice(b)
+	return addr
+}
+
+// parseRule parses a CIDR prefix, a range of two addresses separated by "-", or a single
+// address.
+func parseRule(rule string) (first netip.Addr, last netip.Addr, err error) {
+	rule = strings.TrimSpace(rule)
+	if strings.Contains(rule, "/") {
+		prefix, err := netip.ParsePrefix(rule)
+		if err != nil {
+			return first, last, err
+		}
+		prefix = prefix.Masked()
+		return prefix.Addr(), lastAddr(prefix), nil
+	}
+	if i := strings.Index(rule, "-"); i >= 0 {
+		if first, err = parseAddr(rule[:i]); err != nil {
+			return
+		}
+		last, err = parseAddr(rule[i+1:])
+		return
+	}
+	first, err = parseAddr(rule)
+	return first, first, err
+}
+
+// parseAddr parses an address, allowing the zero padded IPv4 addresses found in
+// blocklists ("001.002.003.004").
+func parseAddr(s string) (addr netip.Addr, err error) {
+	s = strings.TrimSpace(s)
+	if addr, err = netip.ParseAddr(s); err == nil || strings.Contains(s, ":") {
+		return
+	}
+	parts := strings.Split(s, ".")
+	if len(parts) != 4 {
+		return
+	}
+	for i, part := range parts {
+		if trimmed := strings.TrimLeft(part, "0"); trimmed != "" {
+			parts[i] = trimmed
+		} else if part != "" {
+			parts[i] = "0"
+		}
+	}
+	return netip.ParseAddr(strings.Join(parts, "."))
+}
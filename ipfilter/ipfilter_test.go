@@ -0,0 +1,118 @@
+package ipfilter
+
+import (
+	"net/netip"
+	"strings"
+	"testing"
+)
+
+func expectBlocked(t *testing.T, f *Filter, addrs map[string]bool) {
+	for s, blocked := range addrs {
+		if f.Blocked(netip.MustParseAddr(s)) != blocked {
+			t.Errorf("%s: expected blocked %v", s, blocked)
+		}
+	}
+}
+
+func TestFilterRules(t *testing.T) {
+	f := NewFilter()
+	for _, rule := range []string{"10.0.0.0/8", "192.168.1.10-192.168.1.20", "1.2.3.4", "2001:db8::/32", "fe80::1-fe80::ff"} {
+		if err := f.AddRule(rule); err != nil {
+			t.Fatal("Failed to add rule: ", rule, err)
+		}
+	}
+	for _, rule := range []string{"10.0.0.0/33", "1.2.3.4-::1", "nonsense"} {
+		if err := f.AddRule(rule); err == nil {
+			t.Error("Expected error adding rule: ", rule)
+		}
+	}
+	expectBlocked(t, f, map[string]bool{
+		"9.255.255.255":        false,
+		"10.0.0.0":             true,
+		"10.255.255.255":       true,
+		"11.0.0.0":             false,
+		"192.168.1.9":          false,
+		"192.168.1.15":         true,
+		"192.168.1.21":         false,
+		"1.2.3.4":              true,
+		"1.2.3.5":              false,
+		"::ffff:10.1.2.3":      true, // IPv4-mapped
+		"2001:db8:1::1":        true,
+		"2001:db9::":           false,
+		"fe80::80":             true,
+		"fe80::100":            false,
+		"::a00:1":              false, // Not the same as 10.0.0.1
+		"255.255.255.255":      false,
+		"ffff:ffff:ffff::ffff": false,
+	})
+}
+
+func TestFilterMerges(t *testing.T) {
+	f := NewFilter()
+	f.AddRule("1.0.0.10-1.0.0.20")
+	f.AddRule("1.0.0.0-1.0.0.9")   // Adjacent
+	f.AddRule("1.0.0.15-1.0.0.30") // Overlapping
+	f.AddRule("1.0.0.40")
+	f.AddRule("255.255.255.0/24")
+	f.AddRule("255.0.0.0/8") // Contains the previous range, which ends at the top
+	if f.Len() != 3 {
+		t.Error("Ranges not merged: ", f.v4)
+	}
+	expectBlocked(t, f, map[string]bool{
+		"1.0.0.0":         true,
+		"1.0.0.30":        true,
+		"1.0.0.31":        false,
+		"1.0.0.40":        true,
+		"255.255.255.255": true,
+	})
+
+	// Rules can be added after lookups
+	f.AddRule("1.0.0.31-1.0.0.39")
+	if f.Len() != 2 || !f.Blocked(netip.MustParseAddr("1.0.0.35")) {
+		t.Error("Later rule not merged: ", f.v4)
+	}
+}
+
+func TestLoadP2P(t *testing.T) {
+	f := NewFilter()
+	n, err := f.LoadP2P(strings.NewReader(`# PeerGuardian list
+Some org:1.2.3.0-1.2.3.255
+
+Colons: in the name:5.6.7.8-5.6.7.9
+IPv6 org:2001:db8::-2001:db8::ffff
+`))
+	if err != nil || n != 3 {
+		t.Fatal("Failed to load list: ", n, err)
+	}
+	expectBlocked(t, f, map[string]bool{"1.2.3.100": true, "5.6.7.9": true, "2001:db8::10": true, "1.2.4.0": false})
+
+	if _, err := f.LoadP2P(strings.NewReader("Bad line\n")); err == nil || !strings.Contains(err.Error(), "line 1") {
+		t.Error("Expected error for bad line: ", err)
+	}
+}
+
+func TestLoadDAT(t *testing.T) {
+	f := NewFilter()
+	n, err := f.LoadDAT(strings.NewReader(`// eMule ipfilter.dat
+001.002.003.000 - 001.002.003.255 , 000 , Blocked org
+005.006.007.000 - 005.006.007.255 , 200 , Allowed org
+010.000.000.001 - 010.000.000.002 , 127 , Also blocked
+`))
+	if err != nil || n != 2 {
+		t.Fatal("Failed to load list: ", n, err)
+	}
+	expectBlocked(t, f, map[string]bool{"1.2.3.4": true, "5.6.7.8": false, "10.0.0.2": true, "10.0.0.3": false})
+}
+
+func TestLoadDetectsFormat(t *testing.T) {
+	f := NewFilter()
+	n, err := f.Load(strings.NewReader(`10.0.0.0/8
+Some org:1.2.3.0-1.2.3.255
+005.006.007.000 - 005.006.007.255 , 0 , Blocked org
+2001:db8::1
+`))
+	if err != nil || n != 4 {
+		t.Fatal("Failed to load list: ", n, err)
+	}
+	expectBlocked(t, f, map[string]bool{"10.1.1.1": true, "1.2.3.4": true, "5.6.7.8": true, "2001:db8::1": true, "2001:db8::2": false})
+}
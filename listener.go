@@ -3,12 +3,16 @@ package libtorrent
 import (
 	"fmt"
 	"net"
+	"strconv"
+	"sync"
 )
 
 type Listener struct {
-	port     int16
-	torrents map[string]*Torrent
-	listener net.Listener
+	port      int16
+	torrents  map[string]*Torrent
+	mutex     sync.RWMutex
+	listeners []net.Listener // One for each address family
+	filter    *peerFilter    // Nil accepts every connection
 }
 
 func NewListener(port int16) (l *Listener) {
@@ -21,48 +25,105 @@ func NewListener(port int16) (l *Listener) {
 
 func (l *Listener) AddTorrent(tor *Torrent) {
 	infoHash := fmt.Sprintf("%x", tor.InfoHash())
+	l.mutex.Lock()
 	l.torrents[infoHash] = tor
+	l.mutex.Unlock()
 }
 
+func (l *Listener) RemoveTorrent(tor *Torrent) {
+	infoHash := fmt.Sprintf("%x", tor.InfoHash())
+	l.mutex.Lock()
+	delete(l.torrents, infoHash)
+	l.mutex.Unlock()
+}
+
+func (l *Listener) getTorrent(infoHash []byte) (tor *Torrent, ok bool) {
+	l.mutex.RLock()
+	tor, ok = l.torrents[fmt.Sprintf("%x", infoHash)]
+	l.mutex.RUnlock()
+	return
+}
+
+// Listen accepts incoming peers on the port in both IPv4 and IPv6, using a separate
+// socket for each family. It fails only if neither family can listen. If the port is 0,
+// both families share the port chosen for IPv4.
 func (l *Listener) Listen() (err error) {
-	port := fmt.Sprintf(":%d", l.port)
-	if l.listener, err = net.Listen("tcp", port); err != nil {
-		return
+	port := int(uint16(l.port))
+	for _, network := range []string{"tcp4", "tcp6"} {
+		ln, e := net.Listen(network, net.JoinHostPort("", strconv.Itoa(port)))
+		if e != nil {
+			logger.Info("Not listening for %s connections: %s", network, e)
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		if port == 0 {
+			port = ln.Addr().(*net.TCPAddr).Port
+		}
+		l.listeners = append(l.listeners, ln)
+		go l.accept(ln)
+	}
+	if len(l.listeners) > 0 {
+		err = nil
 	}
+	return
+}
+
+// accept hands the connections accepted by ln to the torrents they are for.
+func (l *Listener) accept(ln net.Listener) {
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			logger.Error("Listener unexpectedly quit: %s", err)
+			return
+		}
+		if l.filter != nil && l.filter.blocked(conn.RemoteAddr().String(), &l.filter.incoming) {
+			logger.Debug("%s Address is blocked, closing connection", conn.RemoteAddr())
+			conn.Close()
+			continue
+		}
 
-	// Begin accepting incoming peers
-	go func() {
-		for {
-			conn, err := l.listener.Accept()
+		go func() {
+			hs, err := parseHandshake(conn)
 			if err != nil {
-				logger.Error("Listener unexpectedly quit: %s", err)
+				logger.Error("%s Initial handshake failed: %s", conn.RemoteAddr(), err)
+				conn.Close()
 				return
 			}
 
-			go func() {
-				hs, err := parseHandshake(conn)
-				if err != nil {
-					logger.Error("%s Initial handshake failed: %s", conn.RemoteAddr(), err)
-					conn.Close()
-					return
-				}
+			if tor, ok := l.getTorrent(hs.infoHash); ok {
+				logger.Debug("%s Incoming peer connection: %s", conn.RemoteAddr(), hs.peerId)
+				tor.AddPeer(conn, hs)
+			} else {
+				logger.Info("%s Incoming peer connection using expired/invalid infohash", conn.RemoteAddr())
+				conn.Close()
+			}
+		}()
+	}
+}
 
-				infoHash := fmt.Sprintf("%x", hs.infoHash)
-				if tor, ok := l.torrents[infoHash]; ok {
-					logger.Debug("%s Incoming peer connection: %s", conn.RemoteAddr(), hs.peerId)
-					tor.AddPeer(conn, hs)
-				} else {
-					logger.Info("%s Incoming peer connection using expired/invalid infohash", conn.RemoteAddr())
-					conn.Close()
-				}
-				return
-			}()
-		}
-	}()
+// Addr returns the first address being listened on, or nil if Listen has not been called.
+func (l *Listener) Addr() net.Addr {
+	if len(l.listeners) == 0 {
+		return nil
+	}
+	return l.listeners[0].Addr()
+}
 
+// Addrs returns the address being listened on in each family.
+func (l *Listener) Addrs() (addrs []net.Addr) {
+	for _, ln := range l.listeners {
+		addrs = append(addrs, ln.Addr())
+	}
 	return
 }
 
-func (l *Listener) Close() error {
-	return l.listener.Close()
+func (l *Listener) Close() (err error) {
+	for _, ln := range l.listeners {
+		if e := ln.Close(); e != nil && err == nil {
+			err = e
+		}
+	}
+	return
 }
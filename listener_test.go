@@ -0,0 +1,48 @@
+package libtorrent
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func TestListenerDualStack(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	tor.Start()
+
+	l := NewListener(0)
+	if err := l.Listen(); err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer l.Close()
+	l.AddTorrent(tor)
+	addrs := l.Addrs()
+	if len(addrs) != 2 {
+		t.Skip("IPv6 unavailable: ", addrs)
+	}
+	port := addrs[0].(*net.TCPAddr).Port
+	if addrs[1].(*net.TCPAddr).Port != port {
+		t.Error("Families listening on different ports: ", addrs)
+	}
+
+	for _, host := range []string{"127.0.0.1", "::1"} {
+		conn, err := net.Dial("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+		if err != nil {
+			t.Fatal("Failed to connect: ", err)
+		}
+		defer conn.Close()
+		hs := newHandshake(tor.InfoHash(), tor.PeerId())
+		hs.peerId = []byte("-TR2940-abcdefghijkl")
+		hs.BinaryDump(conn)
+	}
+	waitFor(t, "both peers", func() bool { return len(tor.Peers()) == 2 })
+	var v6 bool
+	for _, p := range tor.Peers() {
+		v6 = v6 || strings.HasPrefix(p.Addr, "[::1]:")
+	}
+	if !v6 {
+		t.Error("No IPv6 peer: ", tor.Peers())
+	}
+}
@@ -0,0 +1,300 @@
+// Package lsd implements Local Service Discovery (BEP 14): finding peers on the local
+// network by multicasting the infohashes of our torrents.
+package lsd
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/op/go-logging"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var logger = logging.MustGetLogger("libtorrent")
+
+// The multicast groups announcements are sent to.
+var (
+	IPv4Group = &net.UDPAddr{IP: net.IPv4(239, 192, 152, 143), Port: 6771}
+	IPv6Group = &net.UDPAddr{IP: net.ParseIP("ff15::efc0:988f"), Port: 6771}
+)
+
+// AnnounceInterval is how often each infohash is announced. BEP 14 asks for no more than
+// one announce a minute.
+var AnnounceInterval = time.Minute * 5
+
+// checkInterval is how often the announce loop looks for infohashes that are due.
+var checkInterval = time.Minute
+
+// maxPacketSize bounds announcements, so that they aren't fragmented. Infohashes that
+// don't fit are sent in further packets.
+const maxPacketSize = 1400
+
+// Found is called with the address of each peer found for one of our infohashes.
+type Found func(infoHash []byte, addr netip.AddrPort)
+
+// Service announces our infohashes and listens for others' announcements on one or more
+// packet connections, usually one per multicast group.
+type Service struct {
+	port       uint16
+	cookie     string // Identifies our own announcements, which are looped back to us
+	infoHashes func() [][]byte
+	found      Found
+	conns      []groupConn
+	announced  map[string]time.Time // When each infohash was last announced
+	trigger    chan struct{}
+	closing    chan struct{}
+	wg         sync.WaitGroup
+	mutex      sync.Mutex
+}
+
+type groupConn struct {
+	conn  net.PacketConn
+	group net.Addr
+}
+
+// New creates a service for peers listening on port. infoHashes is called for the
+// infohashes to announce each time, and found for each peer found for one of them.
+func New(port uint16, infoHashes func() [][]byte, found Found) *Service {
+	cookie := make([]byte, 8)
+	rand.Read(cookie)
+	return &Service{
+		port:       port,
+		cookie:     hex.EncodeToString(cookie),
+		infoHashes: infoHashes,
+		found:      found,
+		announced:  make(map[string]time.Time),
+		trigger:    make(chan struct{}, 1),
+		closing:    make(chan struct{}),
+	}
+}
+
+// Listen joins the IPv4 and IPv6 multicast groups and starts announcing. It fails only
+// if neither group can be joined.
+func (s *Service) Listen() (err error) {
+	joined := false
+	for _, g := range []struct {
+		network string
+		group   *net.UDPAddr
+	}{{"udp4", IPv4Group}, {"udp6", IPv6Group}} {
+		conn, e := net.ListenMulticastUDP(g.network, nil, g.group)
+		if e != nil {
+			logger.Info("Not using local service discovery over %s: %s", g.network, e)
+			if err == nil {
+				err = e
+			}
+			continue
+		}
+		s.AddConn(conn, g.group)
+		joined = true
+	}
+	if joined {
+		err = nil
+	}
+	return
+}
+
+// AddConn announces to group over conn, and reads others' announcements from it. The
+// service closes conn when it is closed. The announce loop starts with the first conn.
+func (s *Service) AddConn(conn net.PacketConn, group net.Addr) {
+	s.mutex.Lock()
+	s.conns = append(s.conns, groupConn{conn: conn, group: group})
+	first := len(s.conns) == 1
+	s.mutex.Unlock()
+
+	s.wg.Add(1)
+	go s.read(conn)
+	if first {
+		s.wg.Add(1)
+		go s.announceLoop()
+	}
+}
+
+// Announce sends any infohashes that are due now, such as those of newly started
+// torrents, rather than waiting for the next check.
+func (s *Service) Announce() {
+	select {
+	case s.trigger <- struct{}{}:
+	default:
+	}
+}
+
+// Close stops announcing and listening.
+func (s *Service) Close() error {
+	s.mutex.Lock()
+	select {
+	case <-s.closing:
+	default:
+		close(s.closing)
+	}
+	for _, gc := range s.conns {
+		gc.conn.Close()
+	}
+	s.mutex.Unlock()
+	s.wg.Wait()
+	return nil
+}
+
+func (s *Service) announceLoop() {
+	defer s.wg.Done()
+	for {
+		s.announceDue()
+		select {
+		case <-time.After(checkInterval):
+		case <-s.trigger:
+		case <-s.closing:
+			return
+		}
+	}
+}
+
+// announceDue announces every infohash not announced within AnnounceInterval.
+func (s *Service) announceDue() {
+	now := time.Now()
+	infoHashes := s.infoHashes()
+	var due []string
+	current := make(map[string]bool)
+	s.mutex.Lock()
+	for _, infoHash := range infoHashes {
+		key := hex.EncodeToString(infoHash)
+		current[key] = true
+		if last, ok := s.announced[key]; !ok || now.Sub(last) >= AnnounceInterval {
+			due = append(due, key)
+			s.announced[key] = now
+		}
+	}
+	for key := range s.announced {
+		if !current[key] {
+			// Announce again straight away if it comes back
+			delete(s.announced, key)
+		}
+	}
+	conns := append([]groupConn(nil), s.conns...)
+	s.mutex.Unlock()
+
+	for _, gc := range conns {
+		for _, packet := range s.packets(gc.group, due) {
+			if _, err := gc.conn.WriteTo(packet, gc.group); err != nil {
+				logger.Debug("Failed to send local service discovery announce to %s: %s", gc.group, err)
+			}
+		}
+	}
+}
+
+// packets builds the announcements of infoHashes to group, as many to a packet as fit.
+func (s *Service) packets(group net.Addr, infoHashes []string) (packets [][]byte) {
+	header := fmt.Sprintf("BT-SEARCH * HTTP/1.1\r\nHost: %s\r\nPort: %d\r\n", group, s.port)
+	footer := fmt.Sprintf("cookie: %s\r\n\r\n\r\n", s.cookie)
+	var buf bytes.Buffer
+	for _, infoHash := range infoHashes {
+		line := fmt.Sprintf("Infohash: %s\r\n", infoHash)
+		if buf.Len() > 0 && buf.Len()+len(line)+len(footer) > maxPacketSize {
+			buf.WriteString(footer)
+			packets = append(packets, append([]byte(nil), buf.Bytes()...))
+			buf.Reset()
+		}
+		if buf.Len() == 0 {
+			buf.WriteString(header)
+		}
+		buf.WriteString(line)
+	}
+	if buf.Len() > 0 {
+		buf.WriteString(footer)
+		packets = append(packets, buf.Bytes())
+	}
+	return
+}
+
+// read passes on the peers in each announcement received on conn, until it is closed.
+func (s *Service) read(conn net.PacketConn) {
+	defer s.wg.Done()
+	b := make([]byte, 2048)
+	for {
+		n, from, err := conn.ReadFrom(b)
+		if err != nil {
+			select {
+			case <-s.closing:
+			default:
+				logger.Error("Local service discovery stopped reading: %s", err)
+			}
+			return
+		}
+		udpAddr, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		port, infoHashes, cookie, err := parseAnnounce(b[:n])
+		if err != nil {
+			logger.Debug("Ignoring local service discovery packet from %s: %s", from, err)
+			continue
+		}
+		if cookie == s.cookie {
+			continue
+		}
+		addr := netip.AddrPortFrom(udpAddr.AddrPort().Addr().Unmap(), port)
+		wanted := make(map[string]bool)
+		for _, infoHash := range s.infoHashes() {
+			wanted[string(infoHash)] = true
+		}
+		for _, infoHash := range infoHashes {
+			if wanted[string(infoHash)] {
+				s.found(infoHash, addr)
+			}
+		}
+	}
+}
+
+// parseAnnounce reads a BT-SEARCH announcement.
+func parseAnnounce(b []byte) (port uint16, infoHashes [][]byte, cookie string, err error) {
+	r := bufio.NewReader(bytes.NewReader(b))
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, "BT-SEARCH * HTTP/1.1") {
+		return 0, nil, "", errors.New("not a BT-SEARCH announcement")
+	}
+	for {
+		line, e := r.ReadString('\n')
+		line = strings.TrimSpace(line)
+		if line == "" {
+			break
+		}
+		i := strings.Index(line, ":")
+		if i < 0 {
+			return 0, nil, "", errors.New(fmt.Sprintf("malformed header %q", line))
+		}
+		value := strings.TrimSpace(line[i+1:])
+		switch http.CanonicalHeaderKey(strings.TrimSpace(line[:i])) {
+		case "Port":
+			p, e := strconv.ParseUint(value, 10, 16)
+			if e != nil || p == 0 {
+				return 0, nil, "", errors.New(fmt.Sprintf("invalid port %q", value))
+			}
+			port = uint16(p)
+		case "Infohash":
+			infoHash, e := hex.DecodeString(value)
+			if e != nil || len(infoHash) != 20 {
+				return 0, nil, "", errors.New(fmt.Sprintf("invalid infohash %q", value))
+			}
+			infoHashes = append(infoHashes, infoHash)
+		case "Cookie":
+			cookie = value
+		}
+		if e != nil {
+			break
+		}
+	}
+	if port == 0 || len(infoHashes) == 0 {
+		return 0, nil, "", errors.New("missing port or infohash")
+	}
+	return port, infoHashes, cookie, nil
+}
@@ -0,0 +1,176 @@
+package lsd
+
+import (
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"net"
+	"net/netip"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testHub is a multicast group in memory: every packet written by a member is delivered
+// to all members, including the sender.
+type testHub struct {
+	members []*testConn
+	mutex   sync.Mutex
+}
+
+type testPacket struct {
+	b    []byte
+	from net.Addr
+}
+
+type testConn struct {
+	hub     *testHub
+	addr    *net.UDPAddr
+	packets chan testPacket
+	closed  chan struct{}
+	once    sync.Once
+}
+
+func (hub *testHub) join(addr string) *testConn {
+	conn := &testConn{
+		hub:     hub,
+		addr:    net.UDPAddrFromAddrPort(netip.MustParseAddrPort(addr)),
+		packets: make(chan testPacket, 100),
+		closed:  make(chan struct{}),
+	}
+	hub.mutex.Lock()
+	hub.members = append(hub.members, conn)
+	hub.mutex.Unlock()
+	return conn
+}
+
+func (c *testConn) ReadFrom(b []byte) (int, net.Addr, error) {
+	select {
+	case p := <-c.packets:
+		return copy(b, p.b), p.from, nil
+	case <-c.closed:
+		return 0, nil, errors.New("closed")
+	}
+}
+
+func (c *testConn) WriteTo(b []byte, addr net.Addr) (int, error) {
+	c.hub.mutex.Lock()
+	defer c.hub.mutex.Unlock()
+	for _, m := range c.hub.members {
+		m.packets <- testPacket{b: append([]byte(nil), b...), from: c.addr}
+	}
+	return len(b), nil
+}
+
+func (c *testConn) Close() error {
+	c.once.Do(func() { close(c.closed) })
+	return nil
+}
+
+func (c *testConn) LocalAddr() net.Addr                { return c.addr }
+func (c *testConn) SetDeadline(t time.Time) error      { return nil }
+func (c *testConn) SetReadDeadline(t time.Time) error  { return nil }
+func (c *testConn) SetWriteDeadline(t time.Time) error { return nil }
+
+type testFound struct {
+	infoHash []byte
+	addr     netip.AddrPort
+}
+
+func TestService(t *testing.T) {
+	shared := bytes.Repeat([]byte{0xab}, 20)
+	onlyA := bytes.Repeat([]byte{0x01}, 20)
+	onlyB := bytes.Repeat([]byte{0x02}, 20)
+
+	hub := new(testHub)
+	foundA, foundB := make(chan testFound, 10), make(chan testFound, 10)
+	a := New(6881, func() [][]byte { return [][]byte{shared, onlyA} }, func(infoHash []byte, addr netip.AddrPort) {
+		foundA <- testFound{infoHash, addr}
+	})
+	b := New(6882, func() [][]byte { return [][]byte{shared, onlyB} }, func(infoHash []byte, addr netip.AddrPort) {
+		foundB <- testFound{infoHash, addr}
+	})
+	a.AddConn(hub.join("192.168.1.10:6771"), IPv4Group)
+	defer a.Close()
+	b.AddConn(hub.join("192.168.1.20:6771"), IPv4Group)
+	defer b.Close()
+
+	// Each finds the other for the infohash they share, and not themselves
+	for _, c := range []struct {
+		found chan testFound
+		addr  string
+	}{{foundA, "192.168.1.20:6882"}, {foundB, "192.168.1.10:6881"}} {
+		select {
+		case f := <-c.found:
+			if !bytes.Equal(f.infoHash, shared) || f.addr.String() != c.addr {
+				t.Errorf("Expected %x from %s, got %x from %s", shared, c.addr, f.infoHash, f.addr)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for peer")
+		}
+	}
+	select {
+	case f := <-foundA:
+		t.Error("Unexpected peer: ", f)
+	case f := <-foundB:
+		t.Error("Unexpected peer: ", f)
+	case <-time.After(time.Millisecond * 50):
+	}
+
+	// Infohashes aren't announced again until they are due
+	conn := hub.join("192.168.1.30:6771")
+	a.Announce()
+	select {
+	case p := <-conn.packets:
+		t.Errorf("Announced again too soon: %q", p.b)
+	case <-time.After(time.Millisecond * 50):
+	}
+}
+
+func TestPackets(t *testing.T) {
+	s := New(6881, nil, nil)
+	var infoHashes []string
+	for i := 0; i < 50; i++ {
+		infoHashes = append(infoHashes, hex.EncodeToString(bytes.Repeat([]byte{byte(i)}, 20)))
+	}
+	packets := s.packets(IPv6Group, infoHashes)
+	if len(packets) < 2 {
+		t.Fatal("Expected infohashes to be split between packets, got ", len(packets))
+	}
+	var got int
+	for _, packet := range packets {
+		if len(packet) > maxPacketSize {
+			t.Error("Packet too large: ", len(packet))
+		}
+		if !strings.Contains(string(packet), "Host: [ff15::efc0:988f]:6771\r\n") {
+			t.Errorf("Incorrect host: %q", packet)
+		}
+		port, hashes, cookie, err := parseAnnounce(packet)
+		if err != nil || port != 6881 || cookie != s.cookie {
+			t.Fatal("Failed to parse own announce: ", port, cookie, err)
+		}
+		got += len(hashes)
+	}
+	if got != len(infoHashes) {
+		t.Errorf("Expected %d infohashes, got %d", len(infoHashes), got)
+	}
+}
+
+func TestParseAnnounce(t *testing.T) {
+	infoHash := strings.Repeat("AB", 20)
+	port, hashes, cookie, err := parseAnnounce([]byte("BT-SEARCH * HTTP/1.1\r\nHost: 239.192.152.143:6771\r\nport: 51413\r\nInfohash: " + infoHash + "\r\ncookie: xyz\r\n\r\n\r\n"))
+	if err != nil || port != 51413 || len(hashes) != 1 || hashes[0][0] != 0xab || cookie != "xyz" {
+		t.Error("Failed to parse announce: ", port, hashes, cookie, err)
+	}
+	for _, bad := range []string{
+		"GET / HTTP/1.1\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 0\r\nInfohash: " + infoHash + "\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\nInfohash: abc\r\n\r\n",
+		"BT-SEARCH * HTTP/1.1\r\nPort: 6881\r\n\r\n",
+	} {
+		if _, _, _, err := parseAnnounce([]byte(bad)); err == nil {
+			t.Errorf("Expected error parsing %q", bad)
+		}
+	}
+}
@@ -32,11 +32,11 @@ type handshake struct {
 	peerId   []byte
 }
 
-func newHandshake(infoHash []byte) (hs *handshake) {
+func newHandshake(infoHash []byte, peerId []byte) (hs *handshake) {
 	hs = &handshake{
 		protocol: []byte("BitTorrent protocol"),
 		infoHash: infoHash,
-		peerId:   PeerId,
+		peerId:   peerId,
 	}
 	return
 }
@@ -46,7 +46,7 @@ func parseHandshake(r io.Reader) (hs *handshake, err error) {
 	hs = new(handshake)
 
 	// Name length
-	_, err = r.Read(buf[0:1])
+	_, err = io.ReadFull(r, buf[0:1])
 	if err != nil {
 		return
 	} else if int(buf[0]) != 19 {
@@ -55,29 +55,30 @@ func parseHandshake(r io.Reader) (hs *handshake, err error) {
 	}
 
 	// Protocol
-	_, err = r.Read(buf[0:19])
+	_, err = io.ReadFull(r, buf[0:19])
 	if err != nil {
 		return
 	} else if !bytes.Equal(buf[0:19], []byte("BitTorrent protocol")) {
 		err = errors.New(fmt.Sprintf("Handshake halted: incompatible protocol: %s", buf[0:19]))
+		return
 	}
 	hs.protocol = append(hs.protocol, buf[0:19]...)
 
 	// Skip reserved bytes
-	_, err = r.Read(buf[0:8])
+	_, err = io.ReadFull(r, buf[0:8])
 	if err != nil {
 		return
 	}
 
 	// Info Hash
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return
 	}
 	hs.infoHash = append(hs.infoHash, buf...)
 
 	// PeerID
-	_, err = r.Read(buf)
+	_, err = io.ReadFull(r, buf)
 	if err != nil {
 		return
 	}
@@ -124,7 +125,7 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 	} else if id > Cancel {
 		// Return error on unknown messages
 		discard := make([]byte, length-1)
-		_, err = r.Read(discard)
+		_, err = io.ReadFull(r, discard)
 		if err != nil {
 			return
 		}
@@ -135,7 +136,7 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 	// Read payload (arbitrary size)
 	payload := make([]byte, length-1)
 	if length-1 > 0 {
-		if _, err = r.Read(payload); err != nil {
+		if _, err = io.ReadFull(r, payload); err != nil {
 			return
 		}
 	}
@@ -148,6 +149,8 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 		return parseUnchokeMessage(payloadReader)
 	case Interested:
 		return parseInterestedMessage(payloadReader)
+	case Uninterested:
+		return parseUninterestedMessage(payloadReader)
 	case Have:
 		return parseHaveMessage(payloadReader)
 	case Bitfield:
@@ -156,6 +159,8 @@ func parsePeerMessage(r io.Reader) (msg interface{}, err error) {
 		return parseRequestMessage(payloadReader)
 	case Piece:
 		return parsePieceMessage(payloadReader)
+	case Cancel:
+		return parseCancelMessage(payloadReader)
 	}
 
 	return
@@ -203,6 +208,20 @@ func (msg *interestedMessage) BinaryDump(w io.Writer) error {
 	return mw.err
 }
 
+type uninterestedMessage struct{}
+
+func parseUninterestedMessage(r io.Reader) (msg *uninterestedMessage, err error) {
+	msg = new(uninterestedMessage)
+	return
+}
+
+func (msg *uninterestedMessage) BinaryDump(w io.Writer) error {
+	mw := monadWriter{w: w}
+	mw.Write(uint32(1))
+	mw.Write(Uninterested)
+	return mw.err
+}
+
 type haveMessage struct {
 	pieceIndex uint32
 }
@@ -299,6 +318,31 @@ func (msg *pieceMessage) BinaryDump(w io.Writer) error {
 	return mw.err
 }
 
+type cancelMessage struct {
+	pieceIndex  uint32
+	blockOffset uint32
+	blockLength uint32
+}
+
+func parseCancelMessage(r io.Reader) (msg *cancelMessage, err error) {
+	msg = new(cancelMessage)
+	mr := &monadReader{r: r}
+	mr.Read(&msg.pieceIndex)
+	mr.Read(&msg.blockOffset)
+	mr.Read(&msg.blockLength)
+	return msg, mr.err
+}
+
+func (msg *cancelMessage) BinaryDump(w io.Writer) error {
+	mw := &monadWriter{w: w}
+	mw.Write(uint32(13)) // Length: status + 12 byte payload
+	mw.Write(Cancel)     // Message id
+	mw.Write(msg.pieceIndex)
+	mw.Write(msg.blockOffset)
+	mw.Write(msg.blockLength)
+	return mw.err
+}
+
 type unknownMessage struct {
 	id     uint8
 	length uint32
@@ -0,0 +1,49 @@
+package libtorrent
+
+import (
+	"bytes"
+	"testing"
+	"testing/iotest"
+)
+
+func TestCancelMessage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	(&cancelMessage{pieceIndex: 1, blockOffset: 16384, blockLength: 100}).BinaryDump(buf)
+	if !bytes.Equal(buf.Bytes(), []byte{0, 0, 0, 13, 8, 0, 0, 0, 1, 0, 0, 0x40, 0, 0, 0, 0, 100}) {
+		t.Errorf("Incorrect cancel message: %v", buf.Bytes())
+	}
+
+	msg, err := parsePeerMessage(buf)
+	if err != nil {
+		t.Fatal("Failed to parse cancel message: ", err)
+	}
+	if cancel, ok := msg.(*cancelMessage); !ok || *cancel != (cancelMessage{1, 16384, 100}) {
+		t.Errorf("Incorrect parsed message: %#v", msg)
+	}
+}
+
+func TestParsePeerMessageShortReads(t *testing.T) {
+	buf := new(bytes.Buffer)
+	(&pieceMessage{pieceIndex: 3, blockOffset: 0, data: []byte("some block data")}).BinaryDump(buf)
+
+	msg, err := parsePeerMessage(iotest.OneByteReader(buf))
+	if err != nil {
+		t.Fatal("Failed to parse piece message: ", err)
+	}
+	if piece, ok := msg.(*pieceMessage); !ok || string(piece.data) != "some block data" {
+		t.Errorf("Incorrect parsed message: %#v", msg)
+	}
+}
+
+func TestUninterestedMessage(t *testing.T) {
+	buf := new(bytes.Buffer)
+	(&uninterestedMessage{}).BinaryDump(buf)
+	if !bytes.Equal(buf.Bytes(), []byte{0, 0, 0, 1, 3}) {
+		t.Errorf("Incorrect uninterested message: %v", buf.Bytes())
+	}
+
+	msg, err := parsePeerMessage(buf)
+	if _, ok := msg.(*uninterestedMessage); !ok || err != nil {
+		t.Errorf("Failed to parse uninterested message: %#v, %v", msg, err)
+	}
+}
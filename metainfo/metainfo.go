@@ -16,6 +16,9 @@ type Metainfo struct {
 	PieceCount   int
 	PieceLength  int64
 	InfoHash     []byte
+	URLList      []string // BEP 19 (GetRight style) web seeds
+	HTTPSeeds    []string // BEP 17 (Hoffman style) web seeds
+	Private      bool     // BEP 27: peers may only come from the trackers listed here
 	Files        []struct {
 		Length int64
 		Path   string
@@ -26,12 +29,15 @@ func ParseMetainfo(r io.Reader) (m *Metainfo, err error) {
 	var metaDecode struct {
 		Announce string
 		List     [][]string         `bencode:"announce-list"`
+		URLList  interface{}        `bencode:"url-list"` // Either a single URL or a list
+		Seeds    []string           `bencode:"httpseeds"`
 		RawInfo  bencode.RawMessage `bencode:"info"`
 		Info     struct {
 			Length      int64
 			Name        string
 			Pieces      []byte
 			PieceLength int64 `bencode:"piece length"`
+			Private     int64 `bencode:"private"`
 			Files       []struct {
 				Length int64
 				Path   []string
@@ -65,6 +71,7 @@ func ParseMetainfo(r io.Reader) (m *Metainfo, err error) {
 		PieceLength: metaDecode.Info.PieceLength,
 		Pieces:      make([][]byte, len(metaDecode.Info.Pieces)/20),
 		PieceCount:  len(metaDecode.Info.Pieces) / 20,
+		Private:     metaDecode.Info.Private == 1,
 	}
 
 	// Append other announce lists
@@ -82,6 +89,19 @@ func ParseMetainfo(r io.Reader) (m *Metainfo, err error) {
 		m.AnnounceList = append(m.AnnounceList, list)
 	}
 
+	// Web seeds
+	switch urls := metaDecode.URLList.(type) {
+	case string:
+		m.URLList = []string{urls}
+	case []interface{}:
+		for _, u := range urls {
+			if u, ok := u.(string); ok {
+				m.URLList = append(m.URLList, u)
+			}
+		}
+	}
+	m.HTTPSeeds = metaDecode.Seeds
+
 	// Pieces is a single string of concatenated 20-byte SHA1 hash values for all pieces in the torrent
 	// Cycle through and create an slice of hashes
 	for i := 0; i < len(metaDecode.Info.Pieces)/20; i++ {
@@ -2,6 +2,7 @@ package metainfo
 
 import (
 	"bytes"
+	"github.com/zeebo/bencode"
 	"os"
 	"path/filepath"
 	"testing"
@@ -77,3 +78,52 @@ func TestParseMetainfoTwo(t *testing.T) {
 		t.Error("Incorrect infoshash: ", m.InfoHash)
 	}
 }
+
+func TestParseMetainfoPrivate(t *testing.T) {
+	for _, private := range []int{0, 1} {
+		info := map[string]interface{}{"name": "test.txt", "length": 10, "piece length": 16384, "pieces": string(make([]byte, 20)), "private": private}
+		b, err := bencode.EncodeBytes(map[string]interface{}{"info": info})
+		if err != nil {
+			t.Fatal("Failed to encode metainfo: ", err)
+		}
+		m, err := ParseMetainfo(bytes.NewReader(b))
+		if err != nil {
+			t.Fatal("Failed to parse metainfo: ", err)
+		}
+		if m.Private != (private == 1) {
+			t.Errorf("Private flag %d parsed as %v", private, m.Private)
+		}
+	}
+}
+
+func TestParseMetainfoWebSeeds(t *testing.T) {
+	encode := func(meta map[string]interface{}) *bytes.Reader {
+		meta["info"] = map[string]interface{}{"name": "test.txt", "length": 10, "piece length": 16384, "pieces": string(make([]byte, 20))}
+		b, err := bencode.EncodeBytes(meta)
+		if err != nil {
+			t.Fatal("Failed to encode metainfo: ", err)
+		}
+		return bytes.NewReader(b)
+	}
+
+	m, err := ParseMetainfo(encode(map[string]interface{}{
+		"url-list":  "http://example.com/files/",
+		"httpseeds": []string{"http://example.com/seed.php", "http://example.org/seed"},
+	}))
+	if err != nil {
+		t.Fatal("Failed to parse metainfo: ", err)
+	}
+	if len(m.URLList) != 1 || m.URLList[0] != "http://example.com/files/" {
+		t.Error("Incorrect url-list: ", m.URLList)
+	}
+	if len(m.HTTPSeeds) != 2 || m.HTTPSeeds[1] != "http://example.org/seed" {
+		t.Error("Incorrect httpseeds: ", m.HTTPSeeds)
+	}
+
+	m, err = ParseMetainfo(encode(map[string]interface{}{
+		"url-list": []string{"http://a.example.com/", "http://b.example.com/test.txt"},
+	}))
+	if err != nil || len(m.URLList) != 2 || m.URLList[1] != "http://b.example.com/test.txt" {
+		t.Error("Incorrect url-list: ", m.URLList, err)
+	}
+}
@@ -0,0 +1,105 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/filestore"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// MoveStorage moves the torrent's files beneath newRoot, which is created if need be.
+// Files are renamed where possible, and otherwise copied and checked. The torrent may be
+// running, paused or stopped, and carries on as before once its files have moved. Only
+// torrents stored beneath Config.RootDirectory can be moved.
+func (t *Torrent) MoveStorage(newRoot string) error {
+	if t.config.Storage != nil {
+		return errors.New("MoveStorage: only files beneath the root directory can be moved")
+	}
+	return t.relocate(func() (err error) {
+		root, paths := t.paths()
+		if err = os.MkdirAll(newRoot, 0755); err != nil {
+			return
+		}
+		var moved []string
+		for _, path := range paths {
+			if err = filestore.MoveFile(root, newRoot, path); err != nil {
+				// Put back the files we've already moved
+				for _, path := range moved {
+					filestore.MoveFile(newRoot, root, path)
+				}
+				return
+			}
+			moved = append(moved, path)
+		}
+
+		t.stateLock.Lock()
+		t.root = newRoot
+		t.stateLock.Unlock()
+		return
+	})
+}
+
+// RenameFile changes the path of the file at index, relative to the torrent's root
+// directory. This only affects where the file is stored: the metainfo and infohash are
+// unchanged.
+func (t *Torrent) RenameFile(index int, newPath string) error {
+	if index < 0 || index >= len(t.meta.Files) {
+		return errors.New(fmt.Sprintf("RenameFile: file index %d out of range", index))
+	}
+	newPath = filepath.Clean(newPath)
+	if filepath.IsAbs(newPath) || newPath == "." || newPath == ".." || strings.HasPrefix(newPath, ".."+string(filepath.Separator)) {
+		return errors.New(fmt.Sprintf("RenameFile: %s is not a path within the torrent", newPath))
+	}
+	renamer, ok := t.storageProvider().(filestore.Renamer)
+	if !ok {
+		return errors.New("RenameFile: storage does not support renaming files")
+	}
+
+	return t.relocate(func() error {
+		_, paths := t.paths()
+		for i, path := range paths {
+			if i != index && path == newPath {
+				return errors.New(fmt.Sprintf("RenameFile: %s is already used by file %d", newPath, i))
+			}
+		}
+		if err := renamer.Rename(paths[index], newPath); err != nil {
+			return err
+		}
+
+		t.stateLock.Lock()
+		t.filePaths[index] = newPath
+		t.stateLock.Unlock()
+		return nil
+	})
+}
+
+// relocate closes the torrent's files whilst fn moves them, then reopens them and
+// carries on in the same state as before. Files are rechecked when they are reopened.
+func (t *Torrent) relocate(fn func() error) (err error) {
+	t.lifecycleLock.Lock()
+	defer t.lifecycleLock.Unlock()
+
+	state := t.State()
+	if state == Leeching || state == Seeding {
+		t.halt()
+	}
+	open := t.fileStore != nil
+	t.closeStorage()
+
+	err = fn()
+
+	if open {
+		if e := t.openStorage(); e != nil {
+			t.setError(e)
+			return e
+		}
+	}
+	if state == Leeching || state == Seeding {
+		t.run()
+	} else {
+		t.setState(state)
+	}
+	return
+}
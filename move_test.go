@@ -0,0 +1,99 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/filestore"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// newTestSeed returns a torrent whose data is already complete beneath root.
+func newTestSeed(t *testing.T, root string) *Torrent {
+	os.MkdirAll(root, 0755)
+	if err := ioutil.WriteFile(filepath.Join(root, "test.txt"), testData(t), 0644); err != nil {
+		t.Fatal("Failed to write test data: ", err)
+	}
+	tor, err := NewTorrent(testMetainfo(), &Config{RootDirectory: root})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	return tor
+}
+
+func TestMoveStorage(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	oldRoot, newRoot := filepath.Join(tmpDir, "old"), filepath.Join(tmpDir, "new", "dir")
+	tor := newTestSeed(t, oldRoot)
+	defer tor.Stop()
+	tor.Start()
+	if tor.State() != Seeding {
+		t.Fatal("Complete torrent not seeding")
+	}
+
+	if err := tor.MoveStorage(newRoot); err != nil {
+		t.Fatal("Failed to move storage: ", err)
+	}
+	if tor.State() != Seeding {
+		t.Error("Torrent not seeding after move: ", tor.State())
+	}
+	if _, err := os.Stat(filepath.Join(oldRoot, "test.txt")); !os.IsNotExist(err) {
+		t.Error("File left in old directory")
+	}
+	if s := tor.Status(); s.DoneBytes != 36880 {
+		t.Error("Data lost in move: ", s.DoneBytes)
+	}
+	if rd := tor.ResumeData(); rd.SavePath != newRoot {
+		t.Error("Incorrect save path: ", rd.SavePath)
+	}
+
+	// Peers are served from the new location
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.expect(t)
+	rp.send(t, &interestedMessage{})
+	if _, ok := rp.expect(t).(*unchokeMessage); !ok {
+		t.Fatal("Expected unchoke")
+	}
+	rp.send(t, &requestMessage{pieceIndex: 1, blockOffset: 0, blockLength: 100})
+	if msg, ok := rp.expect(t).(*pieceMessage); !ok || string(msg.data) != string(testData(t)[32768:32868]) {
+		t.Error("Incorrect block after move")
+	}
+
+	// Only files beneath the root directory can be moved
+	mem, _ := NewTorrent(testMetainfo(), &Config{Storage: filestore.NewMemoryStorage()})
+	if err := mem.MoveStorage(oldRoot); err == nil {
+		t.Error("Expected error moving memory storage")
+	}
+}
+
+func TestRenameFile(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, tmpDir)
+	defer tor.Stop()
+
+	newPath := filepath.Join("sub", "renamed.txt")
+	if err := tor.RenameFile(0, newPath); err != nil {
+		t.Fatal("Failed to rename file: ", err)
+	}
+	if tor.State() != Stopped {
+		t.Error("Incorrect state after rename: ", tor.State())
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(tmpDir, newPath)); len(data) != 36880 {
+		t.Error("File not renamed on disk")
+	}
+	s := tor.Status()
+	if s.Files[0].Path != newPath || s.DoneBytes != 36880 {
+		t.Error("Incorrect status after rename: ", s.Files[0], s.DoneBytes)
+	}
+
+	for _, bad := range []string{"", "..", filepath.Join("..", "escape"), filepath.Join(tmpDir, "abs")} {
+		if err := tor.RenameFile(0, bad); err == nil {
+			t.Errorf("Expected error renaming to %q", bad)
+		}
+	}
+	if err := tor.RenameFile(1, "other"); err == nil {
+		t.Error("Expected error renaming missing file")
+	}
+}
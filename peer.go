@@ -1,23 +1,42 @@
 package libtorrent
 
 import (
+	"context"
 	"github.com/torrance/libtorrent/bitfield"
-	"io"
+	"net"
+	"net/netip"
 	"sync"
 	//"testing/iotest"
 )
 
+// maxQueuedPieces bounds the blocks a peer may have asked us for and not yet been sent,
+// including those still being read from disk. Further requests are refused, so that a
+// peer that never reads can't make us queue pieces without limit.
+var maxQueuedPieces = 128
+
 type peer struct {
 	name           string
-	conn           io.ReadWriter
-	write          chan binaryDumper
+	id             []byte
+	addr           string
+	dialAddr       netip.AddrPort // Address we dialed, if we initiated the connection
+	source         PeerSource
+	transport      string
+	conn           net.Conn       // Nil for web seeds
+	queue          []binaryDumper // Messages waiting to be written
+	queueLock      sync.Mutex
+	pendingPieces  int           // Requests accepted and not yet sent, guarded by queueLock
+	queued         chan struct{} // Signalled whenever a message is added to queue
 	read           chan peerDouble
+	closed         chan struct{}
+	closeOnce      sync.Once
 	amChoking      bool
 	amInterested   bool
 	peerChoking    bool
 	peerInterested bool
 	mutex          sync.RWMutex
 	bitf           *bitfield.Bitfield
+	stats          *transferStats
+	requests       map[block]bool // Block requests sent to the peer and not yet answered
 }
 
 type peerDouble struct {
@@ -25,16 +44,30 @@ type peerDouble struct {
 	peer *peer
 }
 
-func newPeer(name string, conn io.ReadWriter, readChan chan peerDouble) (p *peer) {
+// peerClosedMessage is sent on the read channel once the read loop has exited,
+// so that the torrent can drop the peer from its swarm.
+type peerClosedMessage struct{}
+
+// newPeer starts the read and write loops for conn, which has completed the handshake hs.
+// The read loop stops delivering messages on readChan once ctx is done. Payload
+// transferred is also counted in stats.
+func newPeer(ctx context.Context, hs *handshake, conn net.Conn, source PeerSource, readChan chan peerDouble, lim *limits, stats *transferStats) (p *peer) {
 	p = &peer{
-		name:           name,
+		name:           string(hs.peerId),
+		id:             hs.peerId,
+		addr:           conn.RemoteAddr().String(),
+		source:         source,
+		transport:      "tcp",
 		conn:           conn,
-		write:          make(chan binaryDumper, 10),
+		queued:         make(chan struct{}, 1),
 		read:           readChan,
+		closed:         make(chan struct{}),
+		stats:          newTransferStats(stats),
 		amChoking:      true,
 		amInterested:   false,
 		peerChoking:    true,
 		peerInterested: false,
+		requests:       make(map[block]bool),
 	}
 
 	// Write loop
@@ -42,12 +75,25 @@ func newPeer(name string, conn io.ReadWriter, readChan chan peerDouble) (p *peer
 		for {
 			//conn := iotest.NewWriteLogger("Writing", conn)
 			// TODO: send regular keep alive requests
-			msg := <-p.write
-			if err := msg.BinaryDump(conn); err != nil {
-				// TODO: Close peer
-				logger.Error("%s Received error writing to connection: %s", p.name, err)
+			select {
+			case <-p.queued:
+			case <-p.closed:
 				return
 			}
+			for msg := p.dequeue(); msg != nil; msg = p.dequeue() {
+				piece, isPiece := msg.(*pieceMessage)
+				if isPiece {
+					lim.upload.Wait(len(piece.data))
+				}
+				if err := msg.BinaryDump(conn); err != nil {
+					logger.Error("%s Received error writing to connection: %s", p.name, err)
+					p.Close()
+					return
+				}
+				if isPiece {
+					p.stats.uploaded.Add(len(piece.data))
+				}
+			}
 		}
 	}()
 
@@ -61,17 +107,111 @@ func newPeer(name string, conn io.ReadWriter, readChan chan peerDouble) (p *peer
 				// Log unknown messages and then ignore
 				logger.Info(err.Error())
 			} else if err != nil {
-				// TODO: Close peer
 				logger.Debug("%s Received error reading connection: %s", p.name, err)
 				break
 			}
-			readChan <- peerDouble{msg: msg, peer: p}
+			if msg, ok := msg.(*pieceMessage); ok {
+				p.stats.downloaded.Add(len(msg.data))
+				lim.download.Wait(len(msg.data))
+			}
+			select {
+			case readChan <- peerDouble{msg: msg, peer: p}:
+			case <-ctx.Done():
+				p.Close()
+				return
+			}
+		}
+		p.Close()
+		select {
+		case readChan <- peerDouble{msg: &peerClosedMessage{}, peer: p}:
+		case <-ctx.Done():
 		}
 	}()
 
 	return
 }
 
+// Send queues msg for writing, dropping it if the peer has been closed.
+func (p *peer) Send(msg binaryDumper) {
+	select {
+	case <-p.closed:
+		return
+	default:
+	}
+
+	p.queueLock.Lock()
+	p.queue = append(p.queue, msg)
+	p.queueLock.Unlock()
+
+	select {
+	case p.queued <- struct{}{}:
+	default:
+		// The write loop has already been signalled
+	}
+}
+
+// dequeue pops the next message to be written, returning nil if the queue is empty.
+func (p *peer) dequeue() (msg binaryDumper) {
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+	if len(p.queue) > 0 {
+		msg = p.queue[0]
+		p.queue[0] = nil
+		p.queue = p.queue[1:]
+		if _, ok := msg.(*pieceMessage); ok {
+			p.pendingPieces--
+		}
+	}
+	return
+}
+
+// reservePiece counts a block request we are about to serve, returning false if the
+// peer already has maxQueuedPieces waiting. Each reservation is released when the piece
+// message is written or cancelled, or by releasePiece if it is never sent.
+func (p *peer) reservePiece() bool {
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+	if p.pendingPieces >= maxQueuedPieces {
+		return false
+	}
+	p.pendingPieces++
+	return true
+}
+
+// releasePiece releases the reservation of a request that won't be sent.
+func (p *peer) releasePiece() {
+	p.queueLock.Lock()
+	p.pendingPieces--
+	p.queueLock.Unlock()
+}
+
+// CancelPiece removes a queued piece message for the given block, as requested by the
+// peer's cancel message. It returns false if the piece wasn't found, most likely because
+// it has already been sent.
+func (p *peer) CancelPiece(pieceIndex, blockOffset, blockLength uint32) bool {
+	p.queueLock.Lock()
+	defer p.queueLock.Unlock()
+	for i, msg := range p.queue {
+		if msg, ok := msg.(*pieceMessage); ok && msg.pieceIndex == pieceIndex &&
+			msg.blockOffset == blockOffset && uint32(len(msg.data)) == blockLength {
+			p.queue = append(p.queue[:i], p.queue[i+1:]...)
+			p.pendingPieces--
+			return true
+		}
+	}
+	return false
+}
+
+// Close shuts down the connection. It is safe to call more than once.
+func (p *peer) Close() {
+	p.closeOnce.Do(func() {
+		close(p.closed)
+		if p.conn != nil {
+			p.conn.Close()
+		}
+	})
+}
+
 func (p *peer) GetAmChoking() (b bool) {
 	p.mutex.RLock()
 	b = p.amChoking
@@ -85,6 +225,26 @@ func (p *peer) SetAmChoking(b bool) {
 	p.mutex.Unlock()
 }
 
+func (p *peer) GetAmInterested() (b bool) {
+	p.mutex.RLock()
+	b = p.amInterested
+	p.mutex.RUnlock()
+	return
+}
+
+func (p *peer) SetAmInterested(b bool) {
+	p.mutex.Lock()
+	p.amInterested = b
+	p.mutex.Unlock()
+}
+
+func (p *peer) GetPeerChoking() (b bool) {
+	p.mutex.RLock()
+	b = p.peerChoking
+	p.mutex.RUnlock()
+	return
+}
+
 func (p *peer) SetPeerChoking(b bool) {
 	p.mutex.Lock()
 	p.peerChoking = b
@@ -110,8 +270,60 @@ func (p *peer) SetBitfield(bitf *bitfield.Bitfield) {
 	p.mutex.Unlock()
 }
 
-func (p *peer) HasPiece(index int) {
+// HasPiece records a have message. Peers with no pieces may not send a bitfield at all,
+// so one of length pieceCount is created if required.
+func (p *peer) HasPiece(index int, pieceCount int) {
 	p.mutex.Lock()
+	if p.bitf == nil {
+		p.bitf = bitfield.NewBitfield(pieceCount)
+	}
 	p.bitf.SetTrue(index)
 	p.mutex.Unlock()
 }
+
+// Bitfield returns a copy of the peer's pieces, or nil if it hasn't told us about any.
+func (p *peer) Bitfield() *bitfield.Bitfield {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	if p.bitf == nil {
+		return nil
+	}
+	return p.bitf.Copy()
+}
+
+func (p *peer) AddRequest(b block) {
+	p.mutex.Lock()
+	p.requests[b] = true
+	p.mutex.Unlock()
+}
+
+// RemoveRequest forgets an outstanding request, returning false if there wasn't one.
+func (p *peer) RemoveRequest(b block) (ok bool) {
+	p.mutex.Lock()
+	ok = p.requests[b]
+	delete(p.requests, b)
+	p.mutex.Unlock()
+	return
+}
+
+// ClearRequests forgets all outstanding requests. Peers discard our requests when they
+// choke us.
+func (p *peer) ClearRequests() {
+	p.mutex.Lock()
+	p.requests = make(map[block]bool)
+	p.mutex.Unlock()
+}
+
+func (p *peer) RequestCount() (n int) {
+	p.mutex.RLock()
+	n = len(p.requests)
+	p.mutex.RUnlock()
+	return
+}
+
+// IsSeed returns true if the peer has told us it has every piece.
+func (p *peer) IsSeed() bool {
+	p.mutex.RLock()
+	defer p.mutex.RUnlock()
+	return p.bitf != nil && p.bitf.Length() > 0 && p.bitf.SumTrue() >= p.bitf.Length()
+}
@@ -0,0 +1,152 @@
+package libtorrent
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Fingerprint identifies our client in the Azureus-style peer ids we generate:
+// "-" + Client + a character for each part of the version + "-", then 12 random
+// characters. Each part of the version is 0-35, written 0-9 then A-Z.
+type Fingerprint struct {
+	Client                      string // Two letter client code
+	Major, Minor, Revision, Tag int
+}
+
+// DefaultFingerprint is used when Config.Fingerprint is zero.
+var DefaultFingerprint = Fingerprint{Client: "GO", Major: 0, Minor: 1}
+
+const versionChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZ"
+
+// idChars are the characters used for the random part of peer ids, so that they are
+// readable and survive being put in URLs unescaped.
+const idChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz-_"
+
+// String returns the start of the peer ids generated for f, eg. "-GO0100-".
+func (f Fingerprint) String() string {
+	var b strings.Builder
+	b.WriteString("-" + f.Client)
+	for _, v := range []int{f.Major, f.Minor, f.Revision, f.Tag} {
+		if v >= 0 && v < len(versionChars) {
+			b.WriteByte(versionChars[v])
+		} else {
+			b.WriteByte('?')
+		}
+	}
+	b.WriteString("-")
+	return b.String()
+}
+
+// NewPeerId generates a random peer id carrying the fingerprint.
+func (f Fingerprint) NewPeerId() (peerId []byte, err error) {
+	if len(f.Client) != 2 || !isAlnum(f.Client[0]) || !isAlnum(f.Client[1]) {
+		return nil, errors.New(fmt.Sprintf("NewPeerId: invalid client code %q", f.Client))
+	}
+	prefix := f.String()
+	if strings.Contains(prefix, "?") {
+		return nil, errors.New(fmt.Sprintf("NewPeerId: version of %s out of range", f.Client))
+	}
+	peerId = make([]byte, 20)
+	copy(peerId, prefix)
+	random := peerId[len(prefix):]
+	if _, err = rand.Read(random); err != nil {
+		return nil, err
+	}
+	for i, b := range random {
+		random[i] = idChars[int(b)%len(idChars)]
+	}
+	return
+}
+
+func isAlnum(c byte) bool {
+	return (c >= '0' && c <= '9') || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+// azureusClients maps the two letter client codes used in Azureus-style peer ids
+// ("-XX1234-...") to client names.
+var azureusClients = map[string]string{
+	"AZ": "Vuze",
+	"BC": "BitComet",
+	"BT": "BitTorrent",
+	"DE": "Deluge",
+	"GO": "libtorrent (Go)",
+	"KT": "KTorrent",
+	"LT": "libtorrent (Rasterbar)",
+	"lt": "libTorrent (rTorrent)",
+	"qB": "qBittorrent",
+	"TR": "Transmission",
+	"UT": "µTorrent",
+}
+
+// shadowClients maps the client letter of Shadow-style peer ids ("S58B--...") to
+// client names.
+var shadowClients = map[byte]string{
+	'A': "ABC",
+	'O': "Osprey Permaseed",
+	'Q': "BTQueue",
+	'R': "Tribler",
+	'S': "Shadow",
+	'T': "BitTornado",
+	'U': "UPnP NAT Bit Torrent",
+}
+
+// mainlineClients maps the client letter of Mainline-style peer ids ("M4-3-6--...") to
+// client names.
+var mainlineClients = map[string]string{
+	"M": "Mainline",
+	"Q": "Queen Bee",
+}
+
+var mainlineId = regexp.MustCompile(`^([A-Z])(\d{1,3})-(\d{1,3})-(\d{1,3})--?`)
+
+// shadowVersionChars are the characters of Shadow-style versions, each standing for
+// its index.
+const shadowVersionChars = "0123456789ABCDEFGHIJKLMNOPQRSTUVWXYZabcdefghijklmnopqrstuvwxyz.-"
+
+// clientName decodes a peer id into a human readable client name and version.
+func clientName(peerId []byte) string {
+	id := string(peerId)
+
+	if strings.HasPrefix(id, "libt-") {
+		// Peer ids of older versions of this library
+		return "libtorrent (Go)"
+	}
+
+	if len(id) >= 8 && id[0] == '-' && id[7] == '-' {
+		name, ok := azureusClients[id[1:3]]
+		if !ok {
+			name = id[1:3]
+		}
+		// Drop trailing zeros from the version, eg. 2940 -> 2.9.4
+		version := strings.TrimRight(id[3:7], "0")
+		if version == "" {
+			version = "0"
+		}
+		return fmt.Sprintf("%s %s", name, strings.Join(strings.Split(version, ""), "."))
+	}
+
+	if m := mainlineId.FindStringSubmatch(id); m != nil && len(m[0]) == 8 {
+		if name, ok := mainlineClients[m[1]]; ok {
+			return fmt.Sprintf("%s %s.%s.%s", name, m[2], m[3], m[4])
+		}
+	}
+
+	if len(id) >= 6 && id[4:6] == "--" {
+		if name, ok := shadowClients[id[0]]; ok {
+			var version []string
+			for _, c := range []byte(id[1:4]) {
+				v := strings.IndexByte(shadowVersionChars, c)
+				if v < 0 {
+					return "Unknown"
+				}
+				version = append(version, fmt.Sprint(v))
+			}
+			return fmt.Sprintf("%s %s", name, strings.Join(version, "."))
+		}
+	}
+
+	return "Unknown"
+}
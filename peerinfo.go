@@ -0,0 +1,89 @@
+package libtorrent
+
+// PeerSource records how we came to be connected to a peer.
+type PeerSource int
+
+const (
+	SourceUnknown PeerSource = iota
+	SourceTracker
+	SourceDHT
+	SourcePEX
+	SourceLSD
+	SourceIncoming
+	SourceWebSeed
+)
+
+var peerSourceNames = []string{"unknown", "tracker", "dht", "pex", "lsd", "incoming", "webseed"}
+
+func (ps PeerSource) String() string {
+	if int(ps) < 0 || int(ps) >= len(peerSourceNames) {
+		return "unknown"
+	}
+	return peerSourceNames[ps]
+}
+
+// PeerInfo describes a connected peer.
+type PeerInfo struct {
+	Addr      string
+	PeerId    []byte
+	Client    string // Client name and version decoded from PeerId
+	Source    PeerSource
+	Transport string // "tcp", or "http" for web seeds
+	Encrypted bool
+
+	AmChoking      bool
+	AmInterested   bool
+	PeerChoking    bool
+	PeerInterested bool
+
+	DownloadRate int64 // Payload bytes per second
+	UploadRate   int64 // Payload bytes per second
+	Downloaded   int64
+	Uploaded     int64
+
+	OutstandingRequests int     // Block requests sent to the peer and not yet answered
+	Progress            float64 // Fraction of pieces the peer has, between 0 and 1
+	HashFailures        int     // Failed pieces the peer has sent blocks for
+}
+
+// Peers returns information about each connected peer.
+func (t *Torrent) Peers() (infos []PeerInfo) {
+	for _, p := range t.peers() {
+		info := p.Info(t.meta.PieceCount)
+		info.HashFailures = t.bans.Failures(peerKey(p))
+		infos = append(infos, info)
+	}
+	return
+}
+
+// Info returns a snapshot of the peer's state. pieceCount is used to calculate progress.
+func (p *peer) Info(pieceCount int) PeerInfo {
+	info := PeerInfo{
+		Addr:         p.addr,
+		PeerId:       p.id,
+		Client:       clientName(p.id),
+		Source:       p.source,
+		Transport:    p.transport,
+		DownloadRate: p.stats.downloaded.Rate(),
+		UploadRate:   p.stats.uploaded.Rate(),
+		Downloaded:   p.stats.downloaded.Total(),
+		Uploaded:     p.stats.uploaded.Total(),
+	}
+
+	p.mutex.RLock()
+	info.AmChoking = p.amChoking
+	info.AmInterested = p.amInterested
+	info.PeerChoking = p.peerChoking
+	info.PeerInterested = p.peerInterested
+	info.OutstandingRequests = len(p.requests)
+	if p.bitf != nil && pieceCount > 0 {
+		info.Progress = float64(p.bitf.SumTrue()) / float64(pieceCount)
+		if info.Progress > 1 {
+			// Spare bits at the end of the bitfield were set
+			info.Progress = 1
+		}
+	}
+	p.mutex.RUnlock()
+
+	return info
+}
@@ -0,0 +1,107 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+	"strings"
+	"testing"
+)
+
+func TestPeers(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	tor.Start()
+
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	if _, ok := rp.expect(t).(*bitfieldMessage); !ok {
+		t.Fatal("Expected bitfield on connect")
+	}
+
+	bitf := bitfield.NewBitfield(2)
+	bitf.SetTrue(1)
+	rp.send(t, &bitfieldMessage{bitf: bitf})
+	rp.send(t, &unchokeMessage{})
+	waitFor(t, "unchoke", func() bool {
+		infos := tor.Peers()
+		return len(infos) == 1 && !infos[0].PeerChoking && infos[0].OutstandingRequests > 0
+	})
+
+	info := tor.Peers()[0]
+	if info.Client != "Transmission 2.9.4" || string(info.PeerId) != "-TR2940-abcdefghijkl" {
+		t.Error("Incorrect peer id or client: ", string(info.PeerId), info.Client)
+	}
+	if info.Source != SourceIncoming || info.Transport != "tcp" || info.Addr == "" {
+		t.Error("Incorrect connection details: ", info.Source, info.Transport, info.Addr)
+	}
+	// The peer has a piece we need, so we should be interested and requesting it
+	if !info.AmChoking || !info.AmInterested || info.PeerInterested {
+		t.Error("Incorrect choke/interest flags: ", info)
+	}
+	if info.OutstandingRequests != 1 {
+		t.Error("Incorrect outstanding requests: ", info.OutstandingRequests)
+	}
+	if info.Progress != 0.5 {
+		t.Error("Incorrect progress: ", info.Progress)
+	}
+}
+
+func TestClientName(t *testing.T) {
+	tests := map[string]string{
+		"-TR2940-abcdefghijkl": "Transmission 2.9.4",
+		"-qB4250-abcdefghijkl": "qBittorrent 4.2.5",
+		"-XX1000-abcdefghijkl": "XX 1",
+		"-GO0100-abcdefghijkl": "libtorrent (Go) 0.1",
+		"libt-   123456789012": "libtorrent (Go)",
+		"M4-3-6--abcdefghijkl": "Mainline 4.3.6",
+		"M4-20-8-abcdefghijkl": "Mainline 4.20.8",
+		"S58B--abcdefghijklmn": "Shadow 5.8.11",
+		"T03I--abcdefghijklmn": "BitTornado 0.3.18",
+		"X03I--abcdefghijklmn": "Unknown",
+		"M7-2-2-abcdefghijklm": "Unknown",
+	}
+	for id, want := range tests {
+		if got := clientName([]byte(id)); got != want {
+			t.Errorf("clientName(%q) = %q, want %q", id, got, want)
+		}
+	}
+}
+
+func TestNewPeerId(t *testing.T) {
+	f := Fingerprint{Client: "XY", Major: 1, Minor: 12, Revision: 3}
+	a, err := f.NewPeerId()
+	if err != nil {
+		t.Fatal("Failed to generate peer id: ", err)
+	}
+	b, _ := f.NewPeerId()
+	if len(a) != 20 || !strings.HasPrefix(string(a), "-XY1C30-") || string(a) == string(b) {
+		t.Errorf("Incorrect peer ids: %q, %q", a, b)
+	}
+	if strings.Trim(string(a[8:]), idChars) != "" {
+		t.Errorf("Unexpected characters in peer id: %q", a)
+	}
+
+	for _, bad := range []Fingerprint{{Client: "X"}, {Client: "X-"}, {Client: "XY", Minor: 36}, {Client: "XY", Tag: -1}} {
+		if _, err := bad.NewPeerId(); err == nil {
+			t.Error("Expected error for fingerprint ", bad)
+		}
+	}
+
+	// Each torrent has its own peer id
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	config := &Config{RootDirectory: tmpDir}
+	first, err := NewTorrent(testMetainfo(), config)
+	if err != nil {
+		t.Fatal("Failed to create torrent: ", err)
+	}
+	second, err := NewTorrent(testMetainfo(), config)
+	if err != nil {
+		t.Fatal("Failed to create torrent: ", err)
+	}
+	if !strings.HasPrefix(string(first.PeerId()), DefaultFingerprint.String()) || string(first.PeerId()) == string(second.PeerId()) {
+		t.Errorf("Incorrect torrent peer ids: %q, %q", first.PeerId(), second.PeerId())
+	}
+	config.Fingerprint = Fingerprint{Client: "X"}
+	if _, err := NewTorrent(testMetainfo(), config); err == nil {
+		t.Error("Expected error for invalid fingerprint")
+	}
+}
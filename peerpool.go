@@ -0,0 +1,220 @@
+package libtorrent
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"net/netip"
+	"sort"
+	"sync"
+	"time"
+)
+
+const (
+	defaultMaxHalfOpen = 8
+
+	// maxDialFailures is the number of consecutive failed connection attempts after which
+	// an address is forgotten.
+	maxDialFailures = 5
+)
+
+// dialRetry is how long to wait before retrying an address that failed once. The wait
+// doubles with each further failure.
+var dialRetry = time.Second * 30
+
+// peerPool holds the addresses of peers we could connect to, from every source. Each
+// address is kept once, and addresses are handed out highest priority first (BEP 40),
+// with no more than maxHalfOpen connection attempts in progress at a time. Addresses
+// that fail are retried with exponential backoff, and forgotten after maxDialFailures
+// consecutive failures.
+type peerPool struct {
+	candidates  map[netip.AddrPort]*candidate
+	halfOpen    int
+	maxHalfOpen int
+	self        func() (v4 netip.Addr, v6 netip.Addr) // Our addresses, for prioritising
+	mutex       sync.Mutex
+}
+
+type candidate struct {
+	addr      netip.AddrPort
+	source    PeerSource
+	failures  int
+	retryAt   time.Time
+	dialing   bool
+	connected bool
+}
+
+func newPeerPool(maxHalfOpen int, self func() (netip.Addr, netip.Addr)) *peerPool {
+	if maxHalfOpen <= 0 {
+		maxHalfOpen = defaultMaxHalfOpen
+	}
+	return &peerPool{
+		candidates:  make(map[netip.AddrPort]*candidate),
+		maxHalfOpen: maxHalfOpen,
+		self:        self,
+	}
+}
+
+// Add records an address we could connect to. It returns false if the address was
+// already known.
+func (pp *peerPool) Add(addr netip.AddrPort, source PeerSource) bool {
+	addr = netip.AddrPortFrom(addr.Addr().Unmap(), addr.Port())
+	if !addr.IsValid() || addr.Port() == 0 {
+		return false
+	}
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if _, ok := pp.candidates[addr]; ok {
+		return false
+	}
+	pp.candidates[addr] = &candidate{addr: addr, source: source}
+	return true
+}
+
+// Next returns the highest priority address that is ready to be dialed, marking it as
+// dialing. ok is false if there is none, or too many dials are already in progress.
+func (pp *peerPool) Next() (addr netip.AddrPort, source PeerSource, ok bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if pp.halfOpen >= pp.maxHalfOpen {
+		return
+	}
+
+	v4, v6 := pp.self()
+	now := time.Now()
+	var best *candidate
+	var bestPriority uint32
+	for _, c := range pp.candidates {
+		if c.dialing || c.connected || now.Before(c.retryAt) {
+			continue
+		}
+		self := netip.AddrPortFrom(v4, 0)
+		if c.addr.Addr().Is6() {
+			self = netip.AddrPortFrom(v6, 0)
+		}
+		priority := peerPriority(self, c.addr)
+		if best == nil || priority > bestPriority {
+			best, bestPriority = c, priority
+		}
+	}
+	if best == nil {
+		return
+	}
+	best.dialing = true
+	pp.halfOpen++
+	return best.addr, best.source, true
+}
+
+// Connected records that the dial to addr succeeded.
+func (pp *peerPool) Connected(addr netip.AddrPort) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if c, ok := pp.candidates[addr]; ok && c.dialing {
+		c.dialing, c.connected, c.failures = false, true, 0
+		pp.halfOpen--
+	}
+}
+
+// Failed records that the dial to addr failed, scheduling a retry or forgetting the
+// address.
+func (pp *peerPool) Failed(addr netip.AddrPort) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	c, ok := pp.candidates[addr]
+	if !ok || !c.dialing {
+		return
+	}
+	c.dialing = false
+	pp.halfOpen--
+	c.failures++
+	if c.failures >= maxDialFailures {
+		delete(pp.candidates, addr)
+		return
+	}
+	c.retryAt = time.Now().Add(dialRetry * time.Duration(1<<(c.failures-1)))
+}
+
+// Cancelled returns addr to the pool after a dial abandoned for reasons of our own, such
+// as the torrent stopping, without counting it as a failure.
+func (pp *peerPool) Cancelled(addr netip.AddrPort) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if c, ok := pp.candidates[addr]; ok && c.dialing {
+		c.dialing = false
+		pp.halfOpen--
+	}
+}
+
+// Disconnected records that the connection to addr has closed. The address may be
+// dialed again after dialRetry.
+func (pp *peerPool) Disconnected(addr netip.AddrPort) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if c, ok := pp.candidates[addr]; ok && c.connected {
+		c.connected = false
+		c.retryAt = time.Now().Add(dialRetry)
+	}
+}
+
+// Remove forgets addr, such as when it has been blocked.
+func (pp *peerPool) Remove(addr netip.AddrPort) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if c, ok := pp.candidates[addr]; ok {
+		if c.dialing {
+			pp.halfOpen--
+		}
+		delete(pp.candidates, addr)
+	}
+}
+
+// Len returns the number of known addresses.
+func (pp *peerPool) Len() int {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	return len(pp.candidates)
+}
+
+var crc32c = crc32.MakeTable(crc32.Castagnoli)
+
+// peerPriority is the canonical priority of a connection between a and b (BEP 40), the
+// same whichever end calculates it. Connecting to peers in priority order means every
+// peer prefers the same connections, so swarms stay well connected without relying on
+// the addresses trackers happen to hand out.
+func peerPriority(a netip.AddrPort, b netip.AddrPort) uint32 {
+	if a.Addr() == b.Addr() {
+		ports := []uint16{a.Port(), b.Port()}
+		sort.Slice(ports, func(i, j int) bool { return ports[i] < ports[j] })
+		buf := make([]byte, 4)
+		binary.BigEndian.PutUint16(buf, ports[0])
+		binary.BigEndian.PutUint16(buf[2:], ports[1])
+		return crc32.Checksum(buf, crc32c)
+	}
+
+	ab, bb := a.Addr().AsSlice(), b.Addr().AsSlice()
+	if len(ab) != len(bb) {
+		// Different families: compare both as IPv6
+		a16, b16 := a.Addr().As16(), b.Addr().As16()
+		ab, bb = a16[:], b16[:]
+	}
+	// The first /16 (IPv4) or /48 (IPv6) is always used in full, and each further byte
+	// only if the addresses share every byte before it. The rest is masked with 0x55.
+	fixed := 2
+	if len(ab) == 16 {
+		fixed = 6
+	}
+	shared := 0
+	for shared < len(ab) && ab[shared] == bb[shared] {
+		shared++
+	}
+	for i := fixed; i < len(ab); i++ {
+		if i > shared {
+			ab[i] &= 0x55
+			bb[i] &= 0x55
+		}
+	}
+	if bytes.Compare(ab, bb) > 0 {
+		ab, bb = bb, ab
+	}
+	return crc32.Checksum(append(ab, bb...), crc32c)
+}
@@ -0,0 +1,206 @@
+package libtorrent
+
+import (
+	"net"
+	"net/netip"
+	"testing"
+	"time"
+)
+
+func noSelf() (netip.Addr, netip.Addr) {
+	return netip.Addr{}, netip.Addr{}
+}
+
+func TestPeerPriority(t *testing.T) {
+	// Examples from BEP 40
+	cases := []struct {
+		a, b     string
+		priority uint32
+	}{
+		{"123.213.32.10:0", "98.76.54.32:0", 0xec2d7224},
+		{"123.213.32.10:0", "123.213.32.234:0", 0x99568189},
+	}
+	for _, c := range cases {
+		a, b := netip.MustParseAddrPort(c.a), netip.MustParseAddrPort(c.b)
+		if p := peerPriority(a, b); p != c.priority {
+			t.Errorf("peerPriority(%s, %s) = %x, expected %x", a, b, p, c.priority)
+		}
+		if p := peerPriority(b, a); p != c.priority {
+			t.Errorf("peerPriority(%s, %s) = %x, expected %x", b, a, p, c.priority)
+		}
+	}
+
+	// The same address on different ports uses the ports alone
+	a := netip.MustParseAddrPort("10.0.0.1:6881")
+	b := netip.MustParseAddrPort("10.0.0.1:6882")
+	if peerPriority(a, b) != peerPriority(b, a) {
+		t.Error("Priority depends on order of ports")
+	}
+}
+
+func TestPeerPoolDedupe(t *testing.T) {
+	pool := newPeerPool(0, noSelf)
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+	if !pool.Add(addr, SourceTracker) {
+		t.Error("New address rejected")
+	}
+	if pool.Add(addr, SourceTracker) {
+		t.Error("Duplicate address added")
+	}
+	if pool.Add(netip.MustParseAddrPort("[::ffff:10.0.0.1]:6881"), SourceTracker) {
+		t.Error("IPv4-mapped duplicate added")
+	}
+	if pool.Add(netip.MustParseAddrPort("10.0.0.2:0"), SourceTracker) {
+		t.Error("Address without port added")
+	}
+	if pool.Len() != 1 {
+		t.Error("Incorrect length: ", pool.Len())
+	}
+}
+
+func TestPeerPoolHalfOpen(t *testing.T) {
+	pool := newPeerPool(2, noSelf)
+	for _, s := range []string{"10.0.0.1:1", "10.0.0.2:1", "10.0.0.3:1"} {
+		pool.Add(netip.MustParseAddrPort(s), SourceTracker)
+	}
+	first, _, ok1 := pool.Next()
+	second, _, ok2 := pool.Next()
+	if !ok1 || !ok2 || first == second {
+		t.Fatal("Failed to get two addresses: ", first, second)
+	}
+	if addr, _, ok := pool.Next(); ok {
+		t.Fatal("Exceeded half-open limit: ", addr)
+	}
+
+	// Finishing a dial frees a slot
+	pool.Connected(first)
+	third, _, ok := pool.Next()
+	if !ok || third == first || third == second {
+		t.Fatal("Failed to get third address: ", third)
+	}
+	pool.Cancelled(second)
+	pool.Cancelled(third)
+	// Connected addresses aren't handed out again
+	for i := 0; i < 2; i++ {
+		if addr, _, _ := pool.Next(); addr == first {
+			t.Error("Connected address handed out again")
+		}
+	}
+}
+
+func TestPeerPoolPriority(t *testing.T) {
+	self := netip.MustParseAddr("123.213.32.10")
+	pool := newPeerPool(10, func() (netip.Addr, netip.Addr) { return self, netip.Addr{} })
+	addrs := []string{"98.76.54.32:6881", "123.213.32.234:6881", "1.2.3.4:6881", "200.1.1.1:6881"}
+	for _, s := range addrs {
+		pool.Add(netip.MustParseAddrPort(s), SourceTracker)
+	}
+	var last uint32
+	for i := range addrs {
+		addr, _, ok := pool.Next()
+		if !ok {
+			t.Fatal("Ran out of addresses")
+		}
+		priority := peerPriority(netip.AddrPortFrom(self, 0), addr)
+		if i > 0 && priority > last {
+			t.Errorf("%s (%x) handed out after lower priority %x", addr, priority, last)
+		}
+		last = priority
+	}
+}
+
+func TestPeerPoolBackoff(t *testing.T) {
+	defer func(d time.Duration) { dialRetry = d }(dialRetry)
+	dialRetry = time.Millisecond * 20
+
+	pool := newPeerPool(0, noSelf)
+	addr := netip.MustParseAddrPort("10.0.0.1:6881")
+	pool.Add(addr, SourceTracker)
+	for i := 1; i < maxDialFailures; i++ {
+		if _, _, ok := pool.Next(); !ok {
+			t.Fatal("Address not ready after failure ", i-1)
+		}
+		pool.Failed(addr)
+		if _, _, ok := pool.Next(); ok {
+			t.Fatal("Address retried without waiting after failure ", i)
+		}
+		// The wait doubles with each failure
+		time.Sleep(dialRetry * time.Duration(1<<(i-1)))
+	}
+	if _, _, ok := pool.Next(); !ok {
+		t.Fatal("Address not ready for final attempt")
+	}
+	pool.Failed(addr)
+	if pool.Len() != 0 {
+		t.Error("Address not forgotten after repeated failures")
+	}
+
+	// A dropped connection is retried after a wait
+	pool.Add(addr, SourceTracker)
+	pool.Next()
+	pool.Connected(addr)
+	pool.Disconnected(addr)
+	if _, _, ok := pool.Next(); ok {
+		t.Error("Address redialed at once after disconnecting")
+	}
+	time.Sleep(dialRetry)
+	if _, _, ok := pool.Next(); !ok {
+		t.Error("Address not redialed after disconnecting")
+	}
+}
+
+func TestPeerPoolDials(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor, err := NewTorrent(testMetainfo(), &Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer tor.Stop()
+	tor.Start()
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer ln.Close()
+	accepted := make(chan net.Conn, 10)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			accepted <- conn
+		}
+	}()
+
+	// The same address from several announces is dialed once
+	addr := netip.MustParseAddrPort(ln.Addr().String())
+	for i := 0; i < 3; i++ {
+		tor.incomingPeerAddr <- addr
+	}
+	var conn net.Conn
+	select {
+	case conn = <-accepted:
+		defer conn.Close()
+	case <-time.After(time.Second * 5):
+		t.Fatal("Address not dialed")
+	}
+	if _, err := parseHandshake(conn); err != nil {
+		t.Fatal("Failed to read handshake: ", err)
+	}
+	if err := newHandshake(tor.InfoHash(), tor.PeerId()).BinaryDump(conn); err != nil {
+		t.Fatal("Failed to send handshake: ", err)
+	}
+	waitFor(t, "peer to connect", func() bool { return len(tor.Peers()) == 1 })
+
+	select {
+	case <-accepted:
+		t.Error("Address dialed more than once")
+	case <-time.After(time.Millisecond * 100):
+	}
+	if tor.pool.Len() != 1 {
+		t.Error("Incorrect pool length: ", tor.pool.Len())
+	}
+}
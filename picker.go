@@ -0,0 +1,481 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+	"sort"
+	"sync"
+	"time"
+)
+
+// blockSize is the size of the blocks we request from peers.
+const blockSize = 16384
+
+// maxPeerRequests is the number of block requests we keep outstanding with each peer.
+const maxPeerRequests = 10
+
+type block struct {
+	piece  int
+	offset int64
+	length int64
+}
+
+// pieceProgress tracks the blocks of a piece that is being downloaded.
+type pieceProgress struct {
+	blocks   []blockProgress
+	received int
+	owner    *peer // The only peer that may download an exclusive piece
+}
+
+type blockProgress struct {
+	requested []*peer // Peers with an outstanding request for this block
+	received  bool
+	from      *peer // Peer that sent the block
+}
+
+// piecePicker decides which blocks to request from which peers. Pieces with deadlines are
+// chosen first, earliest deadline first, and once late are requested from every peer
+// that has them. Then come prioritised pieces, then pieces already in progress, then new
+// pieces rarest first (or in order, in sequential mode). Once every remaining block has
+// been requested the picker enters endgame mode, and blocks are requested again from any
+// peer that has them. The first copy to arrive wins and the remaining requests should be
+// cancelled.
+//
+// Exclusive pieces are downloaded from whichever peer is first picked to start them, so
+// that a piece that fails its hash check can be blamed on a single peer.
+type piecePicker struct {
+	pieceCount  int
+	pieceLength int64
+	totalLength int64
+	tally       swarmTally // Number of peers with each piece, or -1 if we have it
+	inProgress  map[int]*pieceProgress
+	endgame     bool
+	sequential  bool  // Start new pieces in order rather than rarest first
+	priority    []int // Number of readers that want each piece soon
+	deadlines   map[int]time.Time
+	exclusive   map[int]bool
+	mutex       sync.Mutex
+}
+
+// newPiecePicker creates a picker that will download the pieces missing from have.
+func newPiecePicker(have *bitfield.Bitfield, pieceLength int64, totalLength int64) *piecePicker {
+	pp := &piecePicker{
+		pieceCount:  have.Length(),
+		pieceLength: pieceLength,
+		totalLength: totalLength,
+		priority:    make([]int, have.Length()),
+		deadlines:   make(map[int]time.Time),
+		exclusive:   make(map[int]bool),
+	}
+	pp.Reset(have)
+	return pp
+}
+
+// Reset forgets the swarm and all download progress, as happens when the torrent's files
+// are rechecked. Priorities, deadlines, exclusive pieces and the picking mode are kept.
+func (pp *piecePicker) Reset(have *bitfield.Bitfield) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	pp.tally = make(swarmTally, pp.pieceCount)
+	pp.inProgress = make(map[int]*pieceProgress)
+	pp.endgame = false
+	for i := range pp.tally {
+		if have.Get(i) {
+			pp.tally[i] = -1
+		}
+	}
+}
+
+func (pp *piecePicker) SetSequential(sequential bool) {
+	pp.mutex.Lock()
+	pp.sequential = sequential
+	pp.mutex.Unlock()
+}
+
+// SetDeadline asks for the piece to be downloaded by deadline. It returns false if we
+// already have the piece.
+func (pp *piecePicker) SetDeadline(index int, deadline time.Time) bool {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if pp.tally[index] == -1 {
+		return false
+	}
+	pp.deadlines[index] = deadline
+	return true
+}
+
+// SetExclusive has the piece downloaded again from a single peer.
+func (pp *piecePicker) SetExclusive(index int) {
+	pp.mutex.Lock()
+	pp.exclusive[index] = true
+	pp.mutex.Unlock()
+}
+
+func (pp *piecePicker) ClearDeadlines() {
+	pp.mutex.Lock()
+	pp.deadlines = make(map[int]time.Time)
+	pp.mutex.Unlock()
+}
+
+// Prioritise adds delta to the priority of pieces first to last inclusive. Pieces with
+// a positive priority are downloaded before any others.
+func (pp *piecePicker) Prioritise(first int, last int, delta int) {
+	pp.mutex.Lock()
+	for i := first; i <= last && i < pp.pieceCount; i++ {
+		if i >= 0 {
+			pp.priority[i] += delta
+		}
+	}
+	pp.mutex.Unlock()
+}
+
+func (pp *piecePicker) lengthOf(index int) int64 {
+	if index == pp.pieceCount-1 {
+		return pp.totalLength - int64(index)*pp.pieceLength
+	}
+	return pp.pieceLength
+}
+
+func (pp *piecePicker) AddBitfield(bitf *bitfield.Bitfield) {
+	pp.mutex.Lock()
+	pp.tally.AddBitfield(bitf)
+	pp.mutex.Unlock()
+}
+
+func (pp *piecePicker) RemoveBitfield(bitf *bitfield.Bitfield) {
+	pp.mutex.Lock()
+	pp.tally.RemoveBitfield(bitf)
+	pp.mutex.Unlock()
+}
+
+// AddHave counts a single piece announced by a have message.
+func (pp *piecePicker) AddHave(index int) {
+	pp.mutex.Lock()
+	if index >= 0 && index < len(pp.tally) && pp.tally[index] != -1 {
+		pp.tally[index]++
+	}
+	pp.mutex.Unlock()
+}
+
+// Interesting returns true if bitf contains any piece we don't have.
+func (pp *piecePicker) Interesting(bitf *bitfield.Bitfield) bool {
+	if bitf == nil {
+		return false
+	}
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	for i, n := range pp.tally {
+		if n != -1 && bitf.Get(i) {
+			return true
+		}
+	}
+	return false
+}
+
+// InEndgame returns true once every remaining block has been requested at least once.
+func (pp *piecePicker) InEndgame() (b bool) {
+	pp.mutex.Lock()
+	b = pp.endgame
+	pp.mutex.Unlock()
+	return
+}
+
+// Pick chooses up to n blocks to request from p, which has the pieces in has. The blocks
+// are recorded as requested by p.
+func (pp *piecePicker) Pick(p *peer, has *bitfield.Bitfield, n int) (blocks []block) {
+	if has == nil || n <= 0 {
+		return
+	}
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	// Pieces with deadlines come first. Late pieces are requested even if other peers
+	// have already been asked for them.
+	now := time.Now()
+	for _, index := range pp.byDeadline(has) {
+		if len(blocks) >= n {
+			return
+		}
+		if _, ok := pp.inProgress[index]; !ok {
+			pp.start(index, p)
+		}
+		blocks = pp.pickFromPiece(p, index, n-len(blocks), blocks, now.After(pp.deadlines[index]))
+	}
+
+	// Then pieces that are wanted soon, whether or not they have been started
+	for _, index := range pp.prioritised(has) {
+		if len(blocks) >= n {
+			return
+		}
+		if _, ok := pp.inProgress[index]; !ok {
+			pp.start(index, p)
+		}
+		blocks = pp.pickFromPiece(p, index, n-len(blocks), blocks, false)
+	}
+
+	// Finish off pieces that are already in progress
+	for _, index := range pp.sortedInProgress() {
+		if len(blocks) >= n {
+			return
+		}
+		if has.Get(index) {
+			blocks = pp.pickFromPiece(p, index, n-len(blocks), blocks, false)
+		}
+	}
+
+	// Then start new pieces
+	for _, index := range pp.unstarted(has) {
+		if len(blocks) >= n {
+			return
+		}
+		pp.start(index, p)
+		blocks = pp.pickFromPiece(p, index, n-len(blocks), blocks, false)
+	}
+
+	if len(blocks) > 0 || !pp.allRequested() {
+		return
+	}
+
+	// Endgame: request blocks that are already outstanding with other peers
+	pp.endgame = true
+	for _, index := range pp.sortedInProgress() {
+		if len(blocks) >= n {
+			return
+		}
+		if has.Get(index) {
+			blocks = pp.pickFromPiece(p, index, n-len(blocks), blocks, true)
+		}
+	}
+	return
+}
+
+// start begins tracking the blocks of a new piece, which p will download if the piece
+// is exclusive.
+func (pp *piecePicker) start(index int, p *peer) {
+	length := pp.lengthOf(index)
+	count := int((length + blockSize - 1) / blockSize)
+	progress := &pieceProgress{blocks: make([]blockProgress, count)}
+	if pp.exclusive[index] {
+		progress.owner = p
+	}
+	pp.inProgress[index] = progress
+}
+
+// pickFromPiece appends up to n blocks of the piece to blocks. Normally only blocks with
+// no outstanding request are chosen; in endgame any block not yet requested from p is.
+func (pp *piecePicker) pickFromPiece(p *peer, index int, n int, blocks []block, endgame bool) []block {
+	progress := pp.inProgress[index]
+	if progress.owner == nil && pp.exclusive[index] {
+		// The previous owner went away
+		progress.owner = p
+	}
+	if progress.owner != nil && progress.owner != p {
+		return blocks
+	}
+	length := pp.lengthOf(index)
+	for i := range progress.blocks {
+		if n == 0 {
+			break
+		}
+		bp := &progress.blocks[i]
+		if bp.received || (!endgame && len(bp.requested) > 0) || containsPeer(bp.requested, p) {
+			continue
+		}
+		b := block{piece: index, offset: int64(i) * blockSize, length: blockSize}
+		if b.offset+b.length > length {
+			b.length = length - b.offset
+		}
+		bp.requested = append(bp.requested, p)
+		blocks = append(blocks, b)
+		n--
+	}
+	return blocks
+}
+
+// sortedInProgress returns the indices of pieces in progress, lowest first.
+func (pp *piecePicker) sortedInProgress() (indices []int) {
+	for index := range pp.inProgress {
+		indices = append(indices, index)
+	}
+	sort.Ints(indices)
+	return
+}
+
+// byDeadline returns the pieces in has that we don't have and have a deadline, earliest
+// first.
+func (pp *piecePicker) byDeadline(has *bitfield.Bitfield) (indices []int) {
+	for index := range pp.deadlines {
+		if pp.tally[index] != -1 && has.Get(index) {
+			indices = append(indices, index)
+		}
+	}
+	sort.Slice(indices, func(a, b int) bool {
+		return pp.deadlines[indices[a]].Before(pp.deadlines[indices[b]])
+	})
+	return
+}
+
+// prioritised returns the pieces in has that we don't have and have a positive priority,
+// lowest first.
+func (pp *piecePicker) prioritised(has *bitfield.Bitfield) (indices []int) {
+	for i, n := range pp.tally {
+		if n != -1 && pp.priority[i] > 0 && has.Get(i) {
+			indices = append(indices, i)
+		}
+	}
+	return
+}
+
+// unstarted returns the pieces in has that we don't have and haven't started. They are
+// ordered by the number of peers that have them, or by index in sequential mode.
+func (pp *piecePicker) unstarted(has *bitfield.Bitfield) (indices []int) {
+	for i, n := range pp.tally {
+		if n == -1 || !has.Get(i) {
+			continue
+		}
+		if _, ok := pp.inProgress[i]; ok {
+			continue
+		}
+		indices = append(indices, i)
+	}
+	if pp.sequential {
+		return
+	}
+	sort.SliceStable(indices, func(a, b int) bool {
+		return pp.tally[indices[a]] < pp.tally[indices[b]]
+	})
+	return
+}
+
+// allRequested returns true if every block we still need has an outstanding request.
+func (pp *piecePicker) allRequested() bool {
+	for i, n := range pp.tally {
+		if n == -1 {
+			continue
+		}
+		progress, ok := pp.inProgress[i]
+		if !ok {
+			return false
+		}
+		for _, bp := range progress.blocks {
+			if !bp.received && len(bp.requested) == 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Received marks the block as received from p. It returns the other peers that still have
+// a request outstanding for the block, which should be sent cancels, and whether the piece
+// now has all of its blocks. ok is false if the block wasn't wanted, or wasn't requested
+// from p, so that an unsolicited block can't take the place of a requested one.
+func (pp *piecePicker) Received(p *peer, b block) (others []*peer, complete bool, ok bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+
+	bp := pp.blockProgress(b)
+	if bp == nil || bp.received || !containsPeer(bp.requested, p) {
+		return
+	}
+	for _, q := range bp.requested {
+		if q != p {
+			others = append(others, q)
+		}
+	}
+	bp.requested = nil
+	bp.received = true
+	bp.from = p
+
+	progress := pp.inProgress[b.piece]
+	progress.received++
+	return others, progress.received == len(progress.blocks), true
+}
+
+// blockProgress returns the progress of a block in a piece being downloaded, or nil if b
+// doesn't describe one. The caller must hold mutex.
+func (pp *piecePicker) blockProgress(b block) *blockProgress {
+	progress, ok := pp.inProgress[b.piece]
+	if !ok || b.offset%blockSize != 0 || b.offset/blockSize >= int64(len(progress.blocks)) {
+		return nil
+	}
+	i := int(b.offset / blockSize)
+	expected := pp.lengthOf(b.piece) - b.offset
+	if expected > blockSize {
+		expected = blockSize
+	}
+	if b.length != expected {
+		return nil
+	}
+	return &progress.blocks[i]
+}
+
+// Unrequest forgets p's request for a single block, making it available to other peers.
+func (pp *piecePicker) Unrequest(p *peer, b block) {
+	pp.mutex.Lock()
+	if bp := pp.blockProgress(b); bp != nil {
+		bp.requested = removePeer(bp.requested, p)
+	}
+	pp.mutex.Unlock()
+}
+
+// Abandon forgets all of p's outstanding requests, as happens when it chokes us or
+// disconnects.
+func (pp *piecePicker) Abandon(p *peer) {
+	pp.mutex.Lock()
+	for _, progress := range pp.inProgress {
+		if progress.owner == p {
+			progress.owner = nil
+		}
+		for i := range progress.blocks {
+			progress.blocks[i].requested = removePeer(progress.blocks[i].requested, p)
+		}
+	}
+	pp.mutex.Unlock()
+}
+
+// Finished records that we now have the verified piece. If the piece had a deadline it
+// is removed and returned, and ok is true.
+func (pp *piecePicker) Finished(index int) (deadline time.Time, ok bool) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	delete(pp.inProgress, index)
+	delete(pp.exclusive, index)
+	pp.tally[index] = -1
+	if deadline, ok = pp.deadlines[index]; ok {
+		delete(pp.deadlines, index)
+	}
+	return
+}
+
+// Failed discards all progress on a piece, so that it will be downloaded again from
+// scratch. It returns the peer that sent each of the piece's blocks.
+func (pp *piecePicker) Failed(index int) (senders []*peer) {
+	pp.mutex.Lock()
+	defer pp.mutex.Unlock()
+	if progress, ok := pp.inProgress[index]; ok {
+		for _, bp := range progress.blocks {
+			senders = append(senders, bp.from)
+		}
+	}
+	delete(pp.inProgress, index)
+	pp.endgame = false
+	return
+}
+
+func containsPeer(peers []*peer, p *peer) bool {
+	for _, q := range peers {
+		if q == p {
+			return true
+		}
+	}
+	return false
+}
+
+func removePeer(peers []*peer, p *peer) []*peer {
+	for i, q := range peers {
+		if q == p {
+			return append(peers[:i], peers[i+1:]...)
+		}
+	}
+	return peers
+}
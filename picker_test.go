@@ -0,0 +1,210 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+	"testing"
+	"time"
+)
+
+func TestPickerRarestFirst(t *testing.T) {
+	pp := newPiecePicker(bitfield.NewBitfield(4), 16384, 4*16384)
+	pp.AddBitfield(fullBitfield(4))
+	pp.AddBitfield(fullBitfield(4))
+	pp.AddHave(1)
+	pp.AddHave(3)
+	pp.AddHave(3)
+
+	// Availability is now 2, 3, 2, 4
+	p := &peer{}
+	blocks := pp.Pick(p, fullBitfield(4), 4)
+	order := []int{0, 2, 1, 3}
+	for i, b := range blocks {
+		if b.piece != order[i] || b.offset != 0 || b.length != 16384 {
+			t.Errorf("Block %d incorrect: %#v", i, b)
+		}
+	}
+}
+
+func TestPickerFinishesPiecesInProgress(t *testing.T) {
+	have := bitfield.NewBitfield(3)
+	have.SetTrue(0)
+	pp := newPiecePicker(have, 3*blockSize, 8*blockSize+100)
+
+	a, b := &peer{}, &peer{}
+	first := pp.Pick(a, fullBitfield(3), 2)
+	if len(first) != 2 || first[0].piece != 1 || first[1].offset != blockSize {
+		t.Fatalf("Incorrect first pick: %#v", first)
+	}
+	// The remaining block of piece 1 is picked before starting piece 2
+	second := pp.Pick(b, fullBitfield(3), 3)
+	if len(second) != 3 || second[0].piece != 1 || second[0].offset != 2*blockSize || second[1].piece != 2 {
+		t.Fatalf("Incorrect second pick: %#v", second)
+	}
+	// The last piece is short
+	last := pp.Pick(a, fullBitfield(3), 10)
+	if len(last) != 1 || last[0].piece != 2 || last[0].length != 100 {
+		t.Fatalf("Incorrect final block: %#v", last)
+	}
+}
+
+func TestPickerEndgame(t *testing.T) {
+	pp := newPiecePicker(bitfield.NewBitfield(1), 2*blockSize, 2*blockSize)
+	a, b := &peer{}, &peer{}
+
+	blocks := pp.Pick(a, fullBitfield(1), 10)
+	if len(blocks) != 2 || pp.InEndgame() {
+		t.Fatal("Incorrect initial pick: ", blocks)
+	}
+	dups := pp.Pick(b, fullBitfield(1), 10)
+	if len(dups) != 2 || !pp.InEndgame() {
+		t.Fatal("Endgame did not duplicate requests: ", dups)
+	}
+	if again := pp.Pick(a, fullBitfield(1), 10); len(again) != 0 {
+		t.Error("Blocks requested twice from the same peer: ", again)
+	}
+
+	others, complete, ok := pp.Received(b, blocks[0])
+	if !ok || complete || len(others) != 1 || others[0] != a {
+		t.Error("Incorrect result receiving first block: ", others, complete, ok)
+	}
+	if _, _, ok = pp.Received(a, blocks[0]); ok {
+		t.Error("Duplicate block accepted")
+	}
+	if _, complete, _ = pp.Received(a, blocks[1]); !complete {
+		t.Error("Piece not complete")
+	}
+}
+
+func TestPickerAbandon(t *testing.T) {
+	pp := newPiecePicker(bitfield.NewBitfield(1), blockSize, blockSize)
+	a, b := &peer{}, &peer{}
+
+	if len(pp.Pick(a, fullBitfield(1), 1)) != 1 {
+		t.Fatal("Failed to pick block")
+	}
+	pp.Abandon(a)
+	if pp.InEndgame() {
+		t.Error("In endgame with unrequested blocks")
+	}
+	if blocks := pp.Pick(b, fullBitfield(1), 1); len(blocks) != 1 || pp.InEndgame() {
+		t.Error("Abandoned block not available to other peers: ", blocks)
+	}
+}
+
+func TestPickerPriorityAndSequential(t *testing.T) {
+	pp := newPiecePicker(bitfield.NewBitfield(4), blockSize, 4*blockSize)
+	pp.AddHave(0)
+	pp.AddHave(0)
+	pp.AddHave(1)
+	pp.AddHave(2)
+	pp.AddHave(2)
+
+	pp.SetSequential(true)
+	pp.Prioritise(2, 2, 1)
+	blocks := pp.Pick(&peer{}, fullBitfield(4), 4)
+	order := []int{2, 0, 1, 3}
+	for i, b := range blocks {
+		if b.piece != order[i] {
+			t.Errorf("Block %d incorrect: %#v", i, b)
+		}
+	}
+
+	// Priorities survive a reset
+	pp.Reset(bitfield.NewBitfield(4))
+	pp.SetSequential(false)
+	pp.Prioritise(2, 3, 1)
+	pp.Prioritise(2, 2, -2)
+	blocks = pp.Pick(&peer{}, fullBitfield(4), 1)
+	if len(blocks) != 1 || blocks[0].piece != 3 {
+		t.Errorf("Expected prioritised piece 3, got %#v", blocks)
+	}
+}
+
+func TestPickerDeadlines(t *testing.T) {
+	have := bitfield.NewBitfield(4)
+	have.SetTrue(3)
+	pp := newPiecePicker(have, 2*blockSize, 8*blockSize)
+	pp.Prioritise(0, 0, 1)
+
+	if pp.SetDeadline(3, time.Now()) {
+		t.Error("Deadline set for a piece we have")
+	}
+	pp.SetDeadline(2, time.Now().Add(time.Minute))
+	pp.SetDeadline(1, time.Now().Add(time.Second))
+
+	a, b := &peer{}, &peer{}
+	blocks := pp.Pick(a, fullBitfield(4), 5)
+	order := []int{1, 1, 2, 2, 0}
+	for i, bl := range blocks {
+		if bl.piece != order[i] {
+			t.Errorf("Block %d incorrect: %#v", i, bl)
+		}
+	}
+
+	// Once late, a piece's blocks are requested again from other peers
+	pp.SetDeadline(1, time.Now().Add(-time.Second))
+	blocks = pp.Pick(b, fullBitfield(4), 3)
+	if len(blocks) != 3 || blocks[0].piece != 1 || blocks[1].piece != 1 || blocks[2].piece != 0 {
+		t.Errorf("Late piece not requested again: %#v", blocks)
+	}
+	if pp.InEndgame() {
+		t.Error("Late piece started endgame")
+	}
+
+	if _, ok := pp.Finished(1); !ok {
+		t.Error("Deadline not returned on finish")
+	}
+	if _, ok := pp.Finished(1); ok {
+		t.Error("Deadline not removed on finish")
+	}
+	pp.ClearDeadlines()
+	if _, ok := pp.Finished(2); ok {
+		t.Error("Deadlines not cleared")
+	}
+}
+
+func TestPickerExclusive(t *testing.T) {
+	pp := newPiecePicker(bitfield.NewBitfield(1), 2*blockSize, 2*blockSize)
+	a, b := &peer{}, &peer{}
+
+	first := pp.Pick(a, fullBitfield(1), 1)
+	pp.Received(a, first[0])
+	second := pp.Pick(b, fullBitfield(1), 1)
+	pp.Received(b, second[0])
+	if senders := pp.Failed(0); len(senders) != 2 || senders[0] != a || senders[1] != b {
+		t.Fatal("Incorrect senders: ", senders)
+	}
+
+	// Once exclusive, the piece is only downloaded by the peer that starts it
+	pp.SetExclusive(0)
+	if blocks := pp.Pick(a, fullBitfield(1), 1); len(blocks) != 1 {
+		t.Fatal("Exclusive piece not started: ", blocks)
+	}
+	if blocks := pp.Pick(b, fullBitfield(1), 10); len(blocks) != 0 {
+		t.Error("Exclusive piece picked for another peer: ", blocks)
+	}
+	// Until its owner goes away
+	pp.Abandon(a)
+	if blocks := pp.Pick(b, fullBitfield(1), 10); len(blocks) != 2 {
+		t.Error("Abandoned exclusive piece not picked: ", blocks)
+	}
+}
+
+func TestPickerUnsolicited(t *testing.T) {
+	pp := newPiecePicker(bitfield.NewBitfield(1), 2*blockSize, 2*blockSize)
+	a, b := &peer{}, &peer{}
+	pp.SetExclusive(0)
+
+	// A block that wasn't requested from b can't take a's place
+	blocks := pp.Pick(a, fullBitfield(1), 10)
+	if _, _, ok := pp.Received(b, blocks[0]); ok {
+		t.Error("Unsolicited block accepted")
+	}
+	if others, _, ok := pp.Received(a, blocks[0]); !ok || len(others) != 0 {
+		t.Error("Requested block refused: ", others, ok)
+	}
+	pp.Received(a, blocks[1])
+	if senders := pp.Failed(0); len(senders) != 2 || senders[0] != a || senders[1] != a {
+		t.Error("Incorrect senders: ", senders)
+	}
+}
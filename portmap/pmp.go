@@ -0,0 +1,287 @@
+package portmap
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// PMPPort is the port NAT-PMP and PCP gateways listen on.
+const PMPPort = 5351
+
+// pmpTimeout is how long to wait for the first response to a request. Each retry waits
+// twice as long as the one before.
+var pmpTimeout = time.Millisecond * 250
+
+const pmpTries = 4
+
+const (
+	pmpVersion = 0
+	pcpVersion = 2
+
+	pcpOpAnnounce = 0
+	pcpOpMap      = 1
+
+	pmpOpExternalAddr = 0
+	pmpOpMapUDP       = 1
+	pmpOpMapTCP       = 2
+)
+
+// pmpGateway speaks PCP to gateways that support it, and NAT-PMP to those that don't.
+type pmpGateway struct {
+	addr     netip.AddrPort
+	pcp      bool
+	nonces   map[Protocol][12]byte // PCP nonce of each mapping, needed to refresh or delete it
+	external netip.Addr            // Learned from PCP mappings
+	mutex    sync.Mutex
+}
+
+// DiscoverPMP returns the NAT-PMP or PCP gateway at addr, preferring PCP.
+func DiscoverPMP(ctx context.Context, addr netip.AddrPort) (g Gateway, err error) {
+	pg := &pmpGateway{addr: addr, nonces: make(map[Protocol][12]byte)}
+	resp, err := pg.request(ctx, pcpOpAnnounce, func(local netip.Addr) []byte {
+		return pcpHeader(pcpOpAnnounce, 0, local)
+	})
+	if err != nil {
+		return
+	}
+	if resp[0] == pcpVersion {
+		if resp[3] != 0 {
+			return nil, errors.New(fmt.Sprintf("PCP announce failed with result %d", resp[3]))
+		}
+		pg.pcp = true
+		return pg, nil
+	}
+
+	// A NAT-PMP gateway answers PCP with an unsupported version error
+	if _, err = pg.ExternalIP(ctx); err != nil {
+		return
+	}
+	return pg, nil
+}
+
+func (pg *pmpGateway) String() string {
+	if pg.pcp {
+		return fmt.Sprintf("PCP gateway %s", pg.addr)
+	}
+	return fmt.Sprintf("NAT-PMP gateway %s", pg.addr)
+}
+
+func (pg *pmpGateway) AddMapping(ctx context.Context, proto Protocol, internal, external uint16, lifetime time.Duration) (mapped uint16, granted time.Duration, err error) {
+	if !pg.pcp {
+		return pg.natpmpMap(ctx, proto, internal, external, lifetime)
+	}
+	return pg.pcpMap(ctx, proto, internal, external, lifetime)
+}
+
+func (pg *pmpGateway) DeleteMapping(ctx context.Context, proto Protocol, internal, external uint16) (err error) {
+	if !pg.pcp {
+		_, _, err = pg.natpmpMap(ctx, proto, internal, 0, 0)
+	} else {
+		_, _, err = pg.pcpMap(ctx, proto, internal, 0, 0)
+	}
+	return
+}
+
+func (pg *pmpGateway) ExternalIP(ctx context.Context) (ip netip.Addr, err error) {
+	if pg.pcp {
+		// PCP has no request for the address alone; it comes with each mapping
+		pg.mutex.Lock()
+		defer pg.mutex.Unlock()
+		if !pg.external.IsValid() {
+			return ip, errors.New("no PCP mapping yet")
+		}
+		return pg.external, nil
+	}
+
+	resp, err := pg.request(ctx, pmpOpExternalAddr, func(netip.Addr) []byte {
+		return []byte{pmpVersion, pmpOpExternalAddr}
+	})
+	if err != nil {
+		return
+	}
+	if err = pmpResult(resp); err != nil {
+		return
+	}
+	if len(resp) < 12 {
+		return ip, errors.New("NAT-PMP external address response too short")
+	}
+	ip = netip.AddrFrom4([4]byte(resp[8:12]))
+	return
+}
+
+// natpmpMap makes, refreshes or, with a zero lifetime, deletes a NAT-PMP mapping.
+func (pg *pmpGateway) natpmpMap(ctx context.Context, proto Protocol, internal, external uint16, lifetime time.Duration) (mapped uint16, granted time.Duration, err error) {
+	op := byte(pmpOpMapTCP)
+	if proto == UDP {
+		op = pmpOpMapUDP
+	}
+	resp, err := pg.request(ctx, op, func(netip.Addr) []byte {
+		b := make([]byte, 12)
+		b[0], b[1] = pmpVersion, op
+		binary.BigEndian.PutUint16(b[4:], internal)
+		binary.BigEndian.PutUint16(b[6:], external)
+		binary.BigEndian.PutUint32(b[8:], uint32(lifetime/time.Second))
+		return b
+	})
+	if err != nil {
+		return
+	}
+	if err = pmpResult(resp); err != nil {
+		return
+	}
+	if len(resp) < 16 {
+		return 0, 0, errors.New("NAT-PMP mapping response too short")
+	}
+	mapped = binary.BigEndian.Uint16(resp[10:])
+	granted = time.Duration(binary.BigEndian.Uint32(resp[12:])) * time.Second
+	return
+}
+
+// pcpMap makes, refreshes or, with a zero lifetime, deletes a PCP mapping.
+func (pg *pmpGateway) pcpMap(ctx context.Context, proto Protocol, internal, external uint16, lifetime time.Duration) (mapped uint16, granted time.Duration, err error) {
+	pg.mutex.Lock()
+	nonce, ok := pg.nonces[proto]
+	if !ok {
+		rand.Read(nonce[:])
+		pg.nonces[proto] = nonce
+	}
+	pg.mutex.Unlock()
+
+	protoNumber := byte(6)
+	if proto == UDP {
+		protoNumber = 17
+	}
+	resp, err := pg.request(ctx, pcpOpMap, func(local netip.Addr) []byte {
+		b := pcpHeader(pcpOpMap, lifetime, local)
+		payload := make([]byte, 36)
+		copy(payload, nonce[:])
+		payload[12] = protoNumber
+		binary.BigEndian.PutUint16(payload[16:], internal)
+		binary.BigEndian.PutUint16(payload[18:], external)
+		// Any external address, in the family we are using
+		if local.Is4() {
+			payload[30], payload[31] = 0xff, 0xff
+		}
+		return append(b, payload...)
+	})
+	if err != nil {
+		return
+	}
+	if resp[3] != 0 {
+		return 0, 0, errors.New(fmt.Sprintf("PCP mapping failed with result %d", resp[3]))
+	}
+	if len(resp) < 60 {
+		return 0, 0, errors.New("PCP mapping response too short")
+	}
+	if string(resp[24:36]) != string(nonce[:]) {
+		return 0, 0, errors.New("PCP mapping response has the wrong nonce")
+	}
+	mapped = binary.BigEndian.Uint16(resp[42:])
+	granted = time.Duration(binary.BigEndian.Uint32(resp[4:])) * time.Second
+	if lifetime == 0 {
+		return
+	}
+	pg.mutex.Lock()
+	pg.external = netip.AddrFrom16([16]byte(resp[44:60])).Unmap()
+	pg.mutex.Unlock()
+	return
+}
+
+// pcpHeader builds the common header of PCP requests.
+func pcpHeader(op byte, lifetime time.Duration, local netip.Addr) []byte {
+	b := make([]byte, 24)
+	b[0], b[1] = pcpVersion, op
+	binary.BigEndian.PutUint32(b[4:], uint32(lifetime/time.Second))
+	local16 := local.As16()
+	copy(b[8:], local16[:])
+	return b
+}
+
+// pmpResult returns the error reported by a NAT-PMP response, if any.
+func pmpResult(resp []byte) error {
+	if len(resp) < 4 {
+		return errors.New("NAT-PMP response too short")
+	}
+	if resp[0] != pmpVersion {
+		return errors.New(fmt.Sprintf("unexpected NAT-PMP version %d", resp[0]))
+	}
+	if result := binary.BigEndian.Uint16(resp[2:]); result != 0 {
+		return errors.New(fmt.Sprintf("NAT-PMP request failed with result %d", result))
+	}
+	return nil
+}
+
+// request sends the request built for our local address to the gateway, retrying with
+// backoff, and returns the response to op. Both protocols answer with the opcode plus
+// 128, and a NAT-PMP gateway answers a PCP request with an unsupported version error.
+func (pg *pmpGateway) request(ctx context.Context, op byte, build func(local netip.Addr) []byte) (resp []byte, err error) {
+	conn, err := net.DialUDP("udp", nil, net.UDPAddrFromAddrPort(pg.addr))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	req := build(conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap())
+	b := make([]byte, 1100)
+	timeout := pmpTimeout
+	for try := 0; try < pmpTries; try++ {
+		if _, err = conn.Write(req); err != nil {
+			return
+		}
+		conn.SetReadDeadline(time.Now().Add(timeout))
+		for {
+			n, e := conn.Read(b)
+			if ctx.Err() != nil {
+				return nil, ctx.Err()
+			}
+			if e != nil {
+				// Timed out, or the gateway refused the packet
+				err = e
+				break
+			}
+			if n < 4 || b[1] != op|0x80 {
+				continue
+			}
+			return append([]byte(nil), b[:n]...), nil
+		}
+		timeout *= 2
+	}
+	return nil, errors.New(fmt.Sprintf("no response from %s: %s", pg.addr, err))
+}
+
+// defaultGateway returns the address of the default IPv4 gateway, from the kernel's
+// routing table. It only works on Linux.
+func defaultGateway() (addr netip.Addr, err error) {
+	f, err := os.Open("/proc/net/route")
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		// Iface Destination Gateway Flags ..., with addresses in little endian hex
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 3 || fields[1] != "00000000" {
+			continue
+		}
+		b, e := hex.DecodeString(fields[2])
+		if e != nil || len(b) != 4 {
+			continue
+		}
+		return netip.AddrFrom4([4]byte{b[3], b[2], b[1], b[0]}), nil
+	}
+	return addr, errors.New("no default route")
+}
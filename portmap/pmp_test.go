@@ -0,0 +1,161 @@
+package portmap
+
+import (
+	"context"
+	"encoding/binary"
+	"net"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testPMPServer is a gateway speaking PCP, or only NAT-PMP. NAT-PMP mappings are given
+// the external port after the one asked for, so that the difference shows.
+type testPMPServer struct {
+	conn     *net.UDPConn
+	pcp      bool
+	mappings map[byte]uint16 // External port by protocol number
+	mutex    sync.Mutex
+}
+
+func newTestPMPServer(t *testing.T, pcp bool) *testPMPServer {
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	s := &testPMPServer{conn: conn, pcp: pcp, mappings: make(map[byte]uint16)}
+	go s.serve()
+	return s
+}
+
+func (s *testPMPServer) addr() netip.AddrPort {
+	return s.conn.LocalAddr().(*net.UDPAddr).AddrPort()
+}
+
+func (s *testPMPServer) mapping(proto byte) (port uint16, ok bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	port, ok = s.mappings[proto]
+	return
+}
+
+func (s *testPMPServer) serve() {
+	b := make([]byte, 1100)
+	for {
+		n, from, err := s.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		if resp := s.handle(b[:n]); resp != nil {
+			s.conn.WriteToUDP(resp, from)
+		}
+	}
+}
+
+func (s *testPMPServer) handle(req []byte) []byte {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if req[0] == pcpVersion && !s.pcp {
+		resp := make([]byte, 8)
+		resp[1], resp[3] = req[1]|0x80, 1 // Unsupported version
+		return resp
+	}
+
+	if req[0] == pcpVersion {
+		resp := make([]byte, 24)
+		resp[0], resp[1] = pcpVersion, req[1]|0x80
+		copy(resp[4:8], req[4:8])
+		if req[1] == pcpOpMap {
+			payload := append([]byte(nil), req[24:60]...)
+			proto, external := payload[12], binary.BigEndian.Uint16(payload[18:])
+			if binary.BigEndian.Uint32(req[4:]) == 0 {
+				delete(s.mappings, proto)
+			} else {
+				s.mappings[proto] = external
+			}
+			ip := netip.MustParseAddr("::ffff:203.0.113.7").As16()
+			copy(payload[20:], ip[:])
+			resp = append(resp, payload...)
+		}
+		return resp
+	}
+
+	switch req[1] {
+	case pmpOpExternalAddr:
+		resp := make([]byte, 12)
+		resp[1] = 0x80
+		copy(resp[8:], []byte{198, 51, 100, 9})
+		return resp
+	case pmpOpMapUDP, pmpOpMapTCP:
+		proto := byte(6)
+		if req[1] == pmpOpMapUDP {
+			proto = 17
+		}
+		resp := make([]byte, 16)
+		resp[1] = req[1] | 0x80
+		copy(resp[8:10], req[4:6])
+		external := binary.BigEndian.Uint16(req[6:]) + 1
+		if binary.BigEndian.Uint32(req[8:]) == 0 {
+			delete(s.mappings, proto)
+			external = 0
+		} else {
+			s.mappings[proto] = external
+		}
+		binary.BigEndian.PutUint16(resp[10:], external)
+		copy(resp[12:16], req[8:12])
+		return resp
+	}
+	return nil
+}
+
+func TestPMP(t *testing.T) {
+	for _, c := range []struct {
+		pcp      bool
+		external string
+		offset   uint16
+	}{{true, "203.0.113.7", 0}, {false, "198.51.100.9", 1}} {
+		server := newTestPMPServer(t, c.pcp)
+		defer server.conn.Close()
+		ctx := context.Background()
+
+		g, err := DiscoverPMP(ctx, server.addr())
+		if err != nil {
+			t.Fatal("Failed to discover gateway: ", err)
+		}
+		if g.(*pmpGateway).pcp != c.pcp {
+			t.Error("Incorrect protocol: ", g)
+		}
+		mapped, granted, err := g.AddMapping(ctx, TCP, 6881, 6881, time.Hour)
+		if err != nil || mapped != 6881+c.offset || granted != time.Hour {
+			t.Fatal("Failed to map port: ", g, mapped, granted, err)
+		}
+		if port, ok := server.mapping(6); !ok || port != mapped {
+			t.Error("Gateway has incorrect mapping: ", g, port, ok)
+		}
+		if ip, err := g.ExternalIP(ctx); err != nil || ip.String() != c.external {
+			t.Error("Incorrect external address: ", g, ip, err)
+		}
+		if err := g.DeleteMapping(ctx, TCP, 6881, mapped); err != nil {
+			t.Error("Failed to delete mapping: ", err)
+		}
+		if _, ok := server.mapping(6); ok {
+			t.Error("Mapping not deleted: ", g)
+		}
+	}
+}
+
+func TestPMPNoGateway(t *testing.T) {
+	defer func(d time.Duration) { pmpTimeout = d }(pmpTimeout)
+	pmpTimeout = time.Millisecond * 10
+
+	// Bound but never answered
+	conn, err := net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	defer conn.Close()
+	if g, err := DiscoverPMP(context.Background(), conn.LocalAddr().(*net.UDPAddr).AddrPort()); err == nil {
+		t.Error("Expected error, got gateway ", g)
+	}
+}
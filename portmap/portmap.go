@@ -0,0 +1,234 @@
+// Package portmap maps our listening port on the local network's gateway, so that peers
+// outside a home router can connect to us. Gateways are found and driven by UPnP IGD,
+// NAT-PMP (RFC 6886) or PCP (RFC 6887).
+package portmap
+
+import (
+	"context"
+	"github.com/op/go-logging"
+	"math/rand"
+	"net/netip"
+	"sync"
+	"time"
+)
+
+var logger = logging.MustGetLogger("libtorrent")
+
+// Protocol is the transport protocol of a mapping.
+type Protocol string
+
+const (
+	TCP Protocol = "TCP"
+	UDP Protocol = "UDP"
+)
+
+// Lifetime is how long mappings are requested for. They are refreshed halfway through
+// the lifetime the gateway grants.
+var Lifetime = time.Hour
+
+// retryInterval is how long to wait before trying again after a mapping fails.
+var retryInterval = time.Minute * 5
+
+// discoverTimeout bounds how long gateways are looked for.
+var discoverTimeout = time.Second * 3
+
+// Gateway is a router that can forward an external port to us.
+type Gateway interface {
+	// AddMapping forwards external on the gateway to internal on this host for lifetime,
+	// or as near as the gateway allows. It returns the external port actually mapped, which
+	// may differ from the one asked for, and the lifetime granted. A granted lifetime of
+	// zero means the mapping is permanent.
+	AddMapping(ctx context.Context, proto Protocol, internal, external uint16, lifetime time.Duration) (mapped uint16, granted time.Duration, err error)
+	// DeleteMapping removes a mapping made by AddMapping.
+	DeleteMapping(ctx context.Context, proto Protocol, internal, external uint16) error
+	// ExternalIP returns the gateway's address on the outside.
+	ExternalIP(ctx context.Context) (netip.Addr, error)
+	String() string
+}
+
+// Mapped is called each time a port is mapped, with our address and port as seen from
+// outside the gateway. The address is invalid if the gateway didn't report it, and both
+// are invalid if the mapping has lapsed.
+type Mapped func(proto Protocol, external netip.AddrPort)
+
+// Service maps a port for both TCP and UDP on each gateway given to it, refreshes the
+// mappings before they expire, and removes them when closed.
+type Service struct {
+	port    uint16
+	mapped  Mapped
+	ctx     context.Context
+	cancel  context.CancelFunc
+	wg      sync.WaitGroup
+	mutex   sync.Mutex
+	closed  bool
+	results map[Protocol]netip.AddrPort // Latest mapping of each protocol
+}
+
+// New creates a service mapping port, calling mapped for each mapping made.
+func New(port uint16, mapped Mapped) *Service {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &Service{
+		port:    port,
+		mapped:  mapped,
+		ctx:     ctx,
+		cancel:  cancel,
+		results: make(map[Protocol]netip.AddrPort),
+	}
+}
+
+// Discover looks for gateways by UPnP, and by NAT-PMP or PCP at the default gateway, in
+// the background, and maps the port on each one found.
+func (s *Service) Discover() {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+
+	s.wg.Add(2)
+	go func() {
+		defer s.wg.Done()
+		ctx, cancel := context.WithTimeout(s.ctx, discoverTimeout)
+		defer cancel()
+		gateways, err := DiscoverUPnP(ctx)
+		if err != nil {
+			logger.Info("No UPnP gateway found: %s", err)
+		}
+		for _, g := range gateways {
+			s.AddGateway(g)
+		}
+	}()
+	go func() {
+		defer s.wg.Done()
+		addr, err := defaultGateway()
+		if err != nil {
+			logger.Info("No NAT-PMP or PCP gateway: %s", err)
+			return
+		}
+		ctx, cancel := context.WithTimeout(s.ctx, discoverTimeout)
+		defer cancel()
+		g, err := DiscoverPMP(ctx, netip.AddrPortFrom(addr, PMPPort))
+		if err != nil {
+			logger.Info("No NAT-PMP or PCP gateway at %s: %s", addr, err)
+			return
+		}
+		s.AddGateway(g)
+	}()
+}
+
+// AddGateway maps the port on g, until the service is closed.
+func (s *Service) AddGateway(g Gateway) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	if s.closed {
+		return
+	}
+	logger.Info("Mapping port %d on %s", s.port, g)
+	for _, proto := range []Protocol{TCP, UDP} {
+		s.wg.Add(1)
+		go s.maintain(g, proto)
+	}
+}
+
+// External returns our address and port for proto as last mapped, which is invalid if
+// nothing has been mapped yet.
+func (s *Service) External(proto Protocol) netip.AddrPort {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.results[proto]
+}
+
+// Close stops refreshing the mappings and removes them from their gateways.
+func (s *Service) Close() error {
+	s.mutex.Lock()
+	s.closed = true
+	s.mutex.Unlock()
+	s.cancel()
+	s.wg.Wait()
+	return nil
+}
+
+// maintain keeps the port mapped for proto on g, and removes the mapping once the
+// service is closed.
+func (s *Service) maintain(g Gateway, proto Protocol) {
+	defer s.wg.Done()
+	external := s.port
+	mapped := false
+	var expires time.Time // When the mapping lapses if not refreshed, zero if never
+	for {
+		var wait time.Duration
+		port, granted, err := g.AddMapping(s.ctx, proto, s.port, external, Lifetime)
+		if err != nil {
+			if s.ctx.Err() != nil {
+				break
+			}
+			logger.Error("Failed to map %s port %d on %s: %s", proto, s.port, g, err)
+			if mapped && !expires.IsZero() && time.Now().After(expires) {
+				logger.Info("Lost %s mapping of port %d on %s", proto, external, g)
+				mapped = false
+				s.lost(proto)
+			}
+			if !mapped {
+				// The port may be taken on the gateway, so ask for another next time.
+				// A mapping we hold keeps its port, so that refreshing and removing it
+				// find it.
+				external = uint16(1024 + rand.Intn(65535-1024))
+			}
+			wait = retryInterval
+		} else {
+			external, mapped = port, true
+			s.found(g, proto, port)
+			wait = granted / 2
+			expires = time.Now().Add(granted)
+			if granted == 0 {
+				wait = Lifetime / 2
+				expires = time.Time{}
+			}
+		}
+
+		select {
+		case <-time.After(wait):
+		case <-s.ctx.Done():
+		}
+		if s.ctx.Err() != nil {
+			break
+		}
+	}
+
+	if mapped {
+		// The service's context is done, so give the gateway a little time of its own
+		ctx, cancel := context.WithTimeout(context.Background(), discoverTimeout)
+		defer cancel()
+		if err := g.DeleteMapping(ctx, proto, s.port, external); err != nil {
+			logger.Error("Failed to remove %s mapping of port %d from %s: %s", proto, external, g, err)
+		}
+	}
+}
+
+// lost forgets a mapping that lapsed without being refreshed, and passes on an invalid
+// address in its place.
+func (s *Service) lost(proto Protocol) {
+	s.mutex.Lock()
+	delete(s.results, proto)
+	s.mutex.Unlock()
+	if s.mapped != nil {
+		s.mapped(proto, netip.AddrPort{})
+	}
+}
+
+// found records a successful mapping and passes it on.
+func (s *Service) found(g Gateway, proto Protocol, port uint16) {
+	ip, err := g.ExternalIP(s.ctx)
+	if err != nil {
+		logger.Debug("Failed to get external address from %s: %s", g, err)
+	}
+	addr := netip.AddrPortFrom(ip, port)
+	logger.Info("Mapped %s port %d to %s on %s", proto, s.port, addr, g)
+
+	s.mutex.Lock()
+	s.results[proto] = addr
+	s.mutex.Unlock()
+	if s.mapped != nil {
+		s.mapped(proto, addr)
+	}
+}
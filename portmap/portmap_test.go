@@ -0,0 +1,202 @@
+package portmap
+
+import (
+	"context"
+	"errors"
+	"net/netip"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testGateway maps ports in memory, failing the first failures requests, and every
+// request while down.
+type testGateway struct {
+	failures int
+	down     bool
+	adds     []uint16 // External port of each mapping asked for
+	failed   []uint16 // External port of each mapping refused
+	mappings map[Protocol]uint16
+	mutex    sync.Mutex
+}
+
+func (g *testGateway) AddMapping(ctx context.Context, proto Protocol, internal, external uint16, lifetime time.Duration) (uint16, time.Duration, error) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.adds = append(g.adds, external)
+	if g.down {
+		g.failed = append(g.failed, external)
+		return 0, 0, errors.New("unreachable")
+	}
+	if g.failures > 0 {
+		g.failures--
+		g.failed = append(g.failed, external)
+		return 0, 0, errors.New("conflict")
+	}
+	g.mappings[proto] = external
+	return external, lifetime, nil
+}
+
+func (g *testGateway) DeleteMapping(ctx context.Context, proto Protocol, internal, external uint16) error {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if g.mappings[proto] != external {
+		return errors.New("no such mapping")
+	}
+	delete(g.mappings, proto)
+	return nil
+}
+
+func (g *testGateway) ExternalIP(ctx context.Context) (netip.Addr, error) {
+	return netip.MustParseAddr("203.0.113.7"), nil
+}
+
+func (g *testGateway) String() string {
+	return "test gateway"
+}
+
+func (g *testGateway) count() (adds, mappings int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	return len(g.adds), len(g.mappings)
+}
+
+func (g *testGateway) setDown(down bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	g.down = down
+}
+
+// refused counts the refused requests for port.
+func (g *testGateway) refused(port uint16) (n int) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	for _, p := range g.failed {
+		if p == port {
+			n++
+		}
+	}
+	return
+}
+
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second * 5); !cond(); time.Sleep(time.Millisecond) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for ", what)
+		}
+	}
+}
+
+func TestService(t *testing.T) {
+	defer func(d time.Duration) { Lifetime = d }(Lifetime)
+	Lifetime = time.Millisecond * 20
+
+	found := make(chan netip.AddrPort, 100)
+	s := New(6881, func(proto Protocol, external netip.AddrPort) {
+		if proto == TCP {
+			found <- external
+		}
+	})
+	g := &testGateway{mappings: make(map[Protocol]uint16)}
+	s.AddGateway(g)
+
+	select {
+	case addr := <-found:
+		if addr.String() != "203.0.113.7:6881" || s.External(TCP) != addr {
+			t.Error("Incorrect mapping: ", addr, s.External(TCP))
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for mapping")
+	}
+
+	// Mappings are refreshed before they expire, and removed when closed
+	waitFor(t, "refresh", func() bool {
+		adds, _ := g.count()
+		return adds >= 6
+	})
+	s.Close()
+	if _, mappings := g.count(); mappings != 0 {
+		t.Error("Mappings not removed: ", g.mappings)
+	}
+}
+
+func TestServiceRetry(t *testing.T) {
+	defer func(d time.Duration) { retryInterval = d }(retryInterval)
+	retryInterval = time.Millisecond
+
+	s := New(6881, nil)
+	defer s.Close()
+	g := &testGateway{failures: 1, mappings: make(map[Protocol]uint16)}
+	s.AddGateway(g)
+
+	// Another port is asked for after a failure
+	waitFor(t, "mappings", func() bool {
+		_, mappings := g.count()
+		return mappings == 2
+	})
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	if len(g.adds) != 3 || g.mappings[TCP] == g.mappings[UDP] {
+		t.Error("Incorrect mappings: ", g.adds, g.mappings)
+	}
+}
+
+func TestServiceRefreshFailure(t *testing.T) {
+	defer func(d, r time.Duration) { Lifetime, retryInterval = d, r }(Lifetime, retryInterval)
+	Lifetime, retryInterval = time.Millisecond*400, time.Millisecond
+
+	s := New(6881, nil)
+	g := &testGateway{mappings: make(map[Protocol]uint16)}
+	s.AddGateway(g)
+	waitFor(t, "mappings", func() bool {
+		_, mappings := g.count()
+		return mappings == 2
+	})
+
+	// Failed refreshes keep asking for the granted port, which is removed when closed
+	g.setDown(true)
+	waitFor(t, "refreshes", func() bool { return g.refused(6881) >= 6 })
+	g.setDown(false)
+	s.Close()
+	if _, mappings := g.count(); mappings != 0 {
+		t.Error("Mappings not removed: ", g.mappings, g.failed)
+	}
+	if s.External(TCP).Port() != 6881 {
+		t.Error("Mapping lost before it lapsed: ", s.External(TCP))
+	}
+}
+
+func TestServiceLapse(t *testing.T) {
+	defer func(d, r time.Duration) { Lifetime, retryInterval = d, r }(Lifetime, retryInterval)
+	Lifetime, retryInterval = time.Millisecond*20, time.Millisecond
+
+	found := make(chan netip.AddrPort, 1000)
+	s := New(6881, func(proto Protocol, external netip.AddrPort) {
+		if proto == TCP {
+			found <- external
+		}
+	})
+	defer s.Close()
+	g := &testGateway{mappings: make(map[Protocol]uint16)}
+	s.AddGateway(g)
+	if addr := <-found; addr.Port() != 6881 {
+		t.Fatal("Incorrect mapping: ", addr)
+	}
+
+	// Once the mapping lapses it is reported lost
+	g.setDown(true)
+	for timeout := time.After(time.Second * 5); ; {
+		select {
+		case addr := <-found:
+			if addr.IsValid() {
+				continue // Refreshed before the gateway went down
+			}
+			if s.External(TCP).IsValid() {
+				t.Error("Lost mapping still recorded: ", s.External(TCP))
+			}
+			return
+		case <-timeout:
+			t.Fatal("Timed out waiting for lost mapping")
+		}
+	}
+}
@@ -0,0 +1,295 @@
+package portmap
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ssdpAddr is where SSDP searches for gateways are sent.
+var ssdpAddr = &net.UDPAddr{IP: net.IPv4(239, 255, 255, 250), Port: 1900}
+
+// Description is the description given to UPnP mappings, which routers show to users.
+var Description = "libtorrent"
+
+// The device searched for, and the services that can map ports, best first.
+const igdDevice = "urn:schemas-upnp-org:device:InternetGatewayDevice:1"
+
+var wanServices = []string{
+	"urn:schemas-upnp-org:service:WANIPConnection:2",
+	"urn:schemas-upnp-org:service:WANIPConnection:1",
+	"urn:schemas-upnp-org:service:WANPPPConnection:1",
+}
+
+// upnpOnlyPermanentLeases is the UPnP error code of routers that don't support leases.
+const upnpOnlyPermanentLeases = 725
+
+// upnpGateway is an internet gateway device controlled by UPnP.
+type upnpGateway struct {
+	control string     // URL that the service's actions are posted to
+	service string     // Service type
+	local   netip.Addr // Our address, as seen by the gateway
+}
+
+// DiscoverUPnP searches for internet gateway devices by SSDP until ctx is done, and
+// returns those that can map ports.
+func DiscoverUPnP(ctx context.Context) (gateways []Gateway, err error) {
+	conn, err := net.ListenUDP("udp4", nil)
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
+
+	search := fmt.Sprintf("M-SEARCH * HTTP/1.1\r\nHOST: %s\r\nST: %s\r\nMAN: \"ssdp:discover\"\r\nMX: 2\r\n\r\n", ssdpAddr, igdDevice)
+	if _, err = conn.WriteTo([]byte(search), ssdpAddr); err != nil {
+		return
+	}
+
+	seen := make(map[string]bool)
+	b := make([]byte, 2048)
+	for {
+		n, _, e := conn.ReadFrom(b)
+		if e != nil {
+			break
+		}
+		resp, e := http.ReadResponse(bufio.NewReader(bytes.NewReader(b[:n])), nil)
+		if e != nil {
+			logger.Debug("Ignoring SSDP response: %s", e)
+			continue
+		}
+		location := resp.Header.Get("Location")
+		if location == "" || seen[location] {
+			continue
+		}
+		seen[location] = true
+		g, e := newUPnPGateway(ctx, location)
+		if e != nil {
+			logger.Debug("Ignoring UPnP device at %s: %s", location, e)
+			continue
+		}
+		gateways = append(gateways, g)
+	}
+	if len(gateways) == 0 {
+		err = errors.New("no internet gateway device responded")
+	}
+	return
+}
+
+// upnpDevice is a device in a UPnP device description.
+type upnpDevice struct {
+	Devices  []upnpDevice `xml:"deviceList>device"`
+	Services []struct {
+		ServiceType string `xml:"serviceType"`
+		ControlURL  string `xml:"controlURL"`
+	} `xml:"serviceList>service"`
+}
+
+// newUPnPGateway reads the device description at location and finds its WAN connection
+// service.
+func newUPnPGateway(ctx context.Context, location string) (g *upnpGateway, err error) {
+	base, err := url.Parse(location)
+	if err != nil {
+		return
+	}
+	req, err := http.NewRequestWithContext(ctx, "GET", location, nil)
+	if err != nil {
+		return
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("device description: %s", resp.Status))
+	}
+	var desc struct {
+		URLBase string     `xml:"URLBase"`
+		Device  upnpDevice `xml:"device"`
+	}
+	if err = xml.NewDecoder(resp.Body).Decode(&desc); err != nil {
+		return
+	}
+	if desc.URLBase != "" {
+		if base, err = url.Parse(desc.URLBase); err != nil {
+			return
+		}
+	}
+
+	for _, service := range wanServices {
+		if control, ok := findService(desc.Device, service); ok {
+			u, e := base.Parse(control)
+			if e != nil {
+				return nil, e
+			}
+			local, e := localAddr(u.Hostname())
+			if e != nil {
+				return nil, e
+			}
+			return &upnpGateway{control: u.String(), service: service, local: local}, nil
+		}
+	}
+	return nil, errors.New("no WAN connection service")
+}
+
+// findService looks for the control URL of a service through the device's tree.
+func findService(device upnpDevice, serviceType string) (control string, ok bool) {
+	for _, s := range device.Services {
+		if strings.TrimSpace(s.ServiceType) == serviceType {
+			return strings.TrimSpace(s.ControlURL), true
+		}
+	}
+	for _, d := range device.Devices {
+		if control, ok = findService(d, serviceType); ok {
+			return
+		}
+	}
+	return
+}
+
+// localAddr returns the address we reach host from.
+func localAddr(host string) (addr netip.Addr, err error) {
+	conn, err := net.Dial("udp", net.JoinHostPort(host, "1900"))
+	if err != nil {
+		return
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).AddrPort().Addr().Unmap(), nil
+}
+
+func (g *upnpGateway) String() string {
+	return fmt.Sprintf("UPnP gateway %s", g.control)
+}
+
+func (g *upnpGateway) AddMapping(ctx context.Context, proto Protocol, internal, external uint16, lifetime time.Duration) (mapped uint16, granted time.Duration, err error) {
+	add := func(lease time.Duration) error {
+		_, err := g.action(ctx, "AddPortMapping", [][2]string{
+			{"NewRemoteHost", ""},
+			{"NewExternalPort", strconv.Itoa(int(external))},
+			{"NewProtocol", string(proto)},
+			{"NewInternalPort", strconv.Itoa(int(internal))},
+			{"NewInternalClient", g.local.String()},
+			{"NewEnabled", "1"},
+			{"NewPortMappingDescription", Description},
+			{"NewLeaseDuration", strconv.Itoa(int(lease / time.Second))},
+		})
+		return err
+	}
+	err = add(lifetime)
+	var upnpErr *upnpError
+	if errors.As(err, &upnpErr) && upnpErr.code == upnpOnlyPermanentLeases {
+		lifetime = 0
+		err = add(0)
+	}
+	if err != nil {
+		return
+	}
+	return external, lifetime, nil
+}
+
+func (g *upnpGateway) DeleteMapping(ctx context.Context, proto Protocol, internal, external uint16) (err error) {
+	_, err = g.action(ctx, "DeletePortMapping", [][2]string{
+		{"NewRemoteHost", ""},
+		{"NewExternalPort", strconv.Itoa(int(external))},
+		{"NewProtocol", string(proto)},
+	})
+	return
+}
+
+func (g *upnpGateway) ExternalIP(ctx context.Context) (ip netip.Addr, err error) {
+	values, err := g.action(ctx, "GetExternalIPAddress", nil)
+	if err != nil {
+		return
+	}
+	return netip.ParseAddr(values["NewExternalIPAddress"])
+}
+
+// upnpError is a fault returned by a UPnP action.
+type upnpError struct {
+	code        int
+	description string
+}
+
+func (e *upnpError) Error() string {
+	return fmt.Sprintf("UPnP error %d: %s", e.code, e.description)
+}
+
+// action calls a SOAP action of the gateway's service with the given arguments, in
+// order, and returns the text of each element in the response by name.
+func (g *upnpGateway) action(ctx context.Context, name string, args [][2]string) (values map[string]string, err error) {
+	var body bytes.Buffer
+	body.WriteString(`<?xml version="1.0"?>` +
+		`<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/" s:encodingStyle="http://schemas.xmlsoap.org/soap/encoding/">` +
+		`<s:Body>`)
+	fmt.Fprintf(&body, `<u:%s xmlns:u="%s">`, name, g.service)
+	for _, arg := range args {
+		fmt.Fprintf(&body, "<%s>", arg[0])
+		xml.EscapeText(&body, []byte(arg[1]))
+		fmt.Fprintf(&body, "</%s>", arg[0])
+	}
+	fmt.Fprintf(&body, `</u:%s></s:Body></s:Envelope>`, name)
+
+	req, err := http.NewRequestWithContext(ctx, "POST", g.control, &body)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Content-Type", `text/xml; charset="utf-8"`)
+	req.Header.Set("SOAPAction", fmt.Sprintf(`"%s#%s"`, g.service, name))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	if values, err = xmlValues(resp.Body); err != nil {
+		return
+	}
+	if resp.StatusCode != http.StatusOK {
+		if code, e := strconv.Atoi(values["errorCode"]); e == nil {
+			return nil, &upnpError{code: code, description: values["errorDescription"]}
+		}
+		return nil, errors.New(fmt.Sprintf("%s: %s", name, resp.Status))
+	}
+	return
+}
+
+// xmlValues returns the text of each element without children in an XML document, by
+// local name.
+func xmlValues(r io.Reader) (values map[string]string, err error) {
+	values = make(map[string]string)
+	d := xml.NewDecoder(r)
+	var name string
+	var text []byte
+	for {
+		tok, e := d.Token()
+		if e == io.EOF {
+			return
+		}
+		if e != nil {
+			return nil, e
+		}
+		switch tok := tok.(type) {
+		case xml.StartElement:
+			name, text = tok.Name.Local, nil
+		case xml.CharData:
+			text = append(text, tok...)
+		case xml.EndElement:
+			if tok.Name.Local == name {
+				values[name] = strings.TrimSpace(string(text))
+			}
+			name = ""
+		}
+	}
+}
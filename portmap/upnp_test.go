@@ -0,0 +1,186 @@
+package portmap
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const testDescription = `<?xml version="1.0"?>
+<root xmlns="urn:schemas-upnp-org:device-1-0">
+  <device>
+    <deviceType>urn:schemas-upnp-org:device:InternetGatewayDevice:1</deviceType>
+    <deviceList>
+      <device>
+        <deviceType>urn:schemas-upnp-org:device:WANDevice:1</deviceType>
+        <deviceList>
+          <device>
+            <deviceType>urn:schemas-upnp-org:device:WANConnectionDevice:1</deviceType>
+            <serviceList>
+              <service>
+                <serviceType>urn:schemas-upnp-org:service:WANIPConnection:1</serviceType>
+                <controlURL>/ctl/IPConn</controlURL>
+              </service>
+            </serviceList>
+          </device>
+        </deviceList>
+      </device>
+    </deviceList>
+  </device>
+</root>`
+
+// testIGD is an internet gateway device answering SSDP searches and SOAP actions.
+type testIGD struct {
+	ssdp          *net.UDPConn
+	http          *httptest.Server
+	permanentOnly bool              // Refuse leases, like some routers
+	mappings      map[string]string // Internal client and port by protocol and external port
+	leases        []string
+	mutex         sync.Mutex
+}
+
+func newTestIGD(t *testing.T) *testIGD {
+	igd := &testIGD{mappings: make(map[string]string)}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/desc.xml", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, testDescription)
+	})
+	mux.HandleFunc("/ctl/IPConn", igd.control)
+	igd.http = httptest.NewServer(mux)
+
+	var err error
+	if igd.ssdp, err = net.ListenUDP("udp4", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)}); err != nil {
+		t.Fatal("Failed to listen: ", err)
+	}
+	go func() {
+		b := make([]byte, 2048)
+		for {
+			n, from, err := igd.ssdp.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			if !strings.Contains(string(b[:n]), "ST: "+igdDevice) {
+				continue
+			}
+			resp := fmt.Sprintf("HTTP/1.1 200 OK\r\nST: %s\r\nLOCATION: %s/desc.xml\r\n\r\n", igdDevice, igd.http.URL)
+			// Devices often answer more than once
+			igd.ssdp.WriteToUDP([]byte(resp), from)
+			igd.ssdp.WriteToUDP([]byte(resp), from)
+		}
+	}()
+	return igd
+}
+
+func (igd *testIGD) Close() {
+	igd.ssdp.Close()
+	igd.http.Close()
+}
+
+func (igd *testIGD) mapping(key string) (client string, ok bool) {
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+	client, ok = igd.mappings[key]
+	return
+}
+
+func (igd *testIGD) control(w http.ResponseWriter, r *http.Request) {
+	args, err := xmlValues(r.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	action := strings.Trim(r.Header.Get("SOAPAction"), `"`)
+	action = action[strings.Index(action, "#")+1:]
+	key := args["NewProtocol"] + " " + args["NewExternalPort"]
+
+	igd.mutex.Lock()
+	defer igd.mutex.Unlock()
+	switch action {
+	case "AddPortMapping":
+		if igd.permanentOnly && args["NewLeaseDuration"] != "0" {
+			w.WriteHeader(http.StatusInternalServerError)
+			fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><s:Fault>`+
+				`<detail><UPnPError xmlns="urn:schemas-upnp-org:control-1-0"><errorCode>725</errorCode>`+
+				`<errorDescription>OnlyPermanentLeasesSupported</errorDescription></UPnPError></detail>`+
+				`</s:Fault></s:Body></s:Envelope>`)
+			return
+		}
+		igd.mappings[key] = args["NewInternalClient"] + ":" + args["NewInternalPort"]
+		igd.leases = append(igd.leases, args["NewLeaseDuration"])
+	case "DeletePortMapping":
+		delete(igd.mappings, key)
+	case "GetExternalIPAddress":
+		fmt.Fprint(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body>`+
+			`<u:GetExternalIPAddressResponse xmlns:u="urn:schemas-upnp-org:service:WANIPConnection:1">`+
+			`<NewExternalIPAddress>203.0.113.7</NewExternalIPAddress>`+
+			`</u:GetExternalIPAddressResponse></s:Body></s:Envelope>`)
+		return
+	default:
+		http.Error(w, "unknown action", http.StatusInternalServerError)
+		return
+	}
+	fmt.Fprintf(w, `<s:Envelope xmlns:s="http://schemas.xmlsoap.org/soap/envelope/"><s:Body><u:%sResponse/></s:Body></s:Envelope>`, action)
+}
+
+func discoverTestIGD(t *testing.T, igd *testIGD) Gateway {
+	defer func(addr *net.UDPAddr) { ssdpAddr = addr }(ssdpAddr)
+	ssdpAddr = igd.ssdp.LocalAddr().(*net.UDPAddr)
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*200)
+	defer cancel()
+	gateways, err := DiscoverUPnP(ctx)
+	if err != nil || len(gateways) != 1 {
+		t.Fatal("Failed to discover gateway: ", gateways, err)
+	}
+	g := gateways[0].(*upnpGateway)
+	if g.control != igd.http.URL+"/ctl/IPConn" || g.service != wanServices[1] {
+		t.Error("Incorrect service: ", g.control, g.service)
+	}
+	return g
+}
+
+func TestUPnP(t *testing.T) {
+	igd := newTestIGD(t)
+	defer igd.Close()
+	g := discoverTestIGD(t, igd)
+	ctx := context.Background()
+
+	mapped, granted, err := g.AddMapping(ctx, UDP, 6881, 6881, time.Hour)
+	if err != nil || mapped != 6881 || granted != time.Hour {
+		t.Fatal("Failed to map port: ", mapped, granted, err)
+	}
+	if client, ok := igd.mapping("UDP 6881"); !ok || client != "127.0.0.1:6881" {
+		t.Error("Gateway has incorrect mapping: ", client, ok)
+	}
+	if ip, err := g.ExternalIP(ctx); err != nil || ip.String() != "203.0.113.7" {
+		t.Error("Incorrect external address: ", ip, err)
+	}
+	if err := g.DeleteMapping(ctx, UDP, 6881, 6881); err != nil {
+		t.Error("Failed to delete mapping: ", err)
+	}
+	if _, ok := igd.mapping("UDP 6881"); ok {
+		t.Error("Mapping not deleted")
+	}
+}
+
+func TestUPnPPermanentLeases(t *testing.T) {
+	igd := newTestIGD(t)
+	defer igd.Close()
+	igd.permanentOnly = true
+	g := discoverTestIGD(t, igd)
+
+	mapped, granted, err := g.AddMapping(context.Background(), TCP, 6881, 7000, time.Hour)
+	if err != nil || mapped != 7000 || granted != 0 {
+		t.Fatal("Failed to map port: ", mapped, granted, err)
+	}
+	if len(igd.leases) != 1 || igd.leases[0] != strconv.Itoa(0) {
+		t.Error("Expected a single permanent lease, got ", igd.leases)
+	}
+}
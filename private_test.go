@@ -0,0 +1,48 @@
+package libtorrent
+
+import (
+	"context"
+	"net/netip"
+	"testing"
+)
+
+func TestPrivateTorrent(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	m := testMetainfo()
+	m.Private = true
+	tor, err := NewTorrent(m, &Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer tor.Stop()
+	tor.Start()
+
+	for _, source := range []PeerSource{SourceDHT, SourcePEX, SourceLSD} {
+		if tor.sourceAllowed(source) {
+			t.Errorf("Private torrent allowed %s peers", source)
+		}
+	}
+	for _, source := range []PeerSource{SourceTracker, SourceIncoming, SourceUnknown} {
+		if !tor.sourceAllowed(source) {
+			t.Errorf("Private torrent refused %s peers", source)
+		}
+	}
+
+	// Addresses from other sources never reach the pool
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tor.addCandidate(ctx, netip.MustParseAddrPort("192.168.1.2:6881"), SourceLSD)
+	tor.addCandidate(ctx, netip.MustParseAddrPort("192.168.1.3:6881"), SourceTracker)
+	if tor.pool.Len() != 1 {
+		t.Error("Incorrect pool length: ", tor.pool.Len())
+	}
+
+	// The peer id and key stay the same across restarts
+	peerId, key := tor.PeerId(), tor.Key()
+	tor.Stop()
+	tor.Start()
+	if string(tor.PeerId()) != string(peerId) || tor.Key() != key {
+		t.Error("Peer id or key changed on restart")
+	}
+}
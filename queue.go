@@ -0,0 +1,219 @@
+package libtorrent
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"time"
+)
+
+// queueCheckInterval is how often a Session reconsiders which torrents should be active,
+// besides whenever a torrent changes state.
+var queueCheckInterval = time.Second * 5
+
+// slowGrace is how long a torrent is given after starting before it may be considered
+// slow.
+var slowGrace = time.Minute
+
+// AutoManaged returns true if the torrent's Session starts and queues it.
+func (t *Torrent) AutoManaged() bool {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.autoManaged
+}
+
+// SetAutoManaged sets whether the torrent's Session starts and queues it, subject to the
+// active limits. Torrents added to a Session are auto-managed. A torrent that isn't is
+// left alone, and doesn't count towards the limits.
+func (t *Torrent) SetAutoManaged(auto bool) {
+	t.stateLock.Lock()
+	t.autoManaged = auto
+	t.stateLock.Unlock()
+}
+
+// enqueue halts the torrent, if it is running, leaving it queued to be started again by
+// its Session.
+func (tor *Torrent) enqueue() {
+	tor.lifecycleLock.Lock()
+	defer tor.lifecycleLock.Unlock()
+
+	switch tor.State() {
+	case Leeching, Seeding:
+		tor.halt()
+		tor.setState(Queued)
+	case Stopped:
+		tor.setState(Queued)
+	}
+}
+
+// slow returns true if the torrent has been running for a while but is transferring
+// less than Config.SlowTorrentRate: downloading whilst leeching, uploading whilst
+// seeding.
+func (t *Torrent) slow() bool {
+	if t.config.SlowTorrentRate <= 0 {
+		return false
+	}
+	t.stateLock.Lock()
+	state, since := t.state, t.activeSince
+	t.stateLock.Unlock()
+	if time.Since(since) < slowGrace {
+		return false
+	}
+	switch state {
+	case Leeching:
+		return t.stats.downloaded.Rate() < t.config.SlowTorrentRate
+	case Seeding:
+		return t.stats.uploaded.Rate() < t.config.SlowTorrentRate
+	}
+	return false
+}
+
+// withinLimit returns true if another torrent may be active, given count already are.
+// A limit of zero means unlimited.
+func withinLimit(count int, limit int) bool {
+	return limit <= 0 || count < limit
+}
+
+// manage starts and queues auto-managed torrents so that no more are active than the
+// limits allow, giving slots to torrents in queue order. Slow torrents are left running
+// but don't count as active, so they don't hold up the rest of the queue.
+func (s *Session) manage() {
+	s.manageLock.Lock()
+	defer s.manageLock.Unlock()
+
+	s.mutex.RLock()
+	queue := append([]*Torrent(nil), s.queue...)
+	s.mutex.RUnlock()
+
+	var downloads, seeds int
+	for _, tor := range queue {
+		state := tor.State()
+		if !tor.AutoManaged() || (state != Queued && state != Leeching && state != Seeding) {
+			continue
+		}
+		if state != Queued && tor.slow() {
+			continue
+		}
+
+		ok := withinLimit(downloads+seeds, s.config.MaxActive)
+		if tor.complete() {
+			ok = ok && withinLimit(seeds, s.config.MaxActiveSeeds)
+		} else {
+			ok = ok && withinLimit(downloads, s.config.MaxActiveDownloads)
+		}
+
+		switch {
+		case ok && state == Queued:
+			logger.Debug("Starting queued torrent %s", tor.meta.Name)
+			if err := tor.Start(); err != nil {
+				logger.Error("Failed to start queued torrent %s: %s", tor.meta.Name, err)
+				continue
+			}
+		case !ok && state != Queued:
+			logger.Debug("Queueing torrent %s", tor.meta.Name)
+			tor.enqueue()
+			continue
+		case !ok:
+			continue
+		}
+		if tor.complete() {
+			seeds++
+		} else {
+			downloads++
+		}
+	}
+}
+
+// requeue asks the session to reconsider which torrents should be active.
+func (s *Session) requeue() {
+	select {
+	case s.requeued <- struct{}{}:
+	default:
+	}
+}
+
+// queueLoop manages the queue whenever a torrent changes state, and regularly to notice
+// torrents becoming slow, until the session is closed.
+func (s *Session) queueLoop() {
+	defer close(s.queueDone)
+	sub := s.events.subscribe(StatusEvents)
+	defer sub.Close()
+	for {
+		select {
+		case ev := <-sub.C:
+			if ev.Type != StateChangedEvent && ev.Type != TorrentFinishedEvent {
+				continue
+			}
+		case <-s.requeued:
+		case <-time.After(queueCheckInterval):
+		case <-s.closing:
+			return
+		}
+		s.manage()
+	}
+}
+
+// QueuePosition returns the torrent's position in the queue, starting from 0.
+func (s *Session) QueuePosition(infoHash []byte) (pos int, err error) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	if pos = s.queueIndex(infoHash); pos < 0 {
+		err = errors.New(fmt.Sprintf("QueuePosition: no torrent %x in session", infoHash))
+	}
+	return
+}
+
+// QueueUp moves the torrent one place towards the front of the queue.
+func (s *Session) QueueUp(infoHash []byte) error {
+	return s.moveInQueue(infoHash, func(pos int, n int) int { return pos - 1 })
+}
+
+// QueueDown moves the torrent one place towards the back of the queue.
+func (s *Session) QueueDown(infoHash []byte) error {
+	return s.moveInQueue(infoHash, func(pos int, n int) int { return pos + 1 })
+}
+
+// QueueTop moves the torrent to the front of the queue.
+func (s *Session) QueueTop(infoHash []byte) error {
+	return s.moveInQueue(infoHash, func(pos int, n int) int { return 0 })
+}
+
+// QueueBottom moves the torrent to the back of the queue.
+func (s *Session) QueueBottom(infoHash []byte) error {
+	return s.moveInQueue(infoHash, func(pos int, n int) int { return n - 1 })
+}
+
+// moveInQueue moves the torrent to the position returned by to, given its current
+// position and the length of the queue, then reconsiders which torrents are active.
+func (s *Session) moveInQueue(infoHash []byte, to func(pos int, n int) int) error {
+	s.mutex.Lock()
+	pos := s.queueIndex(infoHash)
+	if pos < 0 {
+		s.mutex.Unlock()
+		return errors.New(fmt.Sprintf("moveInQueue: no torrent %x in session", infoHash))
+	}
+	newPos := to(pos, len(s.queue))
+	if newPos < 0 {
+		newPos = 0
+	} else if newPos >= len(s.queue) {
+		newPos = len(s.queue) - 1
+	}
+	tor := s.queue[pos]
+	s.queue = append(s.queue[:pos], s.queue[pos+1:]...)
+	s.queue = append(s.queue[:newPos], append([]*Torrent{tor}, s.queue[newPos:]...)...)
+	s.mutex.Unlock()
+
+	s.requeue()
+	return nil
+}
+
+// queueIndex returns the position of the torrent in the queue, or -1. The caller must hold
+// mutex.
+func (s *Session) queueIndex(infoHash []byte) int {
+	for i, tor := range s.queue {
+		if bytes.Equal(tor.meta.InfoHash, infoHash) {
+			return i
+		}
+	}
+	return -1
+}
@@ -0,0 +1,118 @@
+package libtorrent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// addTestTorrents adds n torrents, sharing the test data but with different infohashes.
+func addTestTorrents(t *testing.T, s *Session, n int) (tors []*Torrent) {
+	for i := 0; i < n; i++ {
+		m := testMetainfo()
+		m.InfoHash[0] = byte(i)
+		tor, err := s.AddTorrent(m)
+		if err != nil {
+			t.Fatal("Failed to add torrent: ", err)
+		}
+		tors = append(tors, tor)
+	}
+	return
+}
+
+func expectStates(t *testing.T, tors []*Torrent, states ...int) {
+	waitFor(t, "torrent states", func() bool {
+		for i, tor := range tors {
+			if tor.State() != states[i] {
+				return false
+			}
+		}
+		return true
+	})
+}
+
+func TestQueue(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := NewSession(&Config{RootDirectory: tmpDir, MaxActiveDownloads: 1})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+
+	tors := addTestTorrents(t, s, 3)
+	expectStates(t, tors, Leeching, Queued, Queued)
+	for i, tor := range tors {
+		if pos, err := s.QueuePosition(tor.InfoHash()); err != nil || pos != i {
+			t.Errorf("Torrent %d at position %d: %v", i, pos, err)
+		}
+	}
+
+	// Moving a torrent to the front gives it the slot
+	if err := s.QueueTop(tors[2].InfoHash()); err != nil {
+		t.Fatal("Failed to move torrent: ", err)
+	}
+	expectStates(t, tors, Queued, Queued, Leeching)
+	if got := s.Torrents(); got[0] != tors[2] || got[1] != tors[0] || got[2] != tors[1] {
+		t.Error("Incorrect queue order: ", got)
+	}
+
+	s.QueueDown(tors[2].InfoHash())
+	expectStates(t, tors, Leeching, Queued, Queued)
+	s.QueueBottom(tors[0].InfoHash())
+	s.QueueUp(tors[1].InfoHash())
+	if got := s.Torrents(); got[0] != tors[1] || got[1] != tors[2] || got[2] != tors[0] {
+		t.Error("Incorrect queue order: ", got)
+	}
+	expectStates(t, tors, Queued, Leeching, Queued)
+
+	// Removing the active torrent frees its slot, and torrents that aren't auto-managed
+	// are left alone
+	tors[2].SetAutoManaged(false)
+	if err := s.RemoveTorrent(tors[1].InfoHash(), false); err != nil {
+		t.Fatal("Failed to remove torrent: ", err)
+	}
+	expectStates(t, tors, Leeching, Stopped, Queued)
+	if _, err := s.QueuePosition(tors[1].InfoHash()); err == nil {
+		t.Error("Removed torrent still in queue")
+	}
+
+	// Pausing a queued torrent takes it out of the queue
+	if err := tors[2].Pause(); err != nil || tors[2].State() != Paused {
+		t.Error("Failed to pause queued torrent: ", err)
+	}
+}
+
+func TestQueueSeeds(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "test.txt"), testData(t), 0644); err != nil {
+		t.Fatal("Failed to write test data: ", err)
+	}
+	s, err := NewSession(&Config{RootDirectory: tmpDir, MaxActiveSeeds: 1, MaxActive: 2})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+
+	tors := addTestTorrents(t, s, 2)
+	expectStates(t, tors, Seeding, Queued)
+}
+
+func TestQueueSlowTorrents(t *testing.T) {
+	defer func(d time.Duration) { slowGrace = d }(slowGrace)
+	slowGrace = 0
+
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := NewSession(&Config{RootDirectory: tmpDir, MaxActiveDownloads: 1, SlowTorrentRate: 1})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+
+	// Neither torrent downloads anything, so the first doesn't hold up the second
+	tors := addTestTorrents(t, s, 2)
+	expectStates(t, tors, Leeching, Leeching)
+}
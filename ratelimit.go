@@ -0,0 +1,114 @@
+package libtorrent
+
+import (
+	"sync"
+	"time"
+)
+
+// rateLimiter is a simple token bucket. Tokens (bytes) accumulate at rate per
+// second up to a maximum of one second's worth. A nil rateLimiter, or one with a
+// rate of 0, never blocks.
+type rateLimiter struct {
+	rate   int64
+	tokens int64
+	last   time.Time
+	mutex  sync.Mutex
+}
+
+func newRateLimiter(rate int64) *rateLimiter {
+	return &rateLimiter{
+		rate:   rate,
+		tokens: rate,
+		last:   time.Now(),
+	}
+}
+
+// Wait blocks until n bytes may be transferred.
+func (rl *rateLimiter) Wait(n int) {
+	if rl == nil {
+		return
+	}
+
+	for {
+		rl.mutex.Lock()
+		if rl.rate <= 0 {
+			rl.mutex.Unlock()
+			return
+		}
+
+		// Refill bucket
+		now := time.Now()
+		rl.tokens += int64(now.Sub(rl.last)) * rl.rate / int64(time.Second)
+		if rl.tokens > rl.rate {
+			rl.tokens = rl.rate
+		}
+		rl.last = now
+
+		// Requests larger than the bucket are allowed to go into debt, otherwise
+		// they would never be satisfied.
+		if rl.tokens >= int64(n) || rl.tokens == rl.rate {
+			rl.tokens -= int64(n)
+			rl.mutex.Unlock()
+			return
+		}
+
+		wait := time.Duration((int64(n) - rl.tokens) * int64(time.Second) / rl.rate)
+		rl.mutex.Unlock()
+		time.Sleep(wait)
+	}
+}
+
+// SetRate changes the limit. A rate of 0 removes the limit.
+func (rl *rateLimiter) SetRate(rate int64) {
+	rl.mutex.Lock()
+	rl.rate = rate
+	if rl.tokens > rate {
+		rl.tokens = rate
+	}
+	rl.mutex.Unlock()
+}
+
+// connLimiter caps the number of concurrently open peer connections.
+// A max of 0 means unlimited.
+type connLimiter struct {
+	max   int
+	count int
+	mutex sync.Mutex
+}
+
+func newConnLimiter(max int) *connLimiter {
+	return &connLimiter{max: max}
+}
+
+// Acquire reserves a connection slot, returning false if none are free.
+func (cl *connLimiter) Acquire() bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	if cl.max > 0 && cl.count >= cl.max {
+		return false
+	}
+	cl.count++
+	return true
+}
+
+func (cl *connLimiter) Release() {
+	cl.mutex.Lock()
+	if cl.count > 0 {
+		cl.count--
+	}
+	cl.mutex.Unlock()
+}
+
+// Full returns true if every connection slot is taken.
+func (cl *connLimiter) Full() bool {
+	cl.mutex.Lock()
+	defer cl.mutex.Unlock()
+	return cl.max > 0 && cl.count >= cl.max
+}
+
+func (cl *connLimiter) Count() (n int) {
+	cl.mutex.Lock()
+	n = cl.count
+	cl.mutex.Unlock()
+	return
+}
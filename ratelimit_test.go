@@ -0,0 +1,43 @@
+package libtorrent
+
+import (
+	"testing"
+	"time"
+)
+
+func TestRateLimiter(t *testing.T) {
+	var nilLimiter *rateLimiter
+	nilLimiter.Wait(1 << 20) // Must not block or panic
+
+	rl := newRateLimiter(1000)
+	start := time.Now()
+	rl.Wait(1000) // Drains the initial bucket
+	rl.Wait(500)
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Error("Rate limiter did not block, elapsed: ", elapsed)
+	}
+
+	rl.SetRate(0)
+	start = time.Now()
+	rl.Wait(1 << 20)
+	if elapsed := time.Since(start); elapsed > 100*time.Millisecond {
+		t.Error("Unlimited rate limiter blocked, elapsed: ", elapsed)
+	}
+}
+
+func TestConnLimiter(t *testing.T) {
+	cl := newConnLimiter(2)
+	if !cl.Acquire() || !cl.Acquire() {
+		t.Fatal("Failed to acquire free connection slots")
+	}
+	if cl.Acquire() {
+		t.Error("Acquired more connection slots than the maximum")
+	}
+	cl.Release()
+	if !cl.Acquire() {
+		t.Error("Failed to acquire released connection slot")
+	}
+	if cl.Count() != 2 {
+		t.Error("Incorrect connection count: ", cl.Count())
+	}
+}
@@ -0,0 +1,200 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sync"
+)
+
+// readAhead is the number of bytes beyond the read position that a reader asks to be
+// downloaded before anything else.
+const readAhead = 4 * 1024 * 1024
+
+var errReaderClosed = errors.New("Reader is closed")
+
+// fileReader reads a single file of a torrent whilst it downloads. Reads block until the
+// pieces they cover have been downloaded and verified.
+type fileReader struct {
+	tor       *Torrent
+	offset    int64 // Offset of the file within the torrent
+	length    int64
+	pos       int64 // Read position within the file
+	first     int   // First piece of the prioritised window, or -1 if none
+	last      int
+	closed    chan struct{}
+	closeOnce sync.Once
+	mutex     sync.Mutex
+}
+
+// SetSequential switches between downloading pieces in order, which suits streaming,
+// and the default of downloading the rarest pieces first, which is better for the swarm.
+func (t *Torrent) SetSequential(sequential bool) {
+	t.picker.SetSequential(sequential)
+	t.repick()
+}
+
+// NewReader returns a reader for the file at fileIndex. Pieces around the read position
+// are downloaded first, and reads block until the data they cover has been verified, so
+// the reader can be used to stream a file (eg. with http.ServeContent) before the
+// torrent has finished. The reader must be closed once it is no longer needed.
+func (t *Torrent) NewReader(fileIndex int) (io.ReadSeekCloser, error) {
+	if fileIndex < 0 || fileIndex >= len(t.meta.Files) {
+		return nil, errors.New(fmt.Sprintf("NewReader: file index %d out of range", fileIndex))
+	}
+
+	r := &fileReader{
+		tor:    t,
+		length: t.meta.Files[fileIndex].Length,
+		first:  -1,
+		last:   -1,
+		closed: make(chan struct{}),
+	}
+	for _, file := range t.meta.Files[:fileIndex] {
+		r.offset += file.Length
+	}
+	return r, nil
+}
+
+func (r *fileReader) Read(b []byte) (n int, err error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	select {
+	case <-r.closed:
+		return 0, errReaderClosed
+	default:
+	}
+	if r.pos >= r.length {
+		return 0, io.EOF
+	}
+	if len(b) == 0 {
+		return 0, nil
+	}
+
+	abs := r.offset + r.pos
+	index := int(abs / r.tor.meta.PieceLength)
+	r.prioritise(abs)
+	if !r.tor.waitPiece(index, r.closed) {
+		return 0, errReaderClosed
+	}
+
+	// Read no further than the end of the piece or the file
+	pieceStart := int64(index) * r.tor.meta.PieceLength
+	length := int64(len(b))
+	if remaining := pieceStart + r.tor.pieceLength(index) - abs; remaining < length {
+		length = remaining
+	}
+	if remaining := r.length - r.pos; remaining < length {
+		length = remaining
+	}
+
+	disk := r.tor.storage()
+	if disk == nil {
+		return 0, errors.New("Read: torrent files are closed")
+	}
+	block, err := disk.Read(index, abs-pieceStart, length)
+	if err != nil {
+		return
+	}
+	n = copy(b, block)
+	r.pos += int64(n)
+	return
+}
+
+func (r *fileReader) Seek(offset int64, whence int) (int64, error) {
+	r.mutex.Lock()
+	defer r.mutex.Unlock()
+
+	switch whence {
+	case io.SeekStart:
+	case io.SeekCurrent:
+		offset += r.pos
+	case io.SeekEnd:
+		offset += r.length
+	default:
+		return r.pos, errors.New("Seek: invalid whence")
+	}
+	if offset < 0 {
+		return r.pos, errors.New("Seek: negative position")
+	}
+	r.pos = offset
+	return r.pos, nil
+}
+
+// Close releases the reader's piece priorities and unblocks any pending Read.
+func (r *fileReader) Close() error {
+	r.closeOnce.Do(func() {
+		close(r.closed)
+	})
+	r.mutex.Lock()
+	if r.first != -1 {
+		r.tor.picker.Prioritise(r.first, r.last, -1)
+		r.first, r.last = -1, -1
+	}
+	r.mutex.Unlock()
+	return nil
+}
+
+// prioritise moves the reader's window of prioritised pieces to start at abs, the
+// absolute offset within the torrent. The caller must hold mutex.
+func (r *fileReader) prioritise(abs int64) {
+	end := abs + readAhead
+	if fileEnd := r.offset + r.length; end > fileEnd {
+		end = fileEnd
+	}
+	first := int(abs / r.tor.meta.PieceLength)
+	last := int((end - 1) / r.tor.meta.PieceLength)
+	if first == r.first && last == r.last {
+		return
+	}
+
+	r.tor.picker.Prioritise(first, last, 1)
+	if r.first != -1 {
+		r.tor.picker.Prioritise(r.first, r.last, -1)
+	}
+	r.first, r.last = first, last
+
+	r.tor.repick()
+}
+
+// repick asks the peer loop to request blocks from every peer now, rather than at its
+// next tick, so that changes in priority take effect quickly.
+func (t *Torrent) repick() {
+	select {
+	case t.repicked <- struct{}{}:
+	default:
+	}
+}
+
+// storage returns the disk I/O for the torrent's open files, or nil if they are closed.
+func (t *Torrent) storage() (disk *diskIO) {
+	t.stateLock.Lock()
+	disk = t.disk
+	t.stateLock.Unlock()
+	return
+}
+
+// notifyPieces wakes everything waiting in waitPiece. The caller must hold bitfLock.
+func (t *Torrent) notifyPieces() {
+	close(t.pieceNotify)
+	t.pieceNotify = make(chan struct{})
+}
+
+// waitPiece blocks until we have the verified piece, returning false if cancel is closed
+// first.
+func (t *Torrent) waitPiece(index int, cancel <-chan struct{}) bool {
+	for {
+		t.bitfLock.RLock()
+		have, notify := t.bitf.Get(index), t.pieceNotify
+		t.bitfLock.RUnlock()
+		if have {
+			return true
+		}
+		select {
+		case <-notify:
+		case <-cancel:
+			return false
+		}
+	}
+}
@@ -0,0 +1,137 @@
+package libtorrent
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestReaderBlocksUntilVerified(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+	tor.Start()
+
+	r, err := tor.NewReader(0)
+	if err != nil {
+		t.Fatal("Failed to create reader: ", err)
+	}
+	defer r.Close()
+
+	// Reading from the second piece prioritises it over the first
+	if _, err := r.Seek(32768+10, io.SeekStart); err != nil {
+		t.Fatal("Failed to seek: ", err)
+	}
+	result := make(chan []byte)
+	go func() {
+		buf := make([]byte, 100)
+		n, err := r.Read(buf)
+		if err != nil {
+			t.Error("Read failed: ", err)
+		}
+		result <- buf[:n]
+	}()
+
+	select {
+	case <-result:
+		t.Fatal("Read returned before the piece was downloaded")
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	data := testData(t)
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.seed(t)
+	req := rp.expectRequest(t)
+	if req.pieceIndex != 1 {
+		t.Errorf("Expected prioritised piece to be requested first, got piece %d", req.pieceIndex)
+	}
+	rp.respond(t, req, data)
+
+	select {
+	case b := <-result:
+		if !bytes.Equal(b, data[32778:32878]) {
+			t.Error("Read returned incorrect data")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Read did not return once the piece was verified")
+	}
+}
+
+func TestReaderClose(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+
+	r, _ := tor.NewReader(0)
+	done := make(chan error)
+	go func() {
+		_, err := r.Read(make([]byte, 10))
+		done <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	r.Close()
+
+	select {
+	case err := <-done:
+		if err != errReaderClosed {
+			t.Error("Expected closed error, got: ", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Close did not unblock Read")
+	}
+	for i, n := range tor.picker.priority {
+		if n != 0 {
+			t.Errorf("Piece %d still prioritised after close", i)
+		}
+	}
+	if _, err := tor.NewReader(1); err == nil {
+		t.Error("Expected error for out of range file index")
+	}
+}
+
+func TestReaderServeContent(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	data := testData(t)
+	ioutil.WriteFile(filepath.Join(tmpDir, "test.txt"), data, os.ModePerm)
+
+	tor, err := NewTorrent(testMetainfo(), &Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer tor.Stop()
+
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		r, err := tor.NewReader(0)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer r.Close()
+		http.ServeContent(w, req, "test.txt", time.Time{}, r)
+	}))
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL, nil)
+	req.Header.Set("Range", "bytes=32000-33999")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal("Request failed: ", err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	if resp.StatusCode != http.StatusPartialContent || !bytes.Equal(body, data[32000:34000]) {
+		t.Errorf("Incorrect response across piece boundary: %d, %d bytes", resp.StatusCode, len(body))
+	}
+
+	// Whole file
+	r, _ := tor.NewReader(0)
+	defer r.Close()
+	if all, err := ioutil.ReadAll(r); err != nil || !bytes.Equal(all, data) {
+		t.Error("Failed to read whole file: ", err)
+	}
+}
@@ -0,0 +1,74 @@
+package libtorrent
+
+import (
+	"bytes"
+	"errors"
+	"github.com/torrance/libtorrent/metainfo"
+	"github.com/zeebo/bencode"
+	"io"
+)
+
+// ResumeData records the parts of a torrent's state that can't be recovered from its
+// metainfo, so that the torrent can be recreated as it was.
+type ResumeData struct {
+	InfoHash  []byte   `bencode:"info-hash"`
+	SavePath  string   `bencode:"save-path"`  // Directory holding the files
+	FilePaths []string `bencode:"file-paths"` // Path of each file, after any renames
+	PeerId    []byte   `bencode:"peer-id"`    // Kept so that trackers see the same peer
+	Key       int32    `bencode:"key"`        // Announce key
+}
+
+// ParseResumeData reads resume data written by ResumeData.Encode.
+func ParseResumeData(r io.Reader) (rd *ResumeData, err error) {
+	rd = new(ResumeData)
+	if err = bencode.NewDecoder(r).Decode(rd); err != nil {
+		rd = nil
+	}
+	return
+}
+
+// Encode writes the resume data in bencoded form.
+func (rd *ResumeData) Encode(w io.Writer) error {
+	return bencode.NewEncoder(w).Encode(rd)
+}
+
+// NewTorrentFromResumeData creates a torrent as it was when rd was saved.
+func NewTorrentFromResumeData(m *metainfo.Metainfo, config *Config, rd *ResumeData) (tor *Torrent, err error) {
+	return newTorrent(m, config, newLimits(config), rd)
+}
+
+// ResumeData returns the torrent's current resume data.
+func (t *Torrent) ResumeData() *ResumeData {
+	root, paths := t.paths()
+	return &ResumeData{
+		InfoHash:  t.meta.InfoHash,
+		SavePath:  root,
+		FilePaths: paths,
+		PeerId:    t.peerId,
+		Key:       t.key,
+	}
+}
+
+func (t *Torrent) applyResumeData(rd *ResumeData) error {
+	if !bytes.Equal(rd.InfoHash, t.meta.InfoHash) {
+		return errors.New("Resume data is for a different torrent")
+	}
+	if len(rd.FilePaths) != len(t.meta.Files) {
+		return errors.New("Resume data has the wrong number of files")
+	}
+	t.root = rd.SavePath
+	t.filePaths = append([]string(nil), rd.FilePaths...)
+	if len(rd.PeerId) == 20 {
+		t.peerId = append([]byte(nil), rd.PeerId...)
+		t.key = rd.Key
+	}
+	return nil
+}
+
+// paths returns the directory holding the torrent's files, and a copy of their paths
+// beneath it.
+func (t *Torrent) paths() (root string, paths []string) {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.root, append([]string(nil), t.filePaths...)
+}
@@ -0,0 +1,43 @@
+package libtorrent
+
+import (
+	"bytes"
+	"path/filepath"
+	"testing"
+)
+
+func TestResumeData(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, filepath.Join(tmpDir, "old"))
+	newPath := filepath.Join("sub", "renamed.txt")
+	tor.RenameFile(0, newPath)
+	tor.MoveStorage(filepath.Join(tmpDir, "new"))
+	tor.Stop()
+
+	var buf bytes.Buffer
+	if err := tor.ResumeData().Encode(&buf); err != nil {
+		t.Fatal("Failed to encode resume data: ", err)
+	}
+	rd, err := ParseResumeData(&buf)
+	if err != nil {
+		t.Fatal("Failed to parse resume data: ", err)
+	}
+
+	again, err := NewTorrentFromResumeData(testMetainfo(), &Config{RootDirectory: tmpDir}, rd)
+	if err != nil {
+		t.Fatal("Could not restore torrent: ", err)
+	}
+	defer again.Stop()
+	if s := again.Status(); s.Files[0].Path != newPath || s.DoneBytes != 36880 {
+		t.Error("Torrent not restored from resume data: ", s.Files[0], s.DoneBytes)
+	}
+	if !bytes.Equal(again.PeerId(), tor.PeerId()) || again.Key() != tor.Key() {
+		t.Error("Peer id and key not restored from resume data")
+	}
+
+	rd.InfoHash = make([]byte, 20)
+	if _, err := NewTorrentFromResumeData(testMetainfo(), &Config{RootDirectory: tmpDir}, rd); err == nil {
+		t.Error("Expected error for another torrent's resume data")
+	}
+}
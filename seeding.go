@@ -0,0 +1,149 @@
+package libtorrent
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+// seedCheckInterval is how often a seeding torrent checks its goals.
+var seedCheckInterval = time.Second * 5
+
+// SeedAction is what a torrent does once it has reached a seeding goal.
+type SeedAction int
+
+const (
+	SeedStop   SeedAction = iota // Stop the torrent, closing its files
+	SeedPause                    // Pause the torrent, keeping its files open
+	SeedRemove                   // Remove the torrent from its Session, keeping its files
+)
+
+// SeedingGoals decide when a finished torrent has seeded enough. Seeding ends once any
+// goal is reached; zero values are ignored, so a torrent without goals seeds forever.
+type SeedingGoals struct {
+	Ratio    float64       // Share ratio, as in Status.Ratio
+	SeedTime time.Duration // Total time spent seeding
+	IdleTime time.Duration // Time spent seeding without uploading anything
+	Action   SeedAction
+}
+
+// reached returns a description of the first goal reached, or "" if there is none.
+func (g SeedingGoals) reached(ratio float64, seedTime time.Duration, idleTime time.Duration) string {
+	switch {
+	case g.Ratio > 0 && ratio >= g.Ratio:
+		return fmt.Sprintf("share ratio %.2f", ratio)
+	case g.SeedTime > 0 && seedTime >= g.SeedTime:
+		return fmt.Sprintf("seeding time %s", seedTime)
+	case g.IdleTime > 0 && idleTime >= g.IdleTime:
+		return fmt.Sprintf("idle for %s", idleTime)
+	}
+	return ""
+}
+
+// SeedingGoals returns the torrent's seeding goals.
+func (t *Torrent) SeedingGoals() SeedingGoals {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.goals
+}
+
+// SetSeedingGoals replaces the goals taken from Config.SeedingGoals. They apply from the
+// next check, even if the torrent is already seeding.
+func (t *Torrent) SetSeedingGoals(goals SeedingGoals) {
+	t.stateLock.Lock()
+	t.goals = goals
+	t.stateLock.Unlock()
+}
+
+// timeSeeding returns the total time spent seeding. The caller must hold stateLock.
+func (t *Torrent) timeSeeding() time.Duration {
+	if t.state == Seeding {
+		return t.seedingTime + time.Since(t.seedingSince)
+	}
+	return t.seedingTime
+}
+
+// seedClock keeps the seeding time as the state changes from old to state. The caller
+// must hold stateLock.
+func (t *Torrent) seedClock(old int, state int) {
+	if old == Seeding && state != Seeding {
+		t.seedingTime += time.Since(t.seedingSince)
+	} else if old != Seeding && state == Seeding {
+		t.seedingSince = time.Now()
+	}
+}
+
+// seed checks the seeding goals until one is reached, then carries out its action. It
+// runs for the whole of each run, but only checks whilst seeding.
+func (t *Torrent) seed(ctx context.Context) {
+	idleSince := time.Now()
+	uploaded := t.stats.uploaded.Total()
+	for {
+		select {
+		case <-time.After(seedCheckInterval):
+		case <-ctx.Done():
+			return
+		}
+		if total := t.stats.uploaded.Total(); total != uploaded {
+			uploaded, idleSince = total, time.Now()
+		}
+
+		t.stateLock.Lock()
+		state, goals, seedTime := t.state, t.goals, t.timeSeeding()
+		if state == Seeding && t.seedingSince.After(idleSince) {
+			// We weren't seeding for the time before
+			idleSince = t.seedingSince
+		}
+		t.stateLock.Unlock()
+		if state != Seeding {
+			continue
+		}
+
+		if reason := goals.reached(t.Status().Ratio, seedTime, time.Since(idleSince)); reason != "" {
+			logger.Info("Torrent %s reached its seeding goal: %s", t.meta.Name, reason)
+			t.publish(Event{Type: SeedingGoalReachedEvent})
+			// The action halts the torrent, which waits for this goroutine to return
+			go t.seedingDone(goals.Action)
+			return
+		}
+	}
+}
+
+// seedingDone carries out the action of a reached seeding goal.
+func (t *Torrent) seedingDone(action SeedAction) {
+	var err error
+	switch action {
+	case SeedPause:
+		err = t.Pause()
+	case SeedRemove:
+		if t.removeSelf != nil {
+			t.removeSelf()
+			return
+		}
+		// Not in a Session, so there is nothing to remove it from
+		err = t.Stop()
+	default:
+		err = t.Stop()
+	}
+	if err != nil {
+		logger.Error("Failed to end seeding of %s: %s", t.meta.Name, err)
+	}
+}
+
+// wantPeers returns true if we should dial more peers: always whilst leeching, and whilst
+// seeding only until Config.DialWhileSeeding peers without every piece are connected.
+func (t *Torrent) wantPeers() bool {
+	switch t.State() {
+	case Leeching:
+		return true
+	case Seeding:
+		leechers := 0
+		for _, p := range t.peers() {
+			if !p.IsSeed() {
+				leechers++
+			}
+		}
+		return leechers < t.config.DialWhileSeeding
+	}
+	return false
+}
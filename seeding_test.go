@@ -0,0 +1,125 @@
+package libtorrent
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestSeedingGoalsReached(t *testing.T) {
+	goals := SeedingGoals{Ratio: 2, SeedTime: time.Hour, IdleTime: time.Minute}
+	if reason := goals.reached(1.5, time.Minute, time.Second); reason != "" {
+		t.Error("Goal reached too early: ", reason)
+	}
+	for _, c := range []struct {
+		ratio          float64
+		seedTime, idle time.Duration
+	}{
+		{2, 0, 0},
+		{0, time.Hour, 0},
+		{0, 0, time.Minute},
+	} {
+		if goals.reached(c.ratio, c.seedTime, c.idle) == "" {
+			t.Error("Goal not reached: ", c)
+		}
+	}
+	if reason := (SeedingGoals{}).reached(100, time.Hour*1000, time.Hour*1000); reason != "" {
+		t.Error("Torrent without goals stopped seeding: ", reason)
+	}
+}
+
+func TestSeedingRatio(t *testing.T) {
+	defer func(d time.Duration) { seedCheckInterval = d }(seedCheckInterval)
+	seedCheckInterval = time.Millisecond * 10
+
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, tmpDir)
+	defer tor.Stop()
+	tor.SetSeedingGoals(SeedingGoals{Ratio: 1, Action: SeedPause})
+	sub := tor.Subscribe(StatusEvents)
+	defer sub.Close()
+	tor.Start()
+	if tor.State() != Seeding {
+		t.Fatal("Complete torrent not seeding")
+	}
+	expectEvents(t, sub, StateChangedEvent)
+
+	// Upload the whole torrent once
+	tor.stats.uploaded.Add(int(tor.totalLength()))
+	waitFor(t, "torrent to pause", func() bool { return tor.State() == Paused })
+	expectEvents(t, sub, SeedingGoalReachedEvent, StateChangedEvent)
+	if tor.Status().SeedingTime <= 0 {
+		t.Error("Seeding time not recorded")
+	}
+}
+
+func TestSeedingTime(t *testing.T) {
+	defer func(d time.Duration) { seedCheckInterval = d }(seedCheckInterval)
+	seedCheckInterval = time.Millisecond * 10
+
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, tmpDir)
+	defer tor.Stop()
+	tor.SetSeedingGoals(SeedingGoals{SeedTime: time.Millisecond * 100})
+	tor.Start()
+	waitFor(t, "torrent to stop", func() bool { return tor.State() == Stopped })
+	if seedTime := tor.Status().SeedingTime; seedTime < time.Millisecond*100 {
+		t.Error("Stopped before seeding time reached: ", seedTime)
+	}
+}
+
+func TestSeedingRemove(t *testing.T) {
+	defer func(d time.Duration) { seedCheckInterval = d }(seedCheckInterval)
+	seedCheckInterval = time.Millisecond * 10
+
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	if err := ioutil.WriteFile(filepath.Join(tmpDir, "test.txt"), testData(t), 0644); err != nil {
+		t.Fatal("Failed to write test data: ", err)
+	}
+	s, err := NewSession(&Config{
+		RootDirectory: tmpDir,
+		SeedingGoals:  SeedingGoals{IdleTime: time.Millisecond * 50, Action: SeedRemove},
+	})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+
+	tor, err := s.AddTorrent(testMetainfo())
+	if err != nil {
+		t.Fatal("Failed to add torrent: ", err)
+	}
+	waitFor(t, "torrent to be removed", func() bool { return len(s.Torrents()) == 0 })
+	waitFor(t, "torrent to stop", func() bool { return tor.State() == Stopped })
+	if _, err := ioutil.ReadFile(filepath.Join(tmpDir, "test.txt")); err != nil {
+		t.Error("Files of removed torrent deleted: ", err)
+	}
+}
+
+func TestDialWhileSeeding(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, tmpDir)
+	defer tor.Stop()
+	tor.Start()
+	if tor.wantPeers() {
+		t.Error("Seed wants peers by default")
+	}
+
+	tor.Stop()
+	tor.config.DialWhileSeeding = 1
+	tor.Start()
+	if !tor.wantPeers() {
+		t.Error("Seed doesn't want peers with DialWhileSeeding set")
+	}
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.expect(t)
+	waitFor(t, "peer to connect", func() bool { return len(tor.Peers()) == 1 })
+	if tor.wantPeers() {
+		t.Error("Seed wants peers after reaching DialWhileSeeding")
+	}
+}
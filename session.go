@@ -0,0 +1,247 @@
+package libtorrent
+
+import (
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/lsd"
+	"github.com/torrance/libtorrent/metainfo"
+	"github.com/torrance/libtorrent/portmap"
+	"net"
+	"net/netip"
+	"sync"
+)
+
+// limits are the connection and rate limits and IP filter applied to a torrent's peers,
+// along with our external addresses. Torrents belonging to a Session share a single
+// limits, so the limits apply globally.
+type limits struct {
+	upload   *rateLimiter
+	download *rateLimiter
+	conns    *connLimiter
+	filter   *peerFilter
+	external *externalAddrs
+}
+
+func newLimits(config *Config) *limits {
+	return &limits{
+		upload:   newRateLimiter(config.UploadRateLimit),
+		download: newRateLimiter(config.DownloadRateLimit),
+		conns:    newConnLimiter(config.MaxConnections),
+		filter:   &peerFilter{filter: config.IPFilter},
+		external: new(externalAddrs),
+	}
+}
+
+// Session manages a set of torrents sharing a single listening port and a common
+// set of connection and rate limits. It is safe for concurrent use.
+//
+// Torrents are kept in a queue. Auto-managed torrents are started in queue order, as
+// many as Config's active limits allow, and the rest wait in the Queued state.
+type Session struct {
+	config     *Config
+	listener   *Listener
+	limits     *limits
+	events     *eventBus
+	torrents   map[string]*Torrent
+	queue      []*Torrent
+	mutex      sync.RWMutex
+	closed     bool
+	manageLock sync.Mutex    // Serialises manage
+	requeued   chan struct{} // Wakes the queue loop
+	closing    chan struct{} // Closed to stop the queue loop
+	queueDone  chan struct{} // Closed once the queue loop has returned
+	lsd        *lsd.Service  // Nil unless Config.LocalDiscovery is set
+
+	portmap *portmap.Service // Nil unless Config.PortMapping is set
+}
+
+// NewSession creates a session and begins listening for incoming peers on config.Port.
+func NewSession(config *Config) (s *Session, err error) {
+	s = &Session{
+		config:    config,
+		listener:  NewListener(config.Port),
+		limits:    newLimits(config),
+		events:    newEventBus(nil),
+		torrents:  make(map[string]*Torrent),
+		requeued:  make(chan struct{}, 1),
+		closing:   make(chan struct{}),
+		queueDone: make(chan struct{}),
+	}
+
+	s.listener.filter = s.limits.filter
+	if err = s.listener.Listen(); err != nil {
+		// There is no queue loop for Close to wait for
+		close(s.queueDone)
+		return
+	}
+	go s.queueLoop()
+
+	port := s.listener.Addr().(*net.TCPAddr).Port
+	if config.LocalDiscovery {
+		s.lsd = lsd.New(uint16(port), s.discoverable, s.localPeer)
+		if e := s.lsd.Listen(); e != nil {
+			// Not fatal: peers can still be found through the trackers
+			logger.Error("Failed to start local service discovery: %s", e)
+		}
+	}
+	if config.PortMapping {
+		s.portmap = portmap.New(uint16(port), s.portMapped)
+		s.portmap.Discover()
+	}
+	return
+}
+
+// portMapped records our listening port as mapped on a gateway, so that torrents
+// announce it. A lapsed mapping has port zero, which returns torrents to Config.Port.
+func (s *Session) portMapped(proto portmap.Protocol, external netip.AddrPort) {
+	if proto != portmap.TCP {
+		return
+	}
+	s.limits.external.set(external.Addr())
+	s.limits.external.setPort(external.Port())
+}
+
+// discoverable returns the infohashes to announce by local service discovery: those of
+// running torrents that aren't private.
+func (s *Session) discoverable() (infoHashes [][]byte) {
+	for _, tor := range s.Torrents() {
+		if state := tor.State(); !tor.Private() && (state == Leeching || state == Seeding) {
+			infoHashes = append(infoHashes, tor.InfoHash())
+		}
+	}
+	return
+}
+
+// localPeer passes a peer found by local service discovery to its torrent.
+func (s *Session) localPeer(infoHash []byte, addr netip.AddrPort) {
+	s.mutex.RLock()
+	tor, ok := s.torrents[fmt.Sprintf("%x", infoHash)]
+	s.mutex.RUnlock()
+	if ok {
+		logger.Debug("Found local peer %s for %s", addr, tor.meta.Name)
+		tor.addPeerAddr(addr, SourceLSD)
+	}
+}
+
+// AddTorrent creates a torrent from m and adds it to the back of the queue, as an
+// auto-managed torrent. It is started at once if the active limits allow.
+func (s *Session) AddTorrent(m *metainfo.Metainfo) (tor *Torrent, err error) {
+	infoHash := fmt.Sprintf("%x", m.InfoHash)
+
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		err = errors.New("AddTorrent: session is closed")
+		return
+	}
+	if _, ok := s.torrents[infoHash]; ok {
+		s.mutex.Unlock()
+		err = errors.New(fmt.Sprintf("AddTorrent: torrent %s already exists in session", infoHash))
+		return
+	}
+
+	if tor, err = newTorrent(m, s.config, s.limits, nil); err != nil {
+		s.mutex.Unlock()
+		return
+	}
+	tor.events.parent = s.events
+	tor.removeSelf = func() {
+		if err := s.RemoveTorrent(m.InfoHash, false); err != nil {
+			logger.Debug("Failed to remove torrent after seeding: %s", err)
+		}
+	}
+	s.events.publish(Event{Type: TorrentAddedEvent, InfoHash: m.InfoHash})
+	tor.SetAutoManaged(true)
+	tor.enqueue()
+
+	s.torrents[infoHash] = tor
+	s.queue = append(s.queue, tor)
+	s.listener.AddTorrent(tor)
+	s.mutex.Unlock()
+
+	s.manage()
+	if s.lsd != nil {
+		s.lsd.Announce()
+	}
+	return
+}
+
+// RemoveTorrent stops the torrent with the given infohash and removes it from the session.
+// If deleteFiles is true, its downloaded data is also removed from disk.
+func (s *Session) RemoveTorrent(infoHash []byte, deleteFiles bool) (err error) {
+	key := fmt.Sprintf("%x", infoHash)
+
+	s.mutex.Lock()
+	tor, ok := s.torrents[key]
+	if ok {
+		delete(s.torrents, key)
+		if i := s.queueIndex(infoHash); i >= 0 {
+			s.queue = append(s.queue[:i], s.queue[i+1:]...)
+		}
+	}
+	s.mutex.Unlock()
+
+	if !ok {
+		return errors.New(fmt.Sprintf("RemoveTorrent: no torrent %s in session", key))
+	}
+
+	s.listener.RemoveTorrent(tor)
+	tor.Stop()
+	if deleteFiles {
+		err = tor.deleteFiles()
+	}
+	s.events.publish(Event{Type: TorrentRemovedEvent, InfoHash: infoHash})
+	// Its slot may now be free
+	s.requeue()
+	return
+}
+
+// Subscribe returns a subscription to the events of the session and all of its torrents.
+func (s *Session) Subscribe(filter EventCategory) *Subscription {
+	return s.events.subscribe(filter)
+}
+
+// Torrents returns the torrents currently managed by the session, in queue order.
+func (s *Session) Torrents() (tors []*Torrent) {
+	s.mutex.RLock()
+	defer s.mutex.RUnlock()
+	return append([]*Torrent(nil), s.queue...)
+}
+
+// Close stops every torrent and the listener. The torrents' files are left on disk.
+func (s *Session) Close() error {
+	s.mutex.Lock()
+	if s.closed {
+		s.mutex.Unlock()
+		return nil
+	}
+	s.closed = true
+	tors := s.torrents
+	s.torrents = make(map[string]*Torrent)
+	s.queue = nil
+	s.mutex.Unlock()
+
+	// Stop managing the queue, so nothing is restarted whilst we stop them
+	close(s.closing)
+	<-s.queueDone
+	if s.lsd != nil {
+		s.lsd.Close()
+	}
+	if s.portmap != nil {
+		// Removes the mappings from the gateways
+		s.portmap.Close()
+	}
+
+	// Stop concurrently, as each may wait on its trackers' STOPPED announces
+	var wg sync.WaitGroup
+	for _, tor := range tors {
+		s.listener.RemoveTorrent(tor)
+		wg.Add(1)
+		go func(tor *Torrent) {
+			tor.Stop()
+			wg.Done()
+		}(tor)
+	}
+	wg.Wait()
+	return s.listener.Close()
+}
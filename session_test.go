@@ -0,0 +1,132 @@
+package libtorrent
+
+import (
+	"bytes"
+	"github.com/torrance/libtorrent/metainfo"
+	"net/netip"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func testMetainfo() *metainfo.Metainfo {
+	m := &metainfo.Metainfo{
+		Name:        "test.txt",
+		PieceLength: 32768,
+		PieceCount:  2,
+		Pieces: [][]byte{
+			[]byte{235, 203, 167, 177, 114, 56, 226, 172, 6, 254, 96, 77, 68, 107, 80, 141, 148, 248, 180, 189},
+			[]byte{199, 10, 10, 118, 99, 244, 176, 96, 247, 53, 217, 230, 10, 42, 50, 233, 147, 116, 217, 141},
+		},
+		InfoHash: []byte{0x74, 0x2d, 0x47, 0x53, 0x0f, 0xc4, 0xdc, 0xfd, 0xfd, 0x19, 0x71, 0x71, 0xa7, 0x7a, 0x04, 0x88, 0x67, 0xc6, 0xcc, 0x9d},
+	}
+	m.Files = append(m.Files, struct {
+		Length int64
+		Path   string
+	}{Length: 36880, Path: "test.txt"})
+	return m
+}
+
+func TestSession(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	s, err := NewSession(&Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+
+	m := testMetainfo()
+	tor, err := s.AddTorrent(m)
+	if err != nil {
+		t.Fatal("Failed to add torrent: ", err)
+	}
+	if tor.State() != Leeching {
+		t.Error("Torrent not started, state: ", tor.State())
+	}
+	if _, err = s.AddTorrent(m); err == nil {
+		t.Error("Adding a duplicate torrent should fail")
+	}
+	if tors := s.Torrents(); len(tors) != 1 || tors[0] != tor {
+		t.Error("Incorrect torrents: ", tors)
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "test.txt")); err != nil {
+		t.Error("Torrent file not created: ", err)
+	}
+
+	if err = s.RemoveTorrent(m.InfoHash, true); err != nil {
+		t.Error("Failed to remove torrent: ", err)
+	}
+	if tors := s.Torrents(); len(tors) != 0 {
+		t.Error("Torrent not removed: ", tors)
+	}
+	if tor.State() != Stopped {
+		t.Error("Removed torrent not stopped, state: ", tor.State())
+	}
+	if _, err := os.Stat(filepath.Join(tmpDir, "test.txt")); !os.IsNotExist(err) {
+		t.Error("Torrent file not deleted: ", err)
+	}
+	if err = s.RemoveTorrent(m.InfoHash, false); err == nil {
+		t.Error("Removing an unknown torrent should fail")
+	}
+}
+
+func TestSessionClose(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	s, err := NewSession(&Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	if _, err = s.AddTorrent(testMetainfo()); err != nil {
+		t.Fatal("Failed to add torrent: ", err)
+	}
+
+	if err = s.Close(); err != nil {
+		t.Error("Failed to close session: ", err)
+	}
+	if len(s.Torrents()) != 0 {
+		t.Error("Session still has torrents after close")
+	}
+	if _, err = s.AddTorrent(testMetainfo()); err == nil {
+		t.Error("Adding a torrent to a closed session should fail")
+	}
+	// Files are left in place
+	if _, err := os.Stat(filepath.Join(tmpDir, "test.txt")); err != nil {
+		t.Error("Torrent file removed on close: ", err)
+	}
+}
+
+func TestSessionLocalPeers(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	s, err := NewSession(&Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Failed to create session: ", err)
+	}
+	defer s.Close()
+
+	public := testMetainfo()
+	private := testMetainfo()
+	private.InfoHash[0]++
+	private.Private = true
+	pub, err := s.AddTorrent(public)
+	if err != nil {
+		t.Fatal("Failed to add torrent: ", err)
+	}
+	priv, err := s.AddTorrent(private)
+	if err != nil {
+		t.Fatal("Failed to add torrent: ", err)
+	}
+
+	if infoHashes := s.discoverable(); len(infoHashes) != 1 || !bytes.Equal(infoHashes[0], public.InfoHash) {
+		t.Errorf("Incorrect infohashes to announce: %x", infoHashes)
+	}
+	s.localPeer(public.InfoHash, netip.MustParseAddrPort("192.168.1.2:6881"))
+	s.localPeer(private.InfoHash, netip.MustParseAddrPort("192.168.1.2:6881"))
+	if pub.pool.Len() != 1 || priv.pool.Len() != 0 {
+		t.Error("Local peer not passed to public torrent only: ", pub.pool.Len(), priv.pool.Len())
+	}
+}
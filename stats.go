@@ -0,0 +1,88 @@
+package libtorrent
+
+import (
+	"sync"
+	"time"
+)
+
+// rateWindow is the number of seconds over which transfer rates are averaged.
+const rateWindow = 5
+
+// rateCounter keeps a running total of bytes transferred and the average rate over the
+// last rateWindow seconds. Every addition is also counted by parent, if set, so that
+// per-peer counters roll up into their torrent's.
+type rateCounter struct {
+	total   int64
+	buckets [rateWindow]int64 // Bytes transferred in each of the last few seconds
+	second  int64             // Unix second of the newest bucket
+	parent  *rateCounter
+	mutex   sync.Mutex
+}
+
+func newRateCounter(parent *rateCounter) *rateCounter {
+	return &rateCounter{parent: parent}
+}
+
+func (rc *rateCounter) Add(n int) {
+	rc.mutex.Lock()
+	rc.advance(time.Now().Unix())
+	rc.total += int64(n)
+	rc.buckets[rc.second%rateWindow] += int64(n)
+	rc.mutex.Unlock()
+
+	if rc.parent != nil {
+		rc.parent.Add(n)
+	}
+}
+
+// advance clears out any buckets older than the window. The caller must hold mutex.
+func (rc *rateCounter) advance(now int64) {
+	if now-rc.second >= rateWindow {
+		rc.buckets = [rateWindow]int64{}
+	} else {
+		for s := rc.second + 1; s <= now; s++ {
+			rc.buckets[s%rateWindow] = 0
+		}
+	}
+	if now > rc.second {
+		rc.second = now
+	}
+}
+
+// Total returns the number of bytes counted since creation.
+func (rc *rateCounter) Total() (n int64) {
+	rc.mutex.Lock()
+	n = rc.total
+	rc.mutex.Unlock()
+	return
+}
+
+// Rate returns the average bytes per second over the last rateWindow seconds.
+func (rc *rateCounter) Rate() int64 {
+	rc.mutex.Lock()
+	defer rc.mutex.Unlock()
+
+	rc.advance(time.Now().Unix())
+	var sum int64
+	for _, b := range rc.buckets {
+		sum += b
+	}
+	return sum / rateWindow
+}
+
+// transferStats counts payload (piece data) bytes in each direction.
+type transferStats struct {
+	uploaded   *rateCounter
+	downloaded *rateCounter
+}
+
+// newTransferStats returns counters that also add to parent, which may be nil.
+func newTransferStats(parent *transferStats) *transferStats {
+	if parent == nil {
+		return &transferStats{uploaded: newRateCounter(nil), downloaded: newRateCounter(nil)}
+	}
+	return &transferStats{
+		uploaded:   newRateCounter(parent.uploaded),
+		downloaded: newRateCounter(parent.downloaded),
+	}
+}
@@ -0,0 +1,18 @@
+package libtorrent
+
+import (
+	"testing"
+)
+
+func TestRateCounter(t *testing.T) {
+	parent := newRateCounter(nil)
+	rc := newRateCounter(parent)
+	rc.Add(1000)
+	rc.Add(500)
+	if rc.Total() != 1500 || parent.Total() != 1500 {
+		t.Error("Incorrect totals: ", rc.Total(), parent.Total())
+	}
+	if rc.Rate() != 1500/rateWindow {
+		t.Error("Incorrect rate: ", rc.Rate())
+	}
+}
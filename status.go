@@ -0,0 +1,189 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+	"github.com/torrance/libtorrent/tracker"
+	"time"
+)
+
+// Status is a point in time snapshot of a torrent's progress.
+type Status struct {
+	Name     string
+	InfoHash []byte
+	State    int
+	Err      error
+
+	TotalBytes  int64 // Size of all files in the torrent
+	WantedBytes int64 // Size of the files we are downloading
+	DoneBytes   int64 // Size of verified pieces
+	Files       []FileStatus
+	Pieces      *bitfield.Bitfield // Copy of the verified pieces
+
+	DownloadRate int64 // Payload bytes per second
+	UploadRate   int64 // Payload bytes per second
+	Downloaded   int64 // Payload bytes downloaded since creation
+	Uploaded     int64 // Payload bytes uploaded since creation
+
+	Peers      int // Connected peers, including seeds
+	Seeds      int // Connected peers with every piece
+	SwarmPeers int // Leechers reported by the trackers
+	SwarmSeeds int // Seeders reported by the trackers
+
+	ETA         time.Duration // Time remaining at the current download rate, or -1 if unknown
+	Ratio       float64       // Uploaded / Downloaded, or Uploaded / DoneBytes if nothing has been downloaded
+	ActiveTime  time.Duration // Total time spent leeching or seeding
+	SeedingTime time.Duration // Total time spent seeding
+	Trackers    []tracker.Status
+}
+
+type FileStatus struct {
+	Path      string
+	Length    int64
+	DoneBytes int64
+}
+
+// Progress returns the fraction of wanted bytes that have been downloaded.
+func (s *Status) Progress() float64 {
+	if s.WantedBytes == 0 {
+		return 1
+	}
+	return float64(s.DoneBytes) / float64(s.WantedBytes)
+}
+
+// Status returns a snapshot of the torrent's progress. It does not touch the disk and
+// is cheap enough to poll regularly.
+func (t *Torrent) Status() (s *Status) {
+	bitf := t.bitfield()
+
+	s = &Status{
+		Name:         t.meta.Name,
+		InfoHash:     t.meta.InfoHash,
+		TotalBytes:   t.totalLength(),
+		DoneBytes:    t.bytesDone(bitf),
+		Files:        t.fileProgress(bitf),
+		Pieces:       bitf,
+		DownloadRate: t.stats.downloaded.Rate(),
+		UploadRate:   t.stats.uploaded.Rate(),
+		Downloaded:   t.stats.downloaded.Total(),
+		Uploaded:     t.stats.uploaded.Total(),
+		ETA:          -1,
+	}
+	s.WantedBytes = s.TotalBytes
+
+	t.stateLock.Lock()
+	s.State, s.Err = t.state, t.err
+	s.ActiveTime = t.activeTime
+	if t.state == Leeching || t.state == Seeding {
+		s.ActiveTime += time.Since(t.activeSince)
+	}
+	s.SeedingTime = t.timeSeeding()
+	trackers := t.trackers
+	t.stateLock.Unlock()
+
+	for _, p := range t.peers() {
+		s.Peers++
+		if p.IsSeed() {
+			s.Seeds++
+		}
+	}
+
+	for _, tkr := range trackers {
+		ts := tkr.Status()
+		s.Trackers = append(s.Trackers, ts)
+		// Trackers may share peers, so take the largest swarm rather than the sum
+		if ts.Leechers > s.SwarmPeers {
+			s.SwarmPeers = ts.Leechers
+		}
+		if ts.Seeders > s.SwarmSeeds {
+			s.SwarmSeeds = ts.Seeders
+		}
+	}
+
+	if left := s.WantedBytes - s.DoneBytes; left == 0 {
+		s.ETA = 0
+	} else if s.DownloadRate > 0 {
+		s.ETA = time.Duration(left/s.DownloadRate) * time.Second
+	}
+
+	if s.Downloaded > 0 {
+		s.Ratio = float64(s.Uploaded) / float64(s.Downloaded)
+	} else if s.DoneBytes > 0 {
+		s.Ratio = float64(s.Uploaded) / float64(s.DoneBytes)
+	}
+	return
+}
+
+// bitfield returns a copy of our verified pieces.
+func (t *Torrent) bitfield() *bitfield.Bitfield {
+	t.bitfLock.RLock()
+	defer t.bitfLock.RUnlock()
+	return t.bitf.Copy()
+}
+
+func (t *Torrent) havePiece(index int) bool {
+	t.bitfLock.RLock()
+	defer t.bitfLock.RUnlock()
+	return t.bitf.Get(index)
+}
+
+// complete returns true if we have every piece.
+func (t *Torrent) complete() bool {
+	t.bitfLock.RLock()
+	defer t.bitfLock.RUnlock()
+	return t.bitf.SumTrue() == t.bitf.Length()
+}
+
+func (t *Torrent) totalLength() (length int64) {
+	for _, file := range t.meta.Files {
+		length += file.Length
+	}
+	return
+}
+
+func (t *Torrent) pieceLength(index int) int64 {
+	if index == t.meta.PieceCount-1 {
+		return t.totalLength() - int64(index)*t.meta.PieceLength
+	}
+	return t.meta.PieceLength
+}
+
+// bytesDone returns the number of bytes in the pieces set in bitf.
+func (t *Torrent) bytesDone(bitf *bitfield.Bitfield) (done int64) {
+	done = int64(bitf.SumTrue()) * t.meta.PieceLength
+	if last := t.meta.PieceCount - 1; last >= 0 && bitf.Get(last) {
+		done += t.pieceLength(last) - t.meta.PieceLength
+	}
+	return
+}
+
+// fileProgress returns the number of verified bytes in each file.
+func (t *Torrent) fileProgress(bitf *bitfield.Bitfield) (files []FileStatus) {
+	_, paths := t.paths()
+	var offset int64
+	for i, file := range t.meta.Files {
+		fs := FileStatus{Path: paths[i], Length: file.Length}
+		end := offset + file.Length
+		if file.Length > 0 {
+			first := int(offset / t.meta.PieceLength)
+			last := int((end - 1) / t.meta.PieceLength)
+			for i := first; i <= last; i++ {
+				if !bitf.Get(i) {
+					continue
+				}
+				// Count only the part of the piece that overlaps this file
+				start := int64(i) * t.meta.PieceLength
+				stop := start + t.pieceLength(i)
+				if start < offset {
+					start = offset
+				}
+				if stop > end {
+					stop = end
+				}
+				fs.DoneBytes += stop - start
+			}
+		}
+		files = append(files, fs)
+		offset = end
+	}
+	return
+}
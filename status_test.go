@@ -0,0 +1,96 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+	"github.com/torrance/libtorrent/metainfo"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestStatus(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+
+	s := tor.Status()
+	if s.Name != "test.txt" || s.State != Stopped {
+		t.Error("Incorrect name or state: ", s.Name, s.State)
+	}
+	if s.TotalBytes != 36880 || s.WantedBytes != 36880 || s.DoneBytes != 0 || s.Progress() != 0 {
+		t.Error("Incorrect byte counts: ", s.TotalBytes, s.WantedBytes, s.DoneBytes)
+	}
+	if s.Pieces.Length() != 2 || s.Pieces.SumTrue() != 0 {
+		t.Error("Incorrect piece bitfield: ", s.Pieces.Bytes())
+	}
+	if s.ETA != -1 {
+		t.Error("ETA should be unknown with no download rate, got: ", s.ETA)
+	}
+	if len(s.Files) != 1 || s.Files[0].Length != 36880 {
+		t.Error("Incorrect file status: ", s.Files)
+	}
+
+	tor.Start()
+	connectTestPeer(tor)
+	s = tor.Status()
+	if s.State != Leeching || s.Peers != 1 || s.Seeds != 0 {
+		t.Error("Incorrect state or peer counts: ", s.State, s.Peers, s.Seeds)
+	}
+	if s.ActiveTime <= 0 {
+		t.Error("Active time not counting: ", s.ActiveTime)
+	}
+
+	// The snapshot must not change underneath the caller
+	s.Pieces.SetTrue(0)
+	if tor.havePiece(0) {
+		t.Error("Status bitfield is not a copy")
+	}
+}
+
+func TestStatusCompleteTorrent(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	dst, _ := os.Create(filepath.Join(tmpDir, "test.txt"))
+	src, _ := os.Open(filepath.Join("testData", "test.txt"))
+	io.Copy(dst, src)
+	dst.Close()
+	src.Close()
+
+	tor, err := NewTorrent(testMetainfo(), &Config{RootDirectory: tmpDir})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer tor.Stop()
+
+	s := tor.Status()
+	if s.DoneBytes != 36880 || s.Progress() != 1 || s.ETA != 0 || tor.Left() != 0 {
+		t.Error("Complete torrent reported incorrect progress: ", s.DoneBytes, s.ETA, tor.Left())
+	}
+	if s.Files[0].DoneBytes != 36880 {
+		t.Error("Incorrect file progress: ", s.Files[0])
+	}
+}
+
+func TestFileProgress(t *testing.T) {
+	// Three files of 4, 3 and 6 bytes with 3 byte pieces: [123][4|56][7|89][ABC][D]
+	m := &metainfo.Metainfo{PieceLength: 3, PieceCount: 5}
+	for _, length := range []int64{4, 3, 6} {
+		m.Files = append(m.Files, struct {
+			Length int64
+			Path   string
+		}{Length: length})
+	}
+	tor := &Torrent{meta: m, filePaths: make([]string, 3)}
+
+	bitf := bitfield.NewBitfield(5)
+	bitf.SetTrue(1)
+	bitf.SetTrue(4)
+	files := tor.fileProgress(bitf)
+	if files[0].DoneBytes != 1 || files[1].DoneBytes != 2 || files[2].DoneBytes != 1 {
+		t.Error("Incorrect file progress: ", files)
+	}
+	if tor.bytesDone(bitf) != 4 {
+		t.Error("Incorrect bytes done: ", tor.bytesDone(bitf))
+	}
+}
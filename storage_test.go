@@ -0,0 +1,107 @@
+package libtorrent
+
+import (
+	"bytes"
+	"github.com/torrance/libtorrent/filestore"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// failingStorage fails to open files named fail, and counts how many opened files are
+// still open.
+type failingStorage struct {
+	*filestore.MemoryStorage
+	fail string
+	open int
+}
+
+type countedStorer struct {
+	filestore.TorrentStorer
+	storage *failingStorage
+}
+
+func (s *failingStorage) Open(path string, length int64) (filestore.TorrentStorer, error) {
+	if strings.HasSuffix(path, s.fail) {
+		return nil, os.ErrPermission
+	}
+	tfile, err := s.MemoryStorage.Open(path, length)
+	if err != nil {
+		return nil, err
+	}
+	s.open++
+	return countedStorer{tfile, s}, nil
+}
+
+func (c countedStorer) Close() error {
+	c.storage.open--
+	return nil
+}
+
+func TestOpenStorageFailureClosesFiles(t *testing.T) {
+	m := testMetainfo()
+	m.Files[0].Length = 20000
+	m.Files[0].Path = "a.txt"
+	m.Files = append(m.Files, m.Files[0])
+	m.Files[1].Length, m.Files[1].Path = 16880, "b.txt"
+
+	storage := &failingStorage{MemoryStorage: filestore.NewMemoryStorage(), fail: "b.txt"}
+	if _, err := NewTorrent(m, &Config{Storage: storage}); err == nil {
+		t.Fatal("Expected error opening storage")
+	}
+	if storage.open != 0 {
+		t.Error("Files left open: ", storage.open)
+	}
+}
+
+func TestMemoryStorageTorrent(t *testing.T) {
+	storage := filestore.NewMemoryStorage()
+	tor, err := NewTorrent(testMetainfo(), &Config{Storage: storage})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer tor.Stop()
+	sub := tor.Subscribe(StatusEvents)
+	defer sub.Close()
+	tor.Start()
+
+	data := testData(t)
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.seed(t)
+	for i := 0; i < 3; i++ {
+		rp.respond(t, rp.expectRequest(t), data)
+	}
+	expectEvents(t, sub, StateChangedEvent, StateChangedEvent, TorrentFinishedEvent)
+
+	if !bytes.Equal(storage.File("test.txt").Bytes(), data) {
+		t.Error("Data not stored in memory")
+	}
+
+	// A new torrent using the same storage finds the data already there
+	tor.Stop()
+	again, err := NewTorrent(testMetainfo(), &Config{Storage: storage})
+	if err != nil || !again.complete() {
+		t.Error("Stored data not found by new torrent: ", err)
+	}
+	if err := again.deleteFiles(); err != nil || storage.File("test.txt") != nil {
+		t.Error("Failed to delete files: ", err)
+	}
+}
+
+func TestLazyAllocationTorrent(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+
+	tor, err := NewTorrent(testMetainfo(), &Config{RootDirectory: tmpDir, Allocation: filestore.AllocateLazy})
+	if err != nil {
+		t.Fatal("Could not create torrent: ", err)
+	}
+	defer tor.Stop()
+	if _, err := os.Stat(filepath.Join(tmpDir, "test.txt")); !os.IsNotExist(err) {
+		t.Error("File created before any data was downloaded")
+	}
+	if tor.Status().DoneBytes != 0 {
+		t.Error("Unwritten file has verified pieces")
+	}
+}
@@ -0,0 +1,207 @@
+package libtorrent
+
+import (
+	"github.com/torrance/libtorrent/bitfield"
+	"sync"
+)
+
+// superSeeder reveals a seed's pieces a few at a time (BEP 16). Each peer is sent an
+// empty bitfield and then offered a single piece with a have message. It is only offered
+// another once the piece has been seen to spread, by another peer announcing it, so the
+// seed uploads each piece as few times as possible and the swarm does the rest.
+type superSeeder struct {
+	offered map[*peer]int          // Piece currently offered to each peer
+	allowed map[*peer]map[int]bool // Every piece offered to each peer, which it may request
+	mutex   sync.Mutex
+}
+
+func newSuperSeeder() *superSeeder {
+	return &superSeeder{
+		offered: make(map[*peer]int),
+		allowed: make(map[*peer]map[int]bool),
+	}
+}
+
+// SuperSeeding returns true if super-seeding is enabled.
+func (t *Torrent) SuperSeeding() bool {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.superSeed != nil
+}
+
+// SetSuperSeeding enables or disables super-seeding (BEP 16). It only takes effect
+// whilst seeding, and only for peers that connect afterwards. Disabling it reveals every
+// piece to the peers that were being super-seeded.
+func (t *Torrent) SetSuperSeeding(enabled bool) {
+	t.stateLock.Lock()
+	ss := t.superSeed
+	if enabled && ss == nil {
+		t.superSeed = newSuperSeeder()
+	} else if !enabled {
+		t.superSeed = nil
+	}
+	t.stateLock.Unlock()
+
+	if enabled || ss == nil {
+		return
+	}
+	bitf := t.bitfield()
+	for _, p := range ss.peers() {
+		has := p.Bitfield()
+		for i := 0; i < bitf.Length(); i++ {
+			if bitf.Get(i) && !ss.isAllowed(p, i) && (has == nil || !has.Get(i)) {
+				p.Send(&haveMessage{pieceIndex: uint32(i)})
+			}
+		}
+	}
+}
+
+// superSeeder returns the super-seeder, if super-seeding is enabled.
+func (t *Torrent) superSeeder() *superSeeder {
+	t.stateLock.Lock()
+	defer t.stateLock.Unlock()
+	return t.superSeed
+}
+
+// superSeedPeer starts super-seeding a newly connected peer, which has been sent an
+// empty bitfield in place of our own.
+func (t *Torrent) superSeedPeer(ss *superSeeder, p *peer) {
+	ss.mutex.Lock()
+	ss.allowed[p] = make(map[int]bool)
+	ss.mutex.Unlock()
+	t.superSeedOffer(ss, p)
+}
+
+// superSeedAllows returns true if the peer may request the piece.
+func (t *Torrent) superSeedAllows(p *peer, index int) bool {
+	ss := t.superSeeder()
+	return ss == nil || ss.isAllowed(p, index)
+}
+
+// superSeedHave handles a have message from a peer. Peers whose offered piece it is
+// are offered a new one, as it has spread. The peer itself waits for its piece to
+// spread in turn, unless there is no other peer for it to spread to.
+func (t *Torrent) superSeedHave(from *peer, index int) {
+	ss := t.superSeeder()
+	if ss == nil {
+		return
+	}
+	for _, p := range ss.spreadTo(from, func(i int) bool { return i == index }) {
+		t.superSeedOffer(ss, p)
+	}
+	if len(t.peers()) <= 1 && ss.offeredNow(from, index) {
+		t.superSeedOffer(ss, from)
+	}
+}
+
+// superSeedBitfield handles a bitfield from a peer, which counts as announcing every
+// piece in it. If the peer already had the piece offered to it, it is offered another.
+func (t *Torrent) superSeedBitfield(from *peer, bitf *bitfield.Bitfield) {
+	ss := t.superSeeder()
+	if ss == nil {
+		return
+	}
+	for _, p := range ss.spreadTo(from, bitf.Get) {
+		t.superSeedOffer(ss, p)
+	}
+	ss.mutex.Lock()
+	index, offered := ss.offered[from]
+	_, seeded := ss.allowed[from]
+	ss.mutex.Unlock()
+	if seeded && (!offered || bitf.Get(index)) {
+		t.superSeedOffer(ss, from)
+	}
+}
+
+// superSeedOffer offers the peer the rarest piece it doesn't have, preferring pieces not
+// currently offered to anybody else.
+func (t *Torrent) superSeedOffer(ss *superSeeder, p *peer) {
+	has := p.Bitfield()
+	counts := make([]int, t.meta.PieceCount)
+	for _, q := range t.peers() {
+		if bitf := q.Bitfield(); bitf != nil {
+			for i := range counts {
+				if bitf.Get(i) {
+					counts[i]++
+				}
+			}
+		}
+	}
+
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	if _, ok := ss.allowed[p]; !ok {
+		// Disconnected, or no longer being super-seeded
+		return
+	}
+	for q, index := range ss.offered {
+		if q != p {
+			// Count outstanding offers as copies, so they go to different peers
+			counts[index]++
+		}
+	}
+	best := -1
+	for i := range counts {
+		if (has != nil && has.Get(i)) || ss.allowed[p][i] || !t.havePiece(i) {
+			continue
+		}
+		if best == -1 || counts[i] < counts[best] {
+			best = i
+		}
+	}
+	if best == -1 {
+		delete(ss.offered, p)
+		return
+	}
+	ss.offered[p] = best
+	ss.allowed[p][best] = true
+	logger.Debug("Super-seeding piece %d to peer %s", best, p.name)
+	p.Send(&haveMessage{pieceIndex: uint32(best)})
+}
+
+// spreadTo returns the peers, other than from, whose offered piece from has announced.
+func (ss *superSeeder) spreadTo(from *peer, has func(int) bool) (spread []*peer) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for p, index := range ss.offered {
+		if p != from && has(index) {
+			spread = append(spread, p)
+		}
+	}
+	return
+}
+
+// offeredNow returns true if index is the piece currently offered to p.
+func (ss *superSeeder) offeredNow(p *peer, index int) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	current, ok := ss.offered[p]
+	return ok && current == index
+}
+
+// isAllowed returns true if the peer may request the piece: it isn't being super-seeded,
+// or the piece has been offered to it.
+func (ss *superSeeder) isAllowed(p *peer, index int) bool {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	allowed, ok := ss.allowed[p]
+	return !ok || allowed[index]
+}
+
+// peers returns the peers being super-seeded.
+func (ss *superSeeder) peers() (peers []*peer) {
+	ss.mutex.Lock()
+	defer ss.mutex.Unlock()
+	for p := range ss.allowed {
+		peers = append(peers, p)
+	}
+	return
+}
+
+// remove forgets a disconnected peer.
+func (ss *superSeeder) remove(p *peer) {
+	ss.mutex.Lock()
+	delete(ss.offered, p)
+	delete(ss.allowed, p)
+	ss.mutex.Unlock()
+}
@@ -0,0 +1,105 @@
+package libtorrent
+
+import (
+	"testing"
+)
+
+// expectHave waits for the torrent to announce a piece, returning its index.
+func (rp *testRemotePeer) expectHave(t *testing.T) int {
+	for {
+		switch msg := rp.expect(t).(type) {
+		case *haveMessage:
+			return int(msg.pieceIndex)
+		case *unchokeMessage, *chokeMessage:
+		default:
+			t.Fatalf("Expected have, got %T", msg)
+		}
+	}
+}
+
+func TestSuperSeeding(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, tmpDir)
+	defer tor.Stop()
+	tor.SetSuperSeeding(true)
+	tor.Start()
+
+	// Each peer sees an empty bitfield, then a single piece
+	first := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	if msg, ok := first.expect(t).(*bitfieldMessage); !ok || msg.bitf.SumTrue() != 0 {
+		t.Fatal("Expected empty bitfield, got ", msg)
+	}
+	x := first.expectHave(t)
+
+	// Pieces may only be requested once offered
+	first.send(t, &interestedMessage{})
+	first.send(t, &requestMessage{pieceIndex: uint32(1 - x), blockOffset: 0, blockLength: blockSize})
+	first.send(t, &requestMessage{pieceIndex: uint32(x), blockOffset: 0, blockLength: blockSize})
+	for {
+		msg := first.expect(t)
+		if _, ok := msg.(*unchokeMessage); ok {
+			continue
+		}
+		if piece, ok := msg.(*pieceMessage); !ok || int(piece.pieceIndex) != x {
+			t.Fatal("Expected only the offered piece, got ", msg)
+		}
+		break
+	}
+
+	// A second peer is offered the other piece
+	second := newTestRemotePeer(tor, "-TR2940-mnopqrstuvwx")
+	if msg, ok := second.expect(t).(*bitfieldMessage); !ok || msg.bitf.SumTrue() != 0 {
+		t.Fatal("Expected empty bitfield, got ", msg)
+	}
+	if y := second.expectHave(t); y != 1-x {
+		t.Fatal("Second peer offered the same piece: ", y)
+	}
+
+	// The first peer downloading its piece isn't enough for another, but seeing the
+	// piece arrive at the second peer is
+	first.send(t, &haveMessage{pieceIndex: uint32(x)})
+	second.send(t, &haveMessage{pieceIndex: uint32(x)})
+	if next := first.expectHave(t); next != 1-x {
+		t.Fatal("Expected the remaining piece, got ", next)
+	}
+	if !tor.superSeedAllows(peerNamed(t, tor, "-TR2940-abcdefghijkl"), 1-x) {
+		t.Error("Offered piece not allowed")
+	}
+
+	// Without super-seeding, new peers see every piece
+	tor.SetSuperSeeding(false)
+	third := newTestRemotePeer(tor, "-TR2940-yzabcdefghij")
+	if msg, ok := third.expect(t).(*bitfieldMessage); !ok || msg.bitf.SumTrue() != 2 {
+		t.Fatal("Expected full bitfield, got ", msg)
+	}
+}
+
+func TestSuperSeedingLonePeer(t *testing.T) {
+	tmpDir, cleanup := tempDir(t)
+	defer cleanup()
+	tor := newTestSeed(t, tmpDir)
+	defer tor.Stop()
+	tor.SetSuperSeeding(true)
+	tor.Start()
+
+	rp := newTestRemotePeer(tor, "-TR2940-abcdefghijkl")
+	rp.expect(t)
+	x := rp.expectHave(t)
+	// With nobody else to pass it on to, the next piece follows straight away
+	rp.send(t, &haveMessage{pieceIndex: uint32(x)})
+	if next := rp.expectHave(t); next != 1-x {
+		t.Fatal("Expected the remaining piece, got ", next)
+	}
+}
+
+// peerNamed returns the connected peer with the given peer ID.
+func peerNamed(t *testing.T, tor *Torrent, id string) *peer {
+	for _, p := range tor.peers() {
+		if string(p.id) == id {
+			return p
+		}
+	}
+	t.Fatal("No peer ", id)
+	return nil
+}
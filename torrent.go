@@ -2,14 +2,19 @@ package libtorrent
 
 import (
 	"bytes"
+	"context"
+	"errors"
 	"fmt"
 	"github.com/op/go-logging"
 	"github.com/torrance/libtorrent/bitfield"
 	"github.com/torrance/libtorrent/filestore"
 	"github.com/torrance/libtorrent/metainfo"
 	"github.com/torrance/libtorrent/tracker"
+	"io"
 	"math/rand"
 	"net"
+	"net/netip"
+	"sort"
 	"sync"
 	"time"
 )
@@ -18,191 +23,487 @@ const (
 	Stopped = iota
 	Leeching
 	Seeding
+	Checking
+	Paused
+	Error
+	Queued // Waiting for its Session to start it
 )
 
-var PeerId = []byte(fmt.Sprintf("libt-%15d", rand.Int63()))[0:20]
 var logger = logging.MustGetLogger("libtorrent")
 
 type Torrent struct {
 	meta             *metainfo.Metainfo
 	fileStore        *filestore.FileStore
+	disk             *diskIO
 	config           *Config
 	bitf             *bitfield.Bitfield
+	bitfLock         sync.RWMutex
+	pieceNotify      chan struct{} // Closed and replaced whenever bitf changes
+	repicked         chan struct{} // Wakes the peer loop to request blocks
 	swarm            []*peer
-	incomingPeer     chan *peer
-	incomingPeerAddr chan string
-	swarmTally       swarmTally
+	swarmLock        sync.RWMutex
+	incomingPeerAddr chan netip.AddrPort
+	picker           *piecePicker
 	readChan         chan peerDouble
 	trackers         []*tracker.Tracker
 	state            int
+	err              error
+	ctx              context.Context
+	cancel           context.CancelFunc
 	stateLock        sync.Mutex
+	lifecycleLock    sync.Mutex // Serialises Start, Stop, Pause and Resume
+	wg               sync.WaitGroup
+	limits           *limits
+	events           *eventBus
+	stats            *transferStats
+	bans             *banList      // Peers that have sent corrupt data
+	pool             *peerPool     // Addresses of peers we could connect to
+	activeSince      time.Time     // When the current run started
+	activeTime       time.Duration // Total time spent running in previous runs
+	seedingSince     time.Time     // When the torrent last started seeding
+	seedingTime      time.Duration // Total time spent seeding in previous spells
+	goals            SeedingGoals  // When to stop seeding
+	removeSelf       func()        // Set by a Session to remove the torrent from it
+	autoManaged      bool          // Started and queued by a Session
+	superSeed        *superSeeder  // Nil unless super-seeding
+	peerId           []byte        // Sent in handshakes and announces
+	key              int32         // Sent in announces
+	root             string        // Directory holding the files, when stored on disk
+	filePaths        []string      // Path of each file beneath root, which may be renamed
 }
 
 func NewTorrent(m *metainfo.Metainfo, config *Config) (tor *Torrent, err error) {
+	return newTorrent(m, config, newLimits(config), nil)
+}
+
+// newTorrent creates a torrent whose connection and rate limits are governed by lim,
+// which may be shared with other torrents. If rd is not nil the torrent is restored
+// from it.
+func newTorrent(m *metainfo.Metainfo, config *Config, lim *limits, rd *ResumeData) (tor *Torrent, err error) {
 	tor = &Torrent{
 		config:           config,
 		meta:             m,
-		incomingPeer:     make(chan *peer, 100),
-		incomingPeerAddr: make(chan string, 100),
+		limits:           lim,
+		incomingPeerAddr: make(chan netip.AddrPort, 100),
 		readChan:         make(chan peerDouble, 50),
+		pieceNotify:      make(chan struct{}),
+		repicked:         make(chan struct{}, 1),
 		state:            Stopped,
+		events:           newEventBus(nil),
+		stats:            newTransferStats(nil),
+		bans:             newBanList(),
+		goals:            config.SeedingGoals,
+		key:              rand.Int31(),
+		root:             config.RootDirectory,
+	}
+	fingerprint := config.Fingerprint
+	if fingerprint == (Fingerprint{}) {
+		fingerprint = DefaultFingerprint
+	}
+	if tor.peerId, err = fingerprint.NewPeerId(); err != nil {
+		return
+	}
+	tor.pool = newPeerPool(config.MaxHalfOpen, lim.external.get)
+	if config.SuperSeeding {
+		tor.superSeed = newSuperSeeder()
+	}
+	for _, file := range m.Files {
+		tor.filePaths = append(tor.filePaths, file.Path)
+	}
+	if rd != nil {
+		if err = tor.applyResumeData(rd); err != nil {
+			return
+		}
 	}
 
+	if err = tor.openStorage(); err != nil {
+		return
+	}
+	tor.setState(Stopped)
+	return
+}
+
+// closeStorers closes the files opened so far when opening the storage fails, so that
+// failed restarts don't leak them.
+func closeStorers(tfiles []filestore.TorrentStorer) {
+	for _, tfile := range tfiles {
+		if closer, ok := tfile.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// openStorage opens (or creates) the torrent's files and validates any existing data.
+func (tor *Torrent) openStorage() (err error) {
+	tor.setState(Checking)
+
 	// Extract file information to create a slice of torrentStorers
+	storage := tor.storageProvider()
+	_, paths := tor.paths()
 	tfiles := make([]filestore.TorrentStorer, 0)
 	var tfile filestore.TorrentStorer
-	for _, file := range tor.meta.Files {
-		if tfile, err = filestore.NewTorrentFile(tor.config.RootDirectory, file.Path, file.Length); err != nil {
-			logger.Error("Failed to create file %s: %s", file.Path, err)
+	for i, file := range tor.meta.Files {
+		if tfile, err = storage.Open(paths[i], file.Length); err != nil {
+			logger.Error("Failed to create file %s: %s", paths[i], err)
+			tor.publish(Event{Type: FileErrorEvent, Err: err})
+			closeStorers(tfiles)
 			return
 		}
 		tfiles = append(tfiles, tfile)
 	}
 
 	// Now we can create our filestore.
-	if tor.fileStore, err = filestore.NewFileStore(tfiles, tor.meta.Pieces, tor.meta.PieceLength); err != nil {
+	fileStore, err := filestore.NewFileStore(tfiles, tor.meta.Pieces, tor.meta.PieceLength)
+	if err != nil {
 		logger.Error("Failed to create filestore: %s", err)
+		closeStorers(tfiles)
 		return
 	}
+	tor.stateLock.Lock()
+	tor.fileStore = fileStore
+	tor.disk = newDiskIO(fileStore, tor.config.DiskCacheSize, tor.config.DiskWorkers)
+	tor.stateLock.Unlock()
 
-	if tor.bitf, err = tor.fileStore.Validate(); err != nil {
+	bitf, err := tor.fileStore.Validate()
+	if err != nil {
 		logger.Error("Failed to run validation on new filestore: %s", err)
+		tor.publish(Event{Type: FileErrorEvent, Err: err})
 		return
 	}
+	tor.bitfLock.Lock()
+	tor.bitf = bitf
+	tor.notifyPieces()
+	tor.bitfLock.Unlock()
+	if tor.picker == nil {
+		tor.picker = newPiecePicker(bitf, tor.meta.PieceLength, tor.totalLength())
+	} else {
+		tor.picker.Reset(bitf)
+	}
 
 	return
 }
 
-func (tor *Torrent) Start() {
+// Start begins downloading or seeding the torrent. A stopped torrent has its files
+// reopened and rechecked first, and a paused or queued torrent is resumed.
+func (tor *Torrent) Start() (err error) {
+	tor.lifecycleLock.Lock()
+	defer tor.lifecycleLock.Unlock()
+
+	switch tor.State() {
+	case Leeching, Seeding, Checking:
+		return
+	case Paused, Queued:
+		tor.run()
+		return
+	}
+
+	if tor.fileStore == nil {
+		if err = tor.openStorage(); err != nil {
+			tor.setError(err)
+			return
+		}
+	}
+	tor.run()
+	return
+}
+
+// Stop disconnects all peers, announces STOPPED to the trackers and closes the torrent's
+// files. A stopped torrent can be started again with Start.
+func (tor *Torrent) Stop() (err error) {
+	tor.lifecycleLock.Lock()
+	defer tor.lifecycleLock.Unlock()
+
+	switch tor.State() {
+	case Leeching, Seeding:
+		tor.halt()
+	}
+
+	err = tor.closeStorage()
+	tor.setState(Stopped)
+	return
+}
+
+// closeStorage closes the torrent's files, if they are open. The caller must hold
+// lifecycleLock.
+func (tor *Torrent) closeStorage() (err error) {
+	if tor.fileStore == nil {
+		return
+	}
+	tor.stateLock.Lock()
+	fileStore, disk := tor.fileStore, tor.disk
+	tor.fileStore, tor.disk = nil, nil
+	tor.stateLock.Unlock()
+
+	// Finish any outstanding disk jobs before closing the files beneath them
+	disk.Close()
+	if err = fileStore.Close(); err != nil {
+		logger.Error("Failed to close files for %s: %s", tor.meta.Name, err)
+	}
+	return
+}
+
+// Pause disconnects all peers and announces STOPPED to the trackers, but keeps the
+// torrent's files open so that it can be quickly resumed.
+func (tor *Torrent) Pause() (err error) {
+	tor.lifecycleLock.Lock()
+	defer tor.lifecycleLock.Unlock()
+
+	switch tor.State() {
+	case Paused:
+		return
+	case Leeching, Seeding:
+		tor.halt()
+		tor.setState(Paused)
+		return
+	case Queued:
+		// Taking it out of the queue until it is resumed
+		tor.setState(Paused)
+		return
+	}
+	return errors.New(fmt.Sprintf("Pause: torrent is not running (state %d)", tor.State()))
+}
+
+// Resume restarts a paused torrent.
+func (tor *Torrent) Resume() (err error) {
+	tor.lifecycleLock.Lock()
+	defer tor.lifecycleLock.Unlock()
+
+	if tor.State() != Paused {
+		return errors.New(fmt.Sprintf("Resume: torrent is not paused (state %d)", tor.State()))
+	}
+	tor.run()
+	return
+}
+
+// run starts the trackers and the torrent's goroutines. The caller must hold lifecycleLock.
+func (tor *Torrent) run() {
 	logger.Info("Torrent starting: %s", tor.meta.Name)
 
-	// Set initial state
+	ctx, cancel := context.WithCancel(context.Background())
+
 	tor.stateLock.Lock()
-	if tor.bitf.SumTrue() == tor.bitf.Length() {
-		tor.state = Seeding
+	tor.ctx, tor.cancel = ctx, cancel
+	tor.err = nil
+	tor.activeSince = time.Now()
+	tor.stateLock.Unlock()
+
+	// Set initial state
+	if tor.complete() {
+		tor.setState(Seeding)
 	} else {
-		tor.state = Leeching
+		tor.setState(Leeching)
 	}
-	tor.stateLock.Unlock()
 
 	// Create trackers
+	var trackers []*tracker.Tracker
 	for _, tkr := range tor.meta.AnnounceList {
-		tkr, err := tracker.NewTracker(tkr, tor, tor.incomingPeerAddr)
+		tkr, err := tracker.NewTracker(tkr, trackerObserver{tor}, tor.incomingPeerAddr)
 		if err != nil {
 			logger.Error("Failed to create tracker: %s", err)
 			continue
 		}
-		tor.trackers = append(tor.trackers, tkr)
+		trackers = append(trackers, tkr)
 		tkr.Start()
 	}
+	tor.stateLock.Lock()
+	tor.trackers = trackers
+	tor.stateLock.Unlock()
+
+	if tor.State() == Leeching {
+		tor.addWebSeeds(ctx)
+	}
+
+	tor.wg.Add(4)
 
 	// Tracker loop
 	go func() {
+		defer tor.wg.Done()
 		for {
-			peerAddr := <-tor.incomingPeerAddr
-			// Only attempt to connect to other peers whilst leeching
-			if tor.state != Leeching {
-				continue
+			var peerAddr netip.AddrPort
+			select {
+			case peerAddr = <-tor.incomingPeerAddr:
+			case <-ctx.Done():
+				return
 			}
-			go func() {
-				conn, err := net.Dial("tcp", peerAddr)
-				if err != nil {
-					logger.Debug("Failed to connect to tracker peer address %s: %s", peerAddr, err)
-					return
-				}
-				tor.AddPeer(conn, nil)
-			}()
+			tor.addCandidate(ctx, peerAddr, SourceTracker)
 		}
 	}()
 
+	// Seeding loop
+	go func() {
+		defer tor.wg.Done()
+		tor.seed(ctx)
+	}()
+
 	// Peer loop
 	go func() {
+		defer tor.wg.Done()
 		for {
 			select {
-			case peer := <-tor.incomingPeer:
-				// Add to swarm slice
-				logger.Debug("Connected to new peer: %s", peer.name)
-				tor.swarm = append(tor.swarm, peer)
 			case <-time.After(time.Second * 5):
-				// Unchoke interested peers
-				// TODO: Implement maximum unchoked peers
-				// TODO: Implement optimistic unchoking algorithm
-				for _, peer := range tor.swarm {
-					if peer.GetPeerInterested() && peer.GetAmChoking() {
-						logger.Debug("Unchoking peer %s", peer.name)
-						peer.write <- &unchokeMessage{}
-						peer.SetAmChoking(false)
-					}
-				}
+			case <-tor.repicked:
+			case <-ctx.Done():
+				return
+			}
+			// The fastest peers pick first, so they are given any pieces with deadlines
+			peers := tor.peers()
+			sort.Slice(peers, func(i, j int) bool {
+				return peers[i].stats.downloaded.Rate() > peers[j].stats.downloaded.Rate()
+			})
+			for _, peer := range peers {
+				tor.rechoke(peer)
+				// Pick up any blocks abandoned by other peers
+				tor.requestBlocks(peer)
 			}
+			// Retry any addresses whose backoff has expired
+			tor.connectPeers(ctx)
 		}
 	}()
 
 	// Receive loop
 	go func() {
+		defer tor.wg.Done()
 		for {
-			peerDouble := <-tor.readChan
-			peer := peerDouble.peer
-			msg := peerDouble.msg
-
-			switch msg := msg.(type) {
-			case *chokeMessage:
-				logger.Debug("Peer %s has choked us", peer.name)
-				peer.SetPeerChoking(true)
-			case *unchokeMessage:
-				logger.Debug("Peer %s has unchoked us", peer.name)
-				peer.SetPeerChoking(false)
-			case *interestedMessage:
-				logger.Debug("Peer %s has said it is interested", peer.name)
-				peer.SetPeerInterested(true)
-			//case *uninterestedMessage:
-			//	logger.Debug("Peer %s has said it is uninterested", peer.name)
-			case *haveMessage:
-				pieceIndex := int(msg.pieceIndex)
-				logger.Debug("Peer %s has piece %d", peer.name, pieceIndex)
-				if pieceIndex >= tor.meta.PieceCount {
-					logger.Debug("Peer %s sent an out of range have message")
-					// TODO: Shutdown client
-				}
-				peer.HasPiece(pieceIndex)
-				// TODO: Update swarmTally
-			case *bitfieldMessage:
-				logger.Debug("Peer %s has sent us its bitfield", peer.name)
-				// Raw parsed bitfield has no actual length. Let's try to set it.
-				if err := msg.bitf.SetLength(tor.meta.PieceCount); err != nil {
-					logger.Error(err.Error())
-					// TODO: Shutdown client
-					break
-				}
-				peer.SetBitfield(msg.bitf)
-				tor.swarmTally.AddBitfield(msg.bitf)
-			case *requestMessage:
-				if peer.GetAmChoking() || !tor.bitf.Get(int(msg.pieceIndex)) || msg.blockLength > 32768 {
-					logger.Debug("Peer %s has asked for a block (%d, %d, %d), but we are rejecting them", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
-					// Add naughty points
-					break
-				}
-				logger.Debug("Peer %s has asked for a block (%d, %d, %d), going to fetch block", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
-				block, err := tor.fileStore.GetBlock(int(msg.pieceIndex), int64(msg.blockOffset), int64(msg.blockLength))
-				if err != nil {
-					logger.Error(err.Error())
-					break
-				}
-				logger.Debug("Peer %s has asked for a block (%d, %d, %d), sending it to them", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
-				peer.write <- &pieceMessage{
-					pieceIndex:  msg.pieceIndex,
-					blockOffset: msg.blockOffset,
-					data:        block,
-				}
-				// case *pieceMessage:
-				// case *cancelMessage:
-			default:
-				logger.Debug("Peer %s sent unknown message", peer.name)
+			select {
+			case peerDouble := <-tor.readChan:
+				tor.receive(peerDouble.peer, peerDouble.msg)
+			case <-ctx.Done():
+				return
 			}
 		}
 	}()
 }
 
+// halt cancels the torrent's goroutines, disconnects all peers and stops the trackers,
+// waiting (for a bounded time) for their final STOPPED announces. The caller must hold
+// lifecycleLock.
+func (tor *Torrent) halt() {
+	logger.Info("Torrent stopping: %s", tor.meta.Name)
+
+	tor.stateLock.Lock()
+	tor.cancel()
+	tor.activeTime += time.Since(tor.activeSince)
+	trackers := tor.trackers
+	tor.trackers = nil
+	tor.stateLock.Unlock()
+
+	// Closing the connections unblocks any goroutine waiting to write to a peer
+	for _, p := range tor.peers() {
+		tor.removePeer(p)
+	}
+	tor.wg.Wait()
+	// Pieces still being verified may change our state, so let them finish first
+	tor.disk.Wait()
+
+	var wg sync.WaitGroup
+	for _, tkr := range trackers {
+		wg.Add(1)
+		go func(tkr *tracker.Tracker) {
+			tkr.Stop()
+			wg.Done()
+		}(tkr)
+	}
+	wg.Wait()
+}
+
+// receive handles a single message from peer. It is only called from the receive loop.
+func (tor *Torrent) receive(peer *peer, msg interface{}) {
+	switch msg := msg.(type) {
+	case *chokeMessage:
+		logger.Debug("Peer %s has choked us", peer.name)
+		peer.SetPeerChoking(true)
+		// Choking discards all of our outstanding requests
+		peer.ClearRequests()
+		tor.picker.Abandon(peer)
+	case *unchokeMessage:
+		logger.Debug("Peer %s has unchoked us", peer.name)
+		peer.SetPeerChoking(false)
+		tor.requestBlocks(peer)
+	case *interestedMessage:
+		logger.Debug("Peer %s has said it is interested", peer.name)
+		peer.SetPeerInterested(true)
+		tor.rechoke(peer)
+	case *uninterestedMessage:
+		logger.Debug("Peer %s has said it is uninterested", peer.name)
+		peer.SetPeerInterested(false)
+		tor.rechoke(peer)
+	case *haveMessage:
+		pieceIndex := int(msg.pieceIndex)
+		logger.Debug("Peer %s has piece %d", peer.name, pieceIndex)
+		if pieceIndex >= tor.meta.PieceCount {
+			logger.Debug("Peer %s sent an out of range have message", peer.name)
+			// TODO: Shutdown client
+			break
+		}
+		if bitf := peer.Bitfield(); bitf == nil || !bitf.Get(pieceIndex) {
+			tor.picker.AddHave(pieceIndex)
+		}
+		peer.HasPiece(pieceIndex, tor.meta.PieceCount)
+		tor.superSeedHave(peer, pieceIndex)
+		tor.updateInterest(peer)
+		tor.requestBlocks(peer)
+	case *bitfieldMessage:
+		logger.Debug("Peer %s has sent us its bitfield", peer.name)
+		// Raw parsed bitfield has no actual length. Let's try to set it.
+		if err := msg.bitf.SetLength(tor.meta.PieceCount); err != nil {
+			logger.Error(err.Error())
+			// TODO: Shutdown client
+			break
+		}
+		if old := peer.Bitfield(); old != nil {
+			tor.picker.RemoveBitfield(old)
+		}
+		peer.SetBitfield(msg.bitf)
+		tor.picker.AddBitfield(msg.bitf)
+		tor.superSeedBitfield(peer, msg.bitf)
+		tor.updateInterest(peer)
+		tor.requestBlocks(peer)
+	case *requestMessage:
+		if peer.GetAmChoking() || !tor.havePiece(int(msg.pieceIndex)) || !tor.superSeedAllows(peer, int(msg.pieceIndex)) || msg.blockLength > 32768 {
+			logger.Debug("Peer %s has asked for a block (%d, %d, %d), but we are rejecting them", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
+			// Add naughty points
+			break
+		}
+		if !peer.reservePiece() {
+			logger.Debug("Peer %s has asked for a block (%d, %d, %d), but has too many queued already", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
+			break
+		}
+		logger.Debug("Peer %s has asked for a block (%d, %d, %d), going to fetch block", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
+		tor.disk.ReadBlock(int(msg.pieceIndex), int64(msg.blockOffset), int64(msg.blockLength), func(block []byte, err error) {
+			if err != nil {
+				logger.Error(err.Error())
+				tor.publish(Event{Type: FileErrorEvent, Piece: int(msg.pieceIndex), Err: err})
+				peer.releasePiece()
+				return
+			}
+			if peer.GetAmChoking() {
+				// Choking discards the peer's outstanding requests
+				peer.releasePiece()
+				return
+			}
+			logger.Debug("Peer %s has asked for a block (%d, %d, %d), sending it to them", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
+			peer.Send(&pieceMessage{
+				pieceIndex:  msg.pieceIndex,
+				blockOffset: msg.blockOffset,
+				data:        block,
+			})
+		})
+	case *pieceMessage:
+		logger.Debug("Peer %s has sent us a block (%d, %d, %d)", peer.name, msg.pieceIndex, msg.blockOffset, len(msg.data))
+		tor.receiveBlock(peer, msg)
+		tor.requestBlocks(peer)
+	case *cancelMessage:
+		if peer.CancelPiece(msg.pieceIndex, msg.blockOffset, msg.blockLength) {
+			logger.Debug("Peer %s has cancelled a block (%d, %d, %d)", peer.name, msg.pieceIndex, msg.blockOffset, msg.blockLength)
+		}
+	case *peerClosedMessage:
+		logger.Debug("Peer %s has disconnected", peer.name)
+		tor.removePeer(peer)
+	default:
+		logger.Debug("Peer %s sent unknown message", peer.name)
+	}
+}
+
 func (t *Torrent) String() string {
 	s := `Torrent: %x
     Name: '%s'
@@ -222,14 +523,171 @@ func (t *Torrent) State() (state int) {
 	return
 }
 
+// Err returns the error that put the torrent into the Error state, if any.
+func (t *Torrent) Err() (err error) {
+	t.stateLock.Lock()
+	err = t.err
+	t.stateLock.Unlock()
+	return
+}
+
+func (t *Torrent) setState(state int) {
+	t.stateLock.Lock()
+	old := t.state
+	t.state = state
+	t.seedClock(old, state)
+	t.stateLock.Unlock()
+
+	if old != state {
+		t.publish(Event{Type: StateChangedEvent, State: state})
+	}
+}
+
+func (t *Torrent) setError(err error) {
+	t.stateLock.Lock()
+	t.seedClock(t.state, Error)
+	t.state = Error
+	t.err = err
+	t.stateLock.Unlock()
+
+	t.publish(Event{Type: StateChangedEvent, State: Error, Err: err})
+}
+
+// Subscribe returns a subscription to this torrent's events in the given categories.
+// Slow subscribers miss events rather than holding up the torrent.
+func (t *Torrent) Subscribe(filter EventCategory) *Subscription {
+	return t.events.subscribe(filter)
+}
+
+func (t *Torrent) publish(ev Event) {
+	ev.InfoHash = t.meta.InfoHash
+	t.events.publish(ev)
+}
+
+// context returns the context of the current run, or nil if the torrent has never run.
+func (t *Torrent) context() (ctx context.Context) {
+	t.stateLock.Lock()
+	ctx = t.ctx
+	t.stateLock.Unlock()
+	return
+}
+
+// AddPeer takes over a connection to a peer. If hs is nil, we initiated the connection and
+// still need to receive the peer's handshake; otherwise the peer connected to us.
 func (t *Torrent) AddPeer(conn net.Conn, hs *handshake) {
+	if hs == nil {
+		t.addPeer(conn, nil, SourceUnknown, netip.AddrPort{})
+	} else {
+		t.addPeer(conn, hs, SourceIncoming, netip.AddrPort{})
+	}
+}
+
+// addPeerAddr adds the address of a peer found through source, if the torrent is running.
+func (t *Torrent) addPeerAddr(addr netip.AddrPort, source PeerSource) {
+	if ctx := t.context(); ctx != nil && ctx.Err() == nil {
+		t.addCandidate(ctx, addr, source)
+	}
+}
+
+// addCandidate adds the address of a peer found through source to the pool, and dials it
+// if we want more peers.
+func (t *Torrent) addCandidate(ctx context.Context, addr netip.AddrPort, source PeerSource) {
+	if !t.sourceAllowed(source) {
+		return
+	}
+	if t.limits.filter.blockedAddr(addr.Addr(), &t.limits.filter.peers) {
+		logger.Debug("Discarding blocked %s peer address %s", source, addr)
+		return
+	}
+	if t.pool.Add(addr, source) {
+		t.connectPeers(ctx)
+	}
+}
+
+// connectPeers dials addresses from the pool until the half-open or connection limit is
+// reached, or we have enough peers.
+func (t *Torrent) connectPeers(ctx context.Context) {
+	for t.wantPeers() && !t.limits.conns.Full() {
+		addr, source, ok := t.pool.Next()
+		if !ok {
+			return
+		}
+		go t.dial(ctx, addr, source)
+	}
+}
+
+// dial connects to a peer from the pool, recording the outcome in the pool.
+func (t *Torrent) dial(ctx context.Context, addr netip.AddrPort, source PeerSource) {
+	// Finishing frees a half-open slot for the next address
+	defer t.connectPeers(ctx)
+
+	if t.limits.filter.blockedAddr(addr.Addr(), &t.limits.filter.outgoing) || t.bans.Banned(addr.Addr().String()) {
+		t.pool.Remove(addr)
+		return
+	}
+	dialer := &net.Dialer{Timeout: time.Minute}
+	conn, err := dialer.DialContext(ctx, "tcp", addr.String())
+	if err != nil {
+		logger.Debug("Failed to connect to peer address %s: %s", addr, err)
+		if ctx.Err() != nil {
+			t.pool.Cancelled(addr)
+		} else {
+			t.pool.Failed(addr)
+		}
+		return
+	}
+	if !t.addPeer(conn, nil, source, addr) {
+		if ctx.Err() != nil || t.limits.conns.Full() {
+			t.pool.Cancelled(addr)
+		} else {
+			t.pool.Failed(addr)
+		}
+	}
+}
+
+// addPeer sets up a connection to a peer, returning false if it was dropped. dialAddr is
+// the pool address we dialed, if any.
+func (t *Torrent) addPeer(conn net.Conn, hs *handshake, source PeerSource, dialAddr netip.AddrPort) bool {
+	ctx := t.context()
+	if ctx == nil || ctx.Err() != nil {
+		logger.Debug("%s Torrent is not running, dropping peer", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	count := &t.limits.filter.incoming
+	if hs == nil {
+		count = &t.limits.filter.outgoing
+	}
+	if t.limits.filter.blocked(conn.RemoteAddr().String(), count) {
+		logger.Debug("%s Address is blocked, dropping peer", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	if !t.sourceAllowed(source) {
+		logger.Debug("%s Torrent is private, dropping %s peer", conn.RemoteAddr(), source)
+		conn.Close()
+		return false
+	}
+	if t.bans.Banned(addrKey(conn.RemoteAddr().String())) {
+		logger.Debug("%s Peer is banned, dropping connection", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+	if !t.limits.conns.Acquire() {
+		logger.Debug("%s Connection limit reached, dropping peer", conn.RemoteAddr())
+		conn.Close()
+		return false
+	}
+
 	// Set 60 second limit to connection attempt
 	conn.SetDeadline(time.Now().Add(time.Minute))
 
 	// Send handshake
-	if err := newHandshake(t.InfoHash()).BinaryDump(conn); err != nil {
+	if err := newHandshake(t.InfoHash(), t.peerId).BinaryDump(conn); err != nil {
 		logger.Debug("%s Failed to send handshake to connection: %s", conn.RemoteAddr(), err)
-		return
+		t.limits.conns.Release()
+		conn.Close()
+		return false
 	}
 
 	// If hs is nil, this means we've attempted to establish the connection and need to wait
@@ -238,39 +696,183 @@ func (t *Torrent) AddPeer(conn net.Conn, hs *handshake) {
 	if hs == nil {
 		if hs, err = parseHandshake(conn); err != nil {
 			logger.Debug("%s Failed to parse incoming handshake: %s", conn.RemoteAddr(), err)
-			return
+			t.limits.conns.Release()
+			conn.Close()
+			return false
 		} else if !bytes.Equal(hs.infoHash, t.InfoHash()) {
 			logger.Debug("%s Infohash did not match for connection", conn.RemoteAddr())
+			t.limits.conns.Release()
+			conn.Close()
+			return false
+		}
+	}
+
+	conn.SetDeadline(time.Time{})
+
+	peer := newPeer(ctx, hs, conn, source, t.readChan, t.limits, t.stats)
+	peer.dialAddr = dialAddr
+	ss := t.superSeeder()
+	if t.State() != Seeding {
+		ss = nil
+	}
+	if ss != nil {
+		// Reveal pieces one at a time, once the peer is in the swarm
+		peer.Send(&bitfieldMessage{bitf: bitfield.NewBitfield(t.meta.PieceCount)})
+	} else {
+		peer.Send(&bitfieldMessage{bitf: t.bitfield()})
+	}
+
+	// Stop or Pause may have been called during the handshake. Halting cancels the context
+	// before it clears the swarm, so checking under swarmLock is sufficient.
+	t.swarmLock.Lock()
+	if ctx.Err() != nil {
+		t.swarmLock.Unlock()
+		peer.Close()
+		t.limits.conns.Release()
+		return false
+	}
+	if dialAddr.IsValid() {
+		// Under swarmLock, so that removePeer can't report the disconnection first
+		t.pool.Connected(dialAddr)
+	}
+	t.swarm = append(t.swarm, peer)
+	t.swarmLock.Unlock()
+	logger.Debug("Connected to new peer: %s", peer.name)
+	t.publish(Event{Type: PeerConnectedEvent, Peer: peer.name})
+	if ss != nil {
+		t.superSeedPeer(ss, peer)
+	}
+	return true
+}
+
+// peers returns a copy of the current swarm.
+func (t *Torrent) peers() []*peer {
+	t.swarmLock.RLock()
+	defer t.swarmLock.RUnlock()
+	return append([]*peer(nil), t.swarm...)
+}
+
+// removePeer closes the peer's connection and drops it from the swarm, freeing its
+// connection slot.
+func (t *Torrent) removePeer(p *peer) {
+	p.Close()
+
+	t.swarmLock.Lock()
+	defer t.swarmLock.Unlock()
+	for i, q := range t.swarm {
+		if q == p {
+			t.swarm = append(t.swarm[:i], t.swarm[i+1:]...)
+			if p.conn != nil {
+				// Web seeds don't count towards the connection limit
+				t.limits.conns.Release()
+			}
+			if bitf := p.Bitfield(); bitf != nil {
+				t.picker.RemoveBitfield(bitf)
+			}
+			t.picker.Abandon(p)
+			if p.dialAddr.IsValid() {
+				t.pool.Disconnected(p.dialAddr)
+			}
+			if ss := t.superSeeder(); ss != nil {
+				ss.remove(p)
+			}
+			t.publish(Event{Type: PeerDisconnectedEvent, Peer: p.name})
 			return
 		}
 	}
+}
 
-	peer := newPeer(string(hs.peerId), conn, t.readChan)
-	peer.write <- &bitfieldMessage{bitf: t.bitf}
-	t.incomingPeer <- peer
+// deleteFiles removes the torrent's files from disk, along with any directories left empty.
+// The torrent must be stopped first.
+func (t *Torrent) deleteFiles() (err error) {
+	storage := t.storageProvider()
+	_, paths := t.paths()
+	for _, path := range paths {
+		if e := storage.Remove(path); e != nil {
+			err = e
+		}
+	}
+	return
+}
 
-	conn.SetDeadline(time.Time{})
+// storageProvider returns the configured storage, defaulting to files beneath the root
+// directory.
+func (t *Torrent) storageProvider() filestore.StorageProvider {
+	if t.config.Storage != nil {
+		return t.config.Storage
+	}
+	root, _ := t.paths()
+	return &filestore.DirectoryStorage{
+		Root:       root,
+		Allocation: t.config.Allocation,
+		Oversized:  t.config.OversizedFiles,
+	}
+}
+
+// trackerObserver passes the outcome of each tracker announce on as an event.
+type trackerObserver struct {
+	*Torrent
+}
+
+// SetExternalAddr records our address as seen by a tracker.
+func (o trackerObserver) SetExternalAddr(addr netip.Addr) {
+	o.limits.external.set(addr)
+}
+
+func (o trackerObserver) Announced(url string, peers int, err error) {
+	if err != nil {
+		o.publish(Event{Type: TrackerErrorEvent, Tracker: url, Err: err})
+	} else {
+		o.publish(Event{Type: TrackerAnnounceEvent, Tracker: url, Peers: peers})
+	}
 }
 
 func (t *Torrent) Downloaded() int64 {
-	// TODO:
-	return 0
+	return t.stats.downloaded.Total()
 }
 
 func (t *Torrent) Uploaded() int64 {
-	// TODO:
-	return 0
+	return t.stats.uploaded.Total()
 }
 
 func (t *Torrent) Left() int64 {
-	// TODO:
-	return 0
+	return t.totalLength() - t.bytesDone(t.bitfield())
 }
 
+// Port returns the port we announce: our listening port as mapped on the gateway if it
+// has been, or Config.Port.
 func (t *Torrent) Port() int16 {
+	if port := t.limits.external.getPort(); port != 0 {
+		return int16(port)
+	}
 	return t.config.Port
 }
 
+// PeerId returns the peer id we use for this torrent. Each torrent has its own, so that
+// peers can't link our torrents together, and it stays the same across restarts when
+// the torrent is restored from its resume data.
 func (t *Torrent) PeerId() []byte {
-	return PeerId
+	return t.peerId
+}
+
+// Key returns the key we send in announces, which lets trackers recognise us even if our
+// address changes. Like the peer id, it is kept in the resume data.
+func (t *Torrent) Key() int32 {
+	return t.key
+}
+
+// Private returns true if the torrent is private (BEP 27), so that its peers may only
+// come from the trackers in its metainfo.
+func (t *Torrent) Private() bool {
+	return t.meta.Private
+}
+
+// sourceAllowed returns true if peers found through source may be used. Private torrents
+// don't use DHT, peer exchange or local service discovery.
+func (t *Torrent) sourceAllowed(source PeerSource) bool {
+	switch source {
+	case SourceDHT, SourcePEX, SourceLSD:
+		return !t.meta.Private
+	}
+	return true
 }
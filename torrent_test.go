@@ -1,5 +1,15 @@
 package libtorrent
 
+import (
+	"github.com/torrance/libtorrent/metainfo"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"testing"
+	"time"
+)
+
 // import (
 // 	//"bytes"
 // 	//"fmt"
@@ -69,3 +79,186 @@ package libtorrent
 //	fmt.Println("Starting torrent...")
 //	tor.start()
 //}
+
+func tempDir(t *testing.T) (tmpDir string, cleanup func()) {
+	tmpDir, err := ioutil.TempDir("", "libtorrentTesting")
+	if err != nil {
+		t.Fatal("Could not create temporary directory to run tests: ", err)
+	}
+	return tmpDir, func() { os.RemoveAll(tmpDir) }
+}
+
+func newTestTorrent(t *testing.T) (tor *Torrent, cleanup func()) {
+	return newTestTorrentWith(t, testMetainfo())
+}
+
+func newTestTorrentWith(t *testing.T, m *metainfo.Metainfo) (tor *Torrent, cleanup func()) {
+	tmpDir, removeDir := tempDir(t)
+	tor, err := NewTorrent(m, &Config{RootDirectory: tmpDir})
+	if err != nil {
+		removeDir()
+		t.Fatal("Could not create torrent: ", err)
+	}
+	return tor, func() {
+		tor.Stop()
+		removeDir()
+	}
+}
+
+// connectTestPeer adds one end of a pipe to tor as an incoming peer. The returned channel
+// is closed once the torrent closes its end of the connection.
+func connectTestPeer(tor *Torrent) (closed chan struct{}) {
+	local, remote := net.Pipe()
+	closed = make(chan struct{})
+	go func() {
+		io.Copy(ioutil.Discard, remote)
+		close(closed)
+	}()
+	hs := &handshake{protocol: []byte("BitTorrent protocol"), infoHash: tor.InfoHash(), peerId: []byte("-TT0000-000000000000")}
+	tor.AddPeer(local, hs)
+	return
+}
+
+func TestTorrentLifecycle(t *testing.T) {
+	tor, cleanup := newTestTorrent(t)
+	defer cleanup()
+
+	if tor.State() != Stopped {
+		t.Fatal("New torrent not stopped, state: ", tor.State())
+	}
+	if err := tor.Resume(); err == nil {
+		t.Error("Resuming a stopped torrent should fail")
+	}
+	if err := tor.Pause(); err == nil {
+		t.Error("Pausing a stopped torrent should fail")
+	}
+
+	if err := tor.Start(); err != nil || tor.State() != Leeching {
+		t.Fatal("Failed to start torrent: ", err, tor.State())
+	}
+	closed := connectTestPeer(tor)
+	if len(tor.peers()) != 1 {
+		t.Fatal("Peer not added to swarm")
+	}
+
+	if err := tor.Pause(); err != nil || tor.State() != Paused {
+		t.Fatal("Failed to pause torrent: ", err, tor.State())
+	}
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Error("Peer connection not closed on pause")
+	}
+	if len(tor.peers()) != 0 {
+		t.Error("Swarm not emptied on pause")
+	}
+	if tor.fileStore == nil {
+		t.Error("Files closed on pause")
+	}
+	if err := tor.Pause(); err != nil {
+		t.Error("Pausing a paused torrent should be a no-op: ", err)
+	}
+
+	// Peers are rejected whilst paused
+	closed = connectTestPeer(tor)
+	<-closed
+	if len(tor.peers()) != 0 {
+		t.Error("Peer added to paused torrent")
+	}
+
+	if err := tor.Resume(); err != nil || tor.State() != Leeching {
+		t.Fatal("Failed to resume torrent: ", err, tor.State())
+	}
+
+	if err := tor.Stop(); err != nil || tor.State() != Stopped {
+		t.Fatal("Failed to stop torrent: ", err, tor.State())
+	}
+	if tor.fileStore != nil {
+		t.Error("Files not closed on stop")
+	}
+
+	// A stopped torrent can be started again
+	if err := tor.Start(); err != nil || tor.State() != Leeching {
+		t.Fatal("Failed to restart torrent: ", err, tor.State())
+	}
+}
+
+// testRemotePeer is the far end of a connection added to a torrent. It queues every
+// message the torrent sends it.
+type testRemotePeer struct {
+	conn net.Conn
+	msgs chan interface{}
+}
+
+func newTestRemotePeer(tor *Torrent, peerId string) *testRemotePeer {
+	return newTestRemotePeerFrom(tor, peerId, "")
+}
+
+// addrConn overrides the remote address of a connection.
+type addrConn struct {
+	net.Conn
+	addr net.Addr
+}
+
+func (c addrConn) RemoteAddr() net.Addr {
+	return c.addr
+}
+
+// newTestRemotePeerFrom connects a remote peer that appears to come from addr, if set.
+func newTestRemotePeerFrom(tor *Torrent, peerId string, addr string) *testRemotePeer {
+	var local net.Conn
+	local, remote := net.Pipe()
+	if addr != "" {
+		tcpAddr, _ := net.ResolveTCPAddr("tcp", addr)
+		local = addrConn{Conn: local, addr: tcpAddr}
+	}
+	rp := &testRemotePeer{conn: remote, msgs: make(chan interface{}, 100)}
+	go func() {
+		defer close(rp.msgs)
+		if _, err := parseHandshake(remote); err != nil {
+			return
+		}
+		for {
+			msg, err := parsePeerMessage(remote)
+			if err != nil {
+				return
+			}
+			rp.msgs <- msg
+		}
+	}()
+	hs := &handshake{protocol: []byte("BitTorrent protocol"), infoHash: tor.InfoHash(), peerId: []byte(peerId)}
+	tor.AddPeer(local, hs)
+	return rp
+}
+
+func (rp *testRemotePeer) send(t *testing.T, msg binaryDumper) {
+	if err := msg.BinaryDump(rp.conn); err != nil {
+		t.Fatal("Failed to send message to torrent: ", err)
+	}
+}
+
+// expect returns the next message sent by the torrent, ignoring keepalives.
+func (rp *testRemotePeer) expect(t *testing.T) interface{} {
+	for {
+		select {
+		case msg, ok := <-rp.msgs:
+			if !ok {
+				t.Fatal("Connection closed whilst waiting for message")
+			}
+			if msg != nil {
+				return msg
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for message")
+		}
+	}
+}
+
+// waitFor polls cond until it returns true, failing the test after a few seconds.
+func waitFor(t *testing.T, what string, cond func() bool) {
+	for deadline := time.Now().Add(time.Second * 5); !cond(); time.Sleep(time.Millisecond * 10) {
+		if time.Now().After(deadline) {
+			t.Fatal("Timed out waiting for ", what)
+		}
+	}
+}
@@ -0,0 +1,117 @@
+package tracker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zeebo/bencode"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"time"
+)
+
+var httpEvents = map[int32]string{
+	STARTED:   "started",
+	COMPLETED: "completed",
+	STOPPED:   "stopped",
+}
+
+type httpAnnounceResponse struct {
+	FailureReason string      `bencode:"failure reason"`
+	Interval      int32       `bencode:"interval"`
+	Complete      int32       `bencode:"complete"`
+	Incomplete    int32       `bencode:"incomplete"`
+	Peers         interface{} `bencode:"peers"`  // Compact string, or a list of dictionaries
+	Peers6        string      `bencode:"peers6"` // Compact IPv6 peers (BEP 7)
+	ExternalIP    string      `bencode:"external ip"`
+}
+
+// httpAnnounce announces to an HTTP tracker, asking for a compact response (BEP 23).
+func (tkr *Tracker) httpAnnounce(ctx context.Context, annReq *announceRequest, timeout time.Duration) (annRes *announceResponse, err error) {
+	u := *tkr.url
+	q := u.Query()
+	q.Set("info_hash", string(annReq.infoHash))
+	q.Set("peer_id", string(annReq.peerId))
+	q.Set("port", strconv.Itoa(int(uint16(annReq.port))))
+	q.Set("uploaded", strconv.FormatInt(annReq.uploaded, 10))
+	q.Set("downloaded", strconv.FormatInt(annReq.downloaded, 10))
+	q.Set("left", strconv.FormatInt(annReq.left, 10))
+	q.Set("compact", "1")
+	q.Set("numwant", strconv.Itoa(int(annReq.numWant)))
+	q.Set("key", fmt.Sprintf("%08x", uint32(annReq.key)))
+	if event, ok := httpEvents[annReq.event]; ok {
+		q.Set("event", event)
+	}
+	if addresser, ok := tkr.stat.(ExternalAddresser); ok {
+		v4, v6 := addresser.ExternalAddrs()
+		if v4.IsValid() {
+			q.Set("ipv4", v4.String())
+		}
+		if v6.IsValid() {
+			q.Set("ipv6", v6.String())
+		}
+	}
+	u.RawQuery = q.Encode()
+
+	req, err := http.NewRequestWithContext(ctx, "GET", u.String(), nil)
+	if err != nil {
+		return
+	}
+	client := &http.Client{Timeout: timeout}
+	res, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, errors.New(fmt.Sprintf("httpAnnounce: tracker returned %s", res.Status))
+	}
+
+	var httpRes httpAnnounceResponse
+	if err = bencode.NewDecoder(res.Body).Decode(&httpRes); err != nil {
+		return
+	}
+	if httpRes.FailureReason != "" {
+		return nil, errors.New(fmt.Sprintf("httpAnnounce: tracker failure: %s", httpRes.FailureReason))
+	}
+
+	annRes = &announceResponse{
+		interval: httpRes.Interval,
+		seeders:  httpRes.Complete,
+		leechers: httpRes.Incomplete,
+	}
+	switch peers := httpRes.Peers.(type) {
+	case string:
+		annRes.peers = parseCompactPeers([]byte(peers), 4)
+	case []interface{}:
+		annRes.peers = parsePeerDicts(peers)
+	}
+	annRes.peers = append(annRes.peers, parseCompactPeers([]byte(httpRes.Peers6), 16)...)
+
+	if addresser, ok := tkr.stat.(ExternalAddresser); ok {
+		if addr, ok := netip.AddrFromSlice([]byte(httpRes.ExternalIP)); ok {
+			addresser.SetExternalAddr(addr.Unmap())
+		}
+	}
+	return
+}
+
+// parsePeerDicts decodes the original, non-compact, list of peers: dictionaries with ip
+// and port keys. Entries that aren't IP addresses are skipped.
+func parsePeerDicts(peers []interface{}) (addrs []netip.AddrPort) {
+	for _, p := range peers {
+		dict, ok := p.(map[string]interface{})
+		if !ok {
+			continue
+		}
+		ip, _ := dict["ip"].(string)
+		port, _ := dict["port"].(int64)
+		addr, err := netip.ParseAddr(ip)
+		if err != nil || port <= 0 || port > 65535 {
+			continue
+		}
+		addrs = append(addrs, netip.AddrPortFrom(addr.Unmap(), uint16(port)))
+	}
+	return
+}
@@ -2,6 +2,7 @@ package tracker
 
 import (
 	"bytes"
+	"context"
 	"encoding/binary"
 	"errors"
 	"fmt"
@@ -9,7 +10,9 @@ import (
 	"io"
 	"math/rand"
 	"net"
+	"net/netip"
 	"net/url"
+	"sync"
 	"time"
 )
 
@@ -22,10 +25,13 @@ const (
 
 var logger = logging.MustGetLogger("libtorrent")
 
-// The udpDailer is used to create a udp connection.
-// During testing, the udp dialer can be swapped out for a stub.
+// The udpDailer is used to create a udp connection. Each tracker takes it when created,
+// so during testing a tracker's dialer can be swapped out for a stub.
 var UDPDialer func(network, address string) (net.Conn, error) = net.Dial
 
+// StopTimeout bounds how long Stop waits for the final STOPPED announce.
+var StopTimeout = time.Second * 5
+
 type TorrentStatter interface {
 	InfoHash() []byte
 	Downloaded() int64
@@ -33,16 +39,51 @@ type TorrentStatter interface {
 	Left() int64
 	Port() int16
 	PeerId() []byte
+	Key() int32 // Identifies us to trackers across announces, even if our address changes
+}
+
+// AnnounceObserver may optionally be implemented by a TorrentStatter to be told the
+// outcome of each announce.
+type AnnounceObserver interface {
+	Announced(url string, peers int, err error)
+}
+
+// ExternalAddresser may optionally be implemented by a TorrentStatter to tell HTTP
+// trackers our address in each family (BEP 7), so that peers of both families can find
+// us, and to learn our external address from them (BEP 24). Invalid addresses are
+// unknown.
+type ExternalAddresser interface {
+	ExternalAddrs() (v4 netip.Addr, v6 netip.Addr)
+	SetExternalAddr(addr netip.Addr)
 }
 
 type Tracker struct {
 	url          *url.URL
 	stat         TorrentStatter
+	dialer       func(network, address string) (net.Conn, error)
 	n            uint // This is used like a tcp backoff mechanism
 	nextAnnounce time.Duration
 	stop         chan struct{}
-	peerChan     chan string
+	stopOnce     sync.Once
+	ctx          context.Context // Cancelled by Stop, aborting an announce in flight
+	cancel       context.CancelFunc
+	done         chan struct{} // Closed once the announce loop has exited
+	peerChan     chan netip.AddrPort
 	announce     chan struct{} // Used to force an announce
+	status       Status
+	completed    bool       // A COMPLETED event is waiting to be sent
+	mutex        sync.Mutex // Protects status and completed
+}
+
+// Status describes the outcome of a tracker's most recent announce.
+type Status struct {
+	URL          string
+	LastAnnounce time.Time // Time of the last successful announce
+	NextAnnounce time.Time
+	Seeders      int
+	Leechers     int
+	Peers        int   // Number of peers received in the last announce
+	Err          error // Error from the last announce attempt, if it failed
 }
 
 type connectRequest struct {
@@ -51,21 +92,30 @@ type connectRequest struct {
 	transaction_id int32
 }
 
-func NewTracker(address string, stat TorrentStatter, peerChan chan string) (trk *Tracker, err error) {
+// NewTracker creates a tracker for a udp, http or https announce URL. Peers received from
+// the tracker are sent on peerChan.
+func NewTracker(address string, stat TorrentStatter, peerChan chan netip.AddrPort) (trk *Tracker, err error) {
 	// Verify valid http / or udp address
 	url, err := url.Parse(address)
 	if err != nil {
 		return
-	} else if url.Scheme != "udp" {
+	} else if url.Scheme != "udp" && url.Scheme != "http" && url.Scheme != "https" {
 		err = errors.New(fmt.Sprintf("newTracker: unknown scheme '%s'", url.Scheme))
 		return
 	}
 
+	ctx, cancel := context.WithCancel(context.Background())
 	trk = &Tracker{
 		url:      url,
 		stat:     stat,
+		dialer:   UDPDialer,
 		peerChan: peerChan,
 		stop:     make(chan struct{}),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+		announce: make(chan struct{}),
+		status:   Status{URL: url.String()},
 	}
 	return
 }
@@ -75,6 +125,7 @@ func (tkr *Tracker) Start() {
 	event := STARTED
 
 	go func() {
+		defer close(tkr.done)
 	L:
 		for {
 			select {
@@ -86,40 +137,85 @@ func (tkr *Tracker) Start() {
 				break L
 			}
 
+			reqEvent := event
+			tkr.mutex.Lock()
+			if tkr.completed && event == NONE {
+				reqEvent = COMPLETED
+			}
+			tkr.mutex.Unlock()
+
 			annReq := &announceRequest{
 				transactionId: rand.Int31(),
 				infoHash:      tkr.stat.InfoHash(),
 				peerId:        tkr.stat.PeerId(),
+				key:           tkr.stat.Key(),
 				downloaded:    tkr.stat.Downloaded(),
 				left:          tkr.stat.Left(),
 				uploaded:      tkr.stat.Uploaded(),
 				port:          tkr.stat.Port(),
-				event:         event,
+				event:         reqEvent,
 				numWant:       50,
 			}
-			annRes, err := tkr.udpAnnounce(annReq)
+			annRes, err := tkr.announceOnce(tkr.ctx, annReq, time.Second*60)
+			if tkr.ctx.Err() != nil {
+				// Stopped mid-announce, so that STOPPED isn't held up
+				break L
+			}
+			if obs, ok := tkr.stat.(AnnounceObserver); ok {
+				if err != nil {
+					obs.Announced(tkr.url.String(), 0, err)
+				} else {
+					obs.Announced(tkr.url.String(), len(annRes.peers), nil)
+				}
+			}
 			if err != nil {
 				logger.Info("Failed to contact tracker %s, error: %s", tkr.url, err)
 				// Attempt again using a backoff pattern 60*2^n
 				tkr.nextAnnounce = time.Second * 60 * time.Duration(1<<tkr.n)
 				tkr.n++
+				tkr.mutex.Lock()
+				tkr.status.Err = err
+				tkr.status.NextAnnounce = time.Now().Add(tkr.nextAnnounce)
+				tkr.mutex.Unlock()
 				continue
 			}
 
 			// Success!
 			logger.Info("Got %d peers from tracker %s. Next announce in %d seconds", len(annRes.peers), tkr.url, annRes.interval)
 			tkr.nextAnnounce = time.Second * time.Duration(annRes.interval)
+			tkr.n = 0
 			event = NONE
+			tkr.mutex.Lock()
+			if reqEvent == COMPLETED {
+				tkr.completed = false
+			}
+			tkr.status.Err = nil
+			tkr.status.LastAnnounce = time.Now()
+			tkr.status.NextAnnounce = tkr.status.LastAnnounce.Add(tkr.nextAnnounce)
+			tkr.status.Seeders = int(annRes.seeders)
+			tkr.status.Leechers = int(annRes.leechers)
+			tkr.status.Peers = len(annRes.peers)
+			tkr.mutex.Unlock()
 			for _, peer := range annRes.peers {
-				tkr.peerChan <- peer
+				select {
+				case tkr.peerChan <- peer:
+				case <-tkr.stop:
+					break L
+				}
 			}
 		}
 
+		// The tracker never learnt of us, so there's nothing to stop
+		if event == STARTED {
+			return
+		}
+
 		// Announce STOPPED
 		annReq := &announceRequest{
 			transactionId: rand.Int31(),
 			infoHash:      tkr.stat.InfoHash(),
 			peerId:        tkr.stat.PeerId(),
+			key:           tkr.stat.Key(),
 			downloaded:    tkr.stat.Downloaded(),
 			left:          tkr.stat.Left(),
 			uploaded:      tkr.stat.Uploaded(),
@@ -128,25 +224,120 @@ func (tkr *Tracker) Start() {
 			numWant:       50,
 		}
 		// Ignore failure, we're only making a 'best effort' to shutdown cleanly
-		tkr.udpAnnounce(annReq)
+		tkr.announceOnce(context.Background(), annReq, StopTimeout)
 	}()
 }
 
+// Stop ends the announce loop, aborting any announce in flight, and sends a final
+// STOPPED announce. It blocks until the announce completes or StopTimeout passes. It is
+// safe to call more than once.
 func (tkr *Tracker) Stop() {
-	close(tkr.stop)
+	tkr.stopOnce.Do(func() {
+		close(tkr.stop)
+		tkr.cancel()
+	})
+	select {
+	case <-tkr.done:
+	case <-time.After(StopTimeout):
+		logger.Info("Timed out announcing STOPPED to tracker %s", tkr.url)
+	}
+}
+
+// Status returns a copy of the tracker's current status.
+func (tkr *Tracker) Status() (status Status) {
+	tkr.mutex.Lock()
+	status = tkr.status
+	tkr.mutex.Unlock()
+	return
+}
+
+// Completed tells the tracker that the download has finished. A COMPLETED event is
+// announced immediately.
+func (tkr *Tracker) Completed() {
+	tkr.mutex.Lock()
+	tkr.completed = true
+	tkr.mutex.Unlock()
+	tkr.Announce()
 }
 
 func (tkr *Tracker) Announce() {
-	go func() { tkr.announce <- struct{}{} }()
+	go func() {
+		select {
+		case tkr.announce <- struct{}{}:
+		case <-tkr.stop:
+		}
+	}()
+}
+
+// announceOnce announces to the tracker, giving up after timeout or once ctx is done.
+func (tkr *Tracker) announceOnce(ctx context.Context, annReq *announceRequest, timeout time.Duration) (*announceResponse, error) {
+	if tkr.url.Scheme == "udp" {
+		return tkr.udpAnnounce(ctx, annReq, timeout)
+	}
+	return tkr.httpAnnounce(ctx, annReq, timeout)
 }
 
-func (tkr *Tracker) udpAnnounce(annReq *announceRequest) (annRes *announceResponse, err error) {
-	conn, err := UDPDialer(tkr.url.Scheme, tkr.url.Host)
+// udpAnnounce announces over each address family the tracker's host has, at the same
+// time, since a UDP tracker only returns peers of the family it is contacted over
+// (BEP 15). It succeeds if any family does, combining their peers.
+func (tkr *Tracker) udpAnnounce(ctx context.Context, annReq *announceRequest, timeout time.Duration) (annRes *announceResponse, err error) {
+	networks := []string{"udp4", "udp6"}
+	type result struct {
+		res *announceResponse
+		err error
+	}
+	results := make([]chan result, len(networks))
+	for i, network := range networks {
+		results[i] = make(chan result, 1)
+		req := *annReq
+		go func(network string, ch chan result) {
+			res, err := tkr.udpAnnounceOver(ctx, network, &req, timeout)
+			ch <- result{res, err}
+		}(network, results[i])
+	}
+
+	var errs []error
+	for _, ch := range results {
+		r := <-ch
+		if r.err != nil {
+			errs = append(errs, r.err)
+			continue
+		}
+		if annRes == nil {
+			annRes = r.res
+			continue
+		}
+		annRes.peers = append(annRes.peers, r.res.peers...)
+		if r.res.seeders > annRes.seeders {
+			annRes.seeders = r.res.seeders
+		}
+		if r.res.leechers > annRes.leechers {
+			annRes.leechers = r.res.leechers
+		}
+	}
+	if annRes != nil {
+		return annRes, nil
+	}
+	// Report the failure of a family the host has an address for, if there is one
+	err = errs[0]
+	for _, e := range errs {
+		var addrErr *net.AddrError
+		if !errors.As(e, &addrErr) {
+			return nil, e
+		}
+	}
+	return
+}
+
+func (tkr *Tracker) udpAnnounceOver(ctx context.Context, network string, annReq *announceRequest, timeout time.Duration) (annRes *announceResponse, err error) {
+	conn, err := tkr.dialer(network, tkr.url.Host)
 	if err != nil {
 		return
 	}
 	defer conn.Close()
-	conn.SetDeadline(time.Now().Add(time.Second * 60))
+	conn.SetDeadline(time.Now().Add(timeout))
+	stop := context.AfterFunc(ctx, func() { conn.SetDeadline(time.Now()) })
+	defer stop()
 
 	conReq := &connectionRequest{transactionId: rand.Int31()}
 	if err = conReq.BinaryDump(conn); err != nil {
@@ -169,10 +360,14 @@ func (tkr *Tracker) udpAnnounce(annReq *announceRequest) (annRes *announceRespon
 		return
 	}
 
-	if annRes, err = parseAnnounceResponse(conn); err != nil {
+	ipv6 := false
+	if addr, ok := conn.RemoteAddr().(*net.UDPAddr); ok {
+		ipv6 = addr.IP.To4() == nil
+	}
+	if annRes, err = parseAnnounceResponse(conn, ipv6); err != nil {
 		return
 	} else if annRes.transactionId != annReq.transactionId {
-		errors.New("updAnnounce: received transactionId did not match")
+		err = errors.New("udpAnnounce: received transactionId did not match")
 		return
 	} else if annRes.action != 1 {
 		err = errors.New(fmt.Sprintf("udpAnnounce: action is not set to announce (1), instead got %d", annRes.action))
@@ -265,12 +460,18 @@ type announceResponse struct {
 	interval      int32
 	leechers      int32
 	seeders       int32
-	peers         []string
+	peers         []netip.AddrPort
 }
 
-func parseAnnounceResponse(r io.Reader) (annRes *announceResponse, err error) {
+// parseAnnounceResponse reads a UDP announce response, whose peers are IPv6 if the
+// request was sent over IPv6.
+func parseAnnounceResponse(r io.Reader, ipv6 bool) (annRes *announceResponse, err error) {
+	addrLen := 4
+	if ipv6 {
+		addrLen = 16
+	}
 	// Set byte size to equivalent of getting 150 peers
-	b := make([]byte, 20+6*150)
+	b := make([]byte, 20+(addrLen+2)*150)
 	n, err := r.Read(b)
 	if err != nil {
 		return
@@ -287,16 +488,17 @@ func parseAnnounceResponse(r io.Reader) (annRes *announceResponse, err error) {
 	binary.Read(buf, binary.BigEndian, &annRes.leechers)
 	binary.Read(buf, binary.BigEndian, &annRes.seeders)
 
-	n = (n - 20) / 6 // Number of ip address + port pairs we read
-	for i := 0; i < n; i++ {
-		var a, b, c, d uint8
-		binary.Read(buf, binary.BigEndian, &a)
-		binary.Read(buf, binary.BigEndian, &b)
-		binary.Read(buf, binary.BigEndian, &c)
-		binary.Read(buf, binary.BigEndian, &d)
-		var port uint16
-		binary.Read(buf, binary.BigEndian, &port)
-		annRes.peers = append(annRes.peers, fmt.Sprintf("%d.%d.%d.%d:%d", a, b, c, d, port))
+	annRes.peers = parseCompactPeers(b[20:n], addrLen)
+	return
+}
+
+// parseCompactPeers decodes a list of addresses of addrLen bytes, each followed by a
+// two byte port. Any trailing partial entry is ignored.
+func parseCompactPeers(b []byte, addrLen int) (peers []netip.AddrPort) {
+	for ; len(b) >= addrLen+2; b = b[addrLen+2:] {
+		addr, _ := netip.AddrFromSlice(b[:addrLen])
+		port := binary.BigEndian.Uint16(b[addrLen:])
+		peers = append(peers, netip.AddrPortFrom(addr, port))
 	}
 	return
 }
@@ -2,8 +2,15 @@ package tracker
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/netip"
+	"net/url"
+	"strings"
+	"sync"
 	"testing"
 	"time"
 )
@@ -17,7 +24,7 @@ func TestTracker(t *testing.T) {
 		left:       36880,
 		port:       12345,
 	}
-	peerChan := make(chan string, 10)
+	peerChan := make(chan netip.AddrPort, 10)
 	tkr, _ := NewTracker("udp://tracker.openbittorrent.com:80", stat, peerChan)
 	tkr.Start()
 	tm := time.After(time.Second * 5)
@@ -41,11 +48,11 @@ func TestTrackerPure(t *testing.T) {
 	conn := testConn{
 		readBuf:  readBuf,
 		writeBuf: writeBuf,
+		mutex:    new(sync.Mutex),
 	}
 	var udpdialer = func(network, address string) (net.Conn, error) {
 		return conn, nil
 	}
-	UDPDialer = udpdialer
 
 	infoHash := []byte{0x74, 0x2d, 0x47, 0x53, 0x0f, 0xc4, 0xdc, 0xfd, 0xfd, 0x19, 0x71, 0x71, 0xa7, 0x7a, 0x04, 0x88, 0x67, 0xc6, 0xcc, 0x9d}
 	stat := &testTorrentStatter{
@@ -56,10 +63,12 @@ func TestTrackerPure(t *testing.T) {
 		port:       12345,
 	}
 
-	peerChan := make(chan string, 10)
+	peerChan := make(chan netip.AddrPort, 10)
 	tkr, _ := NewTracker("udp://tracker.openbittorrent.com:80", stat, peerChan)
+	tkr.dialer = udpdialer
 	tkr.Start()
 	time.Sleep(1000)
+	tkr.Stop()
 	fmt.Println(writeBuf.Bytes())
 	fmt.Println(readBuf.Bytes())
 
@@ -93,17 +102,32 @@ func (stat *testTorrentStatter) Port() int16 {
 	return stat.port
 }
 
+func (stat *testTorrentStatter) PeerId() []byte {
+	return []byte("-TT0000-000000000000")
+}
+
+func (stat *testTorrentStatter) Key() int32 {
+	return 0x1234abcd
+}
+
+// testConn is shared by the announces over each address family, so access to its
+// buffers is serialised.
 type testConn struct {
 	writeBuf *bytes.Buffer
 	readBuf  *bytes.Buffer
+	mutex    *sync.Mutex
 }
 
 func (conn testConn) Read(b []byte) (n int, err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
 	n, err = conn.readBuf.Read(b)
 	return
 }
 
 func (conn testConn) Write(b []byte) (n int, err error) {
+	conn.mutex.Lock()
+	defer conn.mutex.Unlock()
 	fmt.Println("Trying to write: ", b)
 	n, err = conn.writeBuf.Write(b)
 	fmt.Println(conn.writeBuf.Bytes())
@@ -121,3 +145,326 @@ func (conn testConn) SetDeadline(t time.Time) (err error) { return }
 func (conn testConn) SetReadDeadline(t time.Time) (err error) { return }
 
 func (conn testConn) SetWriteDeadline(t time.Time) (err error) { return }
+
+// testUDPTracker is a minimal UDP tracker listening on localhost. It records the event
+// of each announce it receives and responds with a fixed list of IPv4 peers.
+type testUDPTracker struct {
+	conn   *net.UDPConn
+	events chan int32
+	peers  []byte
+}
+
+func newTestUDPTracker(t *testing.T, peers []byte) *testUDPTracker {
+	return newTestUDPTrackerOn(t, net.IPv4(127, 0, 0, 1), peers)
+}
+
+func newTestUDPTrackerOn(t *testing.T, ip net.IP, peers []byte) *testUDPTracker {
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: ip})
+	if err != nil {
+		t.Skip("Failed to listen for UDP: ", err)
+	}
+	srv := &testUDPTracker{conn: conn, events: make(chan int32, 10), peers: peers}
+	go srv.serve()
+	return srv
+}
+
+func (srv *testUDPTracker) url() string {
+	return "udp://" + srv.conn.LocalAddr().String()
+}
+
+func (srv *testUDPTracker) serve() {
+	b := make([]byte, 1500)
+	for {
+		n, addr, err := srv.conn.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		req := bytes.NewReader(b[:n])
+		var connectionId int64
+		var action, transactionId int32
+		binary.Read(req, binary.BigEndian, &connectionId)
+		binary.Read(req, binary.BigEndian, &action)
+		binary.Read(req, binary.BigEndian, &transactionId)
+
+		res := new(bytes.Buffer)
+		switch action {
+		case 0: // Connect
+			binary.Write(res, binary.BigEndian, int32(0))
+			binary.Write(res, binary.BigEndian, transactionId)
+			binary.Write(res, binary.BigEndian, int64(1234))
+		case 1: // Announce
+			var event int32
+			req.Seek(80, 0)
+			binary.Read(req, binary.BigEndian, &event)
+			srv.events <- event
+			binary.Write(res, binary.BigEndian, int32(1))
+			binary.Write(res, binary.BigEndian, transactionId)
+			binary.Write(res, binary.BigEndian, int32(1800)) // Interval
+			binary.Write(res, binary.BigEndian, int32(1))    // Leechers
+			binary.Write(res, binary.BigEndian, int32(2))    // Seeders
+			res.Write(srv.peers)
+		}
+		srv.conn.WriteToUDP(res.Bytes(), addr)
+	}
+}
+
+func (srv *testUDPTracker) Close() {
+	srv.conn.Close()
+}
+
+func TestTrackerStopAnnouncesStopped(t *testing.T) {
+	srv := newTestUDPTracker(t, []byte{10, 0, 0, 1, 0x1a, 0xe1})
+	defer srv.Close()
+
+	stat := &testTorrentStatter{infoHash: make([]byte, 20), port: 12345}
+	peerChan := make(chan netip.AddrPort, 10)
+	tkr, err := NewTracker(srv.url(), stat, peerChan)
+	if err != nil {
+		t.Fatal("Failed to create tracker: ", err)
+	}
+	tkr.Start()
+
+	select {
+	case event := <-srv.events:
+		if event != STARTED {
+			t.Error("First announce was not STARTED, got: ", event)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for STARTED announce")
+	}
+	select {
+	case p := <-peerChan:
+		if p.String() != "10.0.0.1:6881" {
+			t.Error("Incorrect peer: ", p)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for peer")
+	}
+
+	tkr.Stop()
+	select {
+	case event := <-srv.events:
+		if event != STOPPED {
+			t.Error("Final announce was not STOPPED, got: ", event)
+		}
+	default:
+		t.Error("Stop returned before announcing STOPPED")
+	}
+	tkr.Stop() // Must be safe to call twice
+}
+
+func TestTrackerStopAbortsAnnounce(t *testing.T) {
+	events := make(chan string, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		event := r.URL.Query().Get("event")
+		events <- event
+		if event == "" {
+			// Hang the regular announce until the tracker gives up on it
+			<-r.Context().Done()
+			return
+		}
+		w.Write([]byte("d8:intervali1800e5:peers0:e"))
+	}))
+	defer srv.Close()
+
+	tkr, _ := NewTracker(srv.URL, &testTorrentStatter{infoHash: make([]byte, 20)}, make(chan netip.AddrPort, 10))
+	tkr.Start()
+	if event := <-events; event != "started" {
+		t.Fatal("First announce was not started, got: ", event)
+	}
+	tkr.Announce()
+	if event := <-events; event != "" {
+		t.Fatal("Expected regular announce, got: ", event)
+	}
+
+	start := time.Now()
+	tkr.Stop()
+	if elapsed := time.Since(start); elapsed > StopTimeout/2 {
+		t.Error("Stop waited for the announce in flight: ", elapsed)
+	}
+	select {
+	case event := <-events:
+		if event != "stopped" {
+			t.Error("Final announce was not stopped, got: ", event)
+		}
+	default:
+		t.Error("Stop returned before announcing stopped")
+	}
+}
+
+type testObservingStatter struct {
+	testTorrentStatter
+	announced chan error
+}
+
+func (stat *testObservingStatter) Announced(url string, peers int, err error) {
+	stat.announced <- err
+}
+
+func TestTrackerAnnounceObserver(t *testing.T) {
+	srv := newTestUDPTracker(t, nil)
+	defer srv.Close()
+
+	stat := &testObservingStatter{
+		testTorrentStatter: testTorrentStatter{infoHash: make([]byte, 20)},
+		announced:          make(chan error, 10),
+	}
+	tkr, _ := NewTracker(srv.url(), stat, make(chan netip.AddrPort, 10))
+	tkr.Start()
+	defer tkr.Stop()
+
+	select {
+	case err := <-stat.announced:
+		if err != nil {
+			t.Error("Announce reported an error: ", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Observer not told of announce")
+	}
+}
+
+func TestParseAnnounceResponseIPv6(t *testing.T) {
+	res := new(bytes.Buffer)
+	binary.Write(res, binary.BigEndian, []int32{1, 99, 1800, 1, 2})
+	res.Write(netip.MustParseAddr("2001:db8::1").AsSlice())
+	res.Write([]byte{0x1a, 0xe1})
+	res.Write([]byte{1, 2, 3}) // Truncated entry
+
+	annRes, err := parseAnnounceResponse(res, true)
+	if err != nil {
+		t.Fatal("Failed to parse response: ", err)
+	}
+	if len(annRes.peers) != 1 || annRes.peers[0].String() != "[2001:db8::1]:6881" {
+		t.Error("Incorrect peers: ", annRes.peers)
+	}
+}
+
+func TestUDPTrackerIPv6(t *testing.T) {
+	peer := append(netip.MustParseAddr("2001:db8::1").AsSlice(), 0x1a, 0xe1)
+	srv := newTestUDPTrackerOn(t, net.IPv6loopback, peer)
+	defer srv.Close()
+
+	peerChan := make(chan netip.AddrPort, 10)
+	tkr, _ := NewTracker(srv.url(), &testTorrentStatter{infoHash: make([]byte, 20)}, peerChan)
+	tkr.Start()
+	defer tkr.Stop()
+	select {
+	case p := <-peerChan:
+		if p.String() != "[2001:db8::1]:6881" {
+			t.Error("Incorrect peer: ", p)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Timed out waiting for peer")
+	}
+}
+
+type testAddresserStatter struct {
+	testTorrentStatter
+	v4, v6   netip.Addr
+	external chan netip.Addr
+}
+
+func (stat *testAddresserStatter) ExternalAddrs() (netip.Addr, netip.Addr) {
+	return stat.v4, stat.v6
+}
+
+func (stat *testAddresserStatter) SetExternalAddr(addr netip.Addr) {
+	stat.external <- addr
+}
+
+func TestHTTPTracker(t *testing.T) {
+	queries := make(chan url.Values, 10)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		queries <- r.URL.Query()
+		peers6 := append(netip.MustParseAddr("2001:db8::1").AsSlice(), 0x1a, 0xe1)
+		w.Write([]byte("d8:completei2e10:incompletei1e8:intervali1800e11:external ip4:\xcb\x00\x71\x05" +
+			"5:peers6:\x0a\x00\x00\x01\x1a\xe1" +
+			"6:peers618:" + string(peers6) + "e"))
+	}))
+	defer srv.Close()
+
+	stat := &testAddresserStatter{
+		testTorrentStatter: testTorrentStatter{infoHash: []byte("aaaaaaaaaaaaaaaaaaaa"), port: 12345, left: 100},
+		v6:                 netip.MustParseAddr("2001:db8::2"),
+		external:           make(chan netip.Addr, 10),
+	}
+	peerChan := make(chan netip.AddrPort, 10)
+	tkr, err := NewTracker(srv.URL+"/announce", stat, peerChan)
+	if err != nil {
+		t.Fatal("Failed to create tracker: ", err)
+	}
+	tkr.Start()
+	defer tkr.Stop()
+
+	q := <-queries
+	if q.Get("info_hash") != "aaaaaaaaaaaaaaaaaaaa" || q.Get("port") != "12345" || q.Get("event") != "started" || q.Get("compact") != "1" {
+		t.Error("Incorrect announce: ", q)
+	}
+	if q.Get("key") != "1234abcd" || q.Get("peer_id") != "-TT0000-000000000000" {
+		t.Error("Incorrect key or peer id: ", q)
+	}
+	if q.Get("ipv6") != "2001:db8::2" || q.Has("ipv4") {
+		t.Error("Incorrect addresses reported: ", q)
+	}
+	for _, want := range []string{"10.0.0.1:6881", "[2001:db8::1]:6881"} {
+		select {
+		case p := <-peerChan:
+			if p.String() != want {
+				t.Errorf("Expected peer %s, got %s", want, p)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for peer")
+		}
+	}
+	if addr := <-stat.external; addr.String() != "203.0.113.5" {
+		t.Error("Incorrect external address: ", addr)
+	}
+	if s := tkr.Status(); s.Seeders != 2 || s.Leechers != 1 {
+		t.Error("Incorrect status: ", s)
+	}
+}
+
+func TestHTTPTrackerPeerDicts(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d8:intervali1800e5:peersld2:ip8:10.0.0.14:porti6881eed2:ip11:example.com4:porti1eed2:ip3:::14:porti80eeee"))
+	}))
+	defer srv.Close()
+
+	peerChan := make(chan netip.AddrPort, 10)
+	tkr, _ := NewTracker(srv.URL, &testTorrentStatter{infoHash: make([]byte, 20)}, peerChan)
+	tkr.Start()
+	defer tkr.Stop()
+	for _, want := range []string{"10.0.0.1:6881", "[::1]:80"} {
+		select {
+		case p := <-peerChan:
+			if p.String() != want {
+				t.Errorf("Expected peer %s, got %s", want, p)
+			}
+		case <-time.After(time.Second * 5):
+			t.Fatal("Timed out waiting for peer")
+		}
+	}
+}
+
+func TestHTTPTrackerFailure(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte("d14:failure reason7:go awaye"))
+	}))
+	defer srv.Close()
+
+	stat := &testObservingStatter{
+		testTorrentStatter: testTorrentStatter{infoHash: make([]byte, 20)},
+		announced:          make(chan error, 10),
+	}
+	tkr, _ := NewTracker(srv.URL, stat, make(chan netip.AddrPort, 10))
+	tkr.Start()
+	defer tkr.Stop()
+	select {
+	case err := <-stat.announced:
+		if err == nil || !strings.Contains(err.Error(), "go away") {
+			t.Error("Expected tracker failure, got: ", err)
+		}
+	case <-time.After(time.Second * 5):
+		t.Fatal("Observer not told of announce")
+	}
+}
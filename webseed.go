@@ -0,0 +1,345 @@
+package libtorrent
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/torrance/libtorrent/bitfield"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// webSeedRetry is how long we wait before using a web seed again after a failed request,
+// unless the server tells us otherwise.
+var webSeedRetry = 30 * time.Second
+
+// webSeedMaxFailures is the number of consecutive failed requests after which a web seed
+// is dropped.
+const webSeedMaxFailures = 5
+
+// webSeed downloads pieces over HTTP, either from a plain web server holding the
+// torrent's files (BEP 19) or from a seeding script that serves pieces (BEP 17).
+//
+// A web seed joins the swarm as a pseudo-peer that has every piece and never chokes us,
+// so it is given blocks by the piece picker like any other peer. Rather than being
+// written to a connection, the request messages queued for it are gathered into HTTP
+// requests, and the blocks that come back are delivered to the receive loop as piece
+// messages.
+type webSeed struct {
+	tor      *Torrent
+	p        *peer
+	url      string
+	httpSeed bool // BEP 17: ask for pieces rather than file ranges
+	client   *http.Client
+}
+
+// webSeedBusy is returned by a BEP 17 seed that is too busy to serve us.
+type webSeedBusy struct {
+	retry time.Duration
+}
+
+func (err webSeedBusy) Error() string {
+	return fmt.Sprintf("Web seed busy, retry in %s", err.retry)
+}
+
+// addWebSeeds adds each of the torrent's web seeds to the swarm.
+func (t *Torrent) addWebSeeds(ctx context.Context) {
+	for _, u := range t.meta.URLList {
+		t.addWebSeed(ctx, u, false)
+	}
+	for _, u := range t.meta.HTTPSeeds {
+		t.addWebSeed(ctx, u, true)
+	}
+}
+
+func (t *Torrent) addWebSeed(ctx context.Context, seedURL string, httpSeed bool) {
+	if t.bans.Banned(seedURL) {
+		logger.Debug("Web seed %s is banned", seedURL)
+		return
+	}
+	bitf := bitfield.NewBitfield(t.meta.PieceCount)
+	for i := 0; i < t.meta.PieceCount; i++ {
+		bitf.SetTrue(i)
+	}
+	ws := &webSeed{
+		tor:      t,
+		url:      seedURL,
+		httpSeed: httpSeed,
+		client:   &http.Client{Timeout: time.Minute},
+		p: &peer{
+			name:      seedURL,
+			addr:      seedURL,
+			source:    SourceWebSeed,
+			transport: "http",
+			queued:    make(chan struct{}, 1),
+			read:      t.readChan,
+			closed:    make(chan struct{}),
+			stats:     newTransferStats(t.stats),
+			amChoking: true,
+			bitf:      bitf,
+			requests:  make(map[block]bool),
+		},
+	}
+
+	t.swarmLock.Lock()
+	if ctx.Err() != nil {
+		t.swarmLock.Unlock()
+		return
+	}
+	t.swarm = append(t.swarm, ws.p)
+	t.swarmLock.Unlock()
+	t.picker.AddBitfield(bitf)
+	logger.Debug("Added web seed: %s", seedURL)
+	t.publish(Event{Type: PeerConnectedEvent, Peer: seedURL})
+
+	go ws.run(ctx)
+	t.updateInterest(ws.p)
+	t.repick()
+}
+
+// run serves the requests queued for the web seed until it is closed.
+func (ws *webSeed) run(ctx context.Context) {
+	failures := 0
+	for {
+		select {
+		case <-ws.p.queued:
+		case <-ws.p.closed:
+			return
+		}
+
+		reqs := ws.pending()
+		if len(reqs) == 0 {
+			continue
+		}
+		err := ws.fetch(ctx, reqs)
+		if err == nil {
+			failures = 0
+			continue
+		}
+		if ctx.Err() != nil {
+			return
+		}
+
+		// Hand the blocks back to the picker so that other peers can download them, and
+		// pretend to be choked until we're ready to try again
+		failures++
+		logger.Info("Web seed %s failed (%d times): %s", ws.url, failures, err)
+		ws.p.SetPeerChoking(true)
+		ws.p.ClearRequests()
+		ws.tor.picker.Abandon(ws.p)
+		if failures >= webSeedMaxFailures {
+			ws.p.Close()
+			select {
+			case ws.tor.readChan <- peerDouble{msg: &peerClosedMessage{}, peer: ws.p}:
+			case <-ctx.Done():
+			}
+			return
+		}
+
+		retry := webSeedRetry
+		if busy, ok := err.(webSeedBusy); ok {
+			retry = busy.retry
+		}
+		select {
+		case <-time.After(retry):
+		case <-ws.p.closed:
+			return
+		}
+		ws.pending()
+		ws.p.SetPeerChoking(false)
+		ws.tor.repick()
+	}
+}
+
+// pending drains the queue, returning the requests that haven't since been cancelled.
+// Other messages are meaningless to a web seed and are dropped.
+func (ws *webSeed) pending() (reqs []*requestMessage) {
+	for msg := ws.p.dequeue(); msg != nil; msg = ws.p.dequeue() {
+		switch msg := msg.(type) {
+		case *requestMessage:
+			reqs = append(reqs, msg)
+		case *cancelMessage:
+			for i, req := range reqs {
+				if req.pieceIndex == msg.pieceIndex && req.blockOffset == msg.blockOffset {
+					reqs = append(reqs[:i], reqs[i+1:]...)
+					break
+				}
+			}
+		}
+	}
+	return
+}
+
+// fetch downloads the requested blocks, joining adjacent blocks into a single HTTP
+// request where possible, and delivers them to the receive loop.
+func (ws *webSeed) fetch(ctx context.Context, reqs []*requestMessage) error {
+	pieceLength := ws.tor.meta.PieceLength
+	start := func(req *requestMessage) int64 {
+		return int64(req.pieceIndex)*pieceLength + int64(req.blockOffset)
+	}
+	sort.Slice(reqs, func(i, j int) bool {
+		return start(reqs[i]) < start(reqs[j])
+	})
+
+	for len(reqs) > 0 {
+		// Find the run of adjacent blocks. BEP 17 seeds serve a single piece at a time.
+		n, length := 1, int64(reqs[0].blockLength)
+		for ; n < len(reqs); n++ {
+			if start(reqs[n]) != start(reqs[0])+length || (ws.httpSeed && reqs[n].pieceIndex != reqs[0].pieceIndex) {
+				break
+			}
+			length += int64(reqs[n].blockLength)
+		}
+
+		var data []byte
+		var err error
+		if ws.httpSeed {
+			data, err = ws.getPiece(ctx, int(reqs[0].pieceIndex), int64(reqs[0].blockOffset), length)
+		} else {
+			data, err = ws.getRange(ctx, start(reqs[0]), length)
+		}
+		if err != nil {
+			return err
+		}
+		ws.p.stats.downloaded.Add(len(data))
+		ws.tor.limits.download.Wait(len(data))
+
+		for _, req := range reqs[:n] {
+			msg := &pieceMessage{
+				pieceIndex:  req.pieceIndex,
+				blockOffset: req.blockOffset,
+				data:        data[:req.blockLength],
+			}
+			data = data[req.blockLength:]
+			select {
+			case ws.tor.readChan <- peerDouble{msg: msg, peer: ws.p}:
+			case <-ctx.Done():
+				return ctx.Err()
+			}
+		}
+		reqs = reqs[n:]
+	}
+	return nil
+}
+
+// getRange fetches length bytes starting at offset into the torrent, making a Range
+// request to each file the bytes span.
+func (ws *webSeed) getRange(ctx context.Context, offset int64, length int64) (data []byte, err error) {
+	end := offset + length
+	var fileStart int64
+	for i, file := range ws.tor.meta.Files {
+		fileEnd := fileStart + file.Length
+		if fileEnd > offset && fileStart < end {
+			from, to := offset, end
+			if from < fileStart {
+				from = fileStart
+			}
+			if to > fileEnd {
+				to = fileEnd
+			}
+			var b []byte
+			if b, err = ws.get(ctx, ws.fileURL(i), from-fileStart, to-fileStart); err != nil {
+				return
+			}
+			data = append(data, b...)
+		}
+		fileStart = fileEnd
+	}
+	return
+}
+
+// fileURL returns the URL of the file at index, as described by BEP 19. For single file
+// torrents a URL ending in a slash names a directory holding the file; otherwise the
+// URL is the file itself. Files of multi-file torrents are found beneath the URL.
+func (ws *webSeed) fileURL(index int) string {
+	meta := ws.tor.meta
+	if len(meta.Files) == 1 && meta.Files[0].Path == meta.Name && !strings.HasSuffix(ws.url, "/") {
+		return ws.url
+	}
+
+	base := ws.url
+	if !strings.HasSuffix(base, "/") {
+		base += "/"
+	}
+	segments := strings.Split(filepath.ToSlash(meta.Files[index].Path), "/")
+	for i, segment := range segments {
+		segments[i] = url.PathEscape(segment)
+	}
+	return base + strings.Join(segments, "/")
+}
+
+// get fetches bytes from up to (but not including) to of the file at fileURL.
+func (ws *webSeed) get(ctx context.Context, fileURL string, from int64, to int64) (data []byte, err error) {
+	req, err := http.NewRequest("GET", fileURL, nil)
+	if err != nil {
+		return
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", from, to-1))
+	resp, err := ws.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusPartialContent:
+		data = make([]byte, to-from)
+		_, err = io.ReadFull(resp.Body, data)
+	case http.StatusOK:
+		// The server ignored our Range header and is sending the whole file
+		if _, err = io.CopyN(ioutil.Discard, resp.Body, from); err != nil {
+			return
+		}
+		data = make([]byte, to-from)
+		_, err = io.ReadFull(resp.Body, data)
+	default:
+		err = errors.New(fmt.Sprintf("Web seed returned %s for %s", resp.Status, fileURL))
+	}
+	return
+}
+
+// getPiece fetches length bytes starting at offset into the piece from a BEP 17 seed.
+func (ws *webSeed) getPiece(ctx context.Context, index int, offset int64, length int64) (data []byte, err error) {
+	sep := "?"
+	if strings.Contains(ws.url, "?") {
+		sep = "&"
+	}
+	pieceURL := fmt.Sprintf("%s%sinfo_hash=%s&piece=%d", ws.url, sep, url.QueryEscape(string(ws.tor.InfoHash())), index)
+	if offset != 0 || length != ws.tor.pieceLength(index) {
+		pieceURL += fmt.Sprintf("&ranges=%d-%d", offset, offset+length-1)
+	}
+
+	req, err := http.NewRequest("GET", pieceURL, nil)
+	if err != nil {
+		return
+	}
+	resp, err := ws.client.Do(req.WithContext(ctx))
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+
+	switch resp.StatusCode {
+	case http.StatusOK:
+		data = make([]byte, length)
+		_, err = io.ReadFull(resp.Body, data)
+	case http.StatusServiceUnavailable:
+		// The body holds the number of seconds to wait before trying again
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 32))
+		busy := webSeedBusy{retry: webSeedRetry}
+		if seconds, err := strconv.Atoi(strings.TrimSpace(string(body))); err == nil {
+			busy.retry = time.Duration(seconds) * time.Second
+		}
+		err = busy
+	default:
+		err = errors.New(fmt.Sprintf("Web seed returned %s for piece %d", resp.Status, index))
+	}
+	return
+}
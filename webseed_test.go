@@ -0,0 +1,211 @@
+package libtorrent
+
+import (
+	"bytes"
+	"crypto/sha1"
+	"github.com/torrance/libtorrent/metainfo"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// runWebSeedTorrent downloads m using only its web seeds, failing if it doesn't finish.
+func runWebSeedTorrent(t *testing.T, m *metainfo.Metainfo) (tmpDir string, cleanup func()) {
+	tmpDir, removeDir := tempDir(t)
+	tor, err := NewTorrent(m, &Config{RootDirectory: tmpDir})
+	if err != nil {
+		removeDir()
+		t.Fatal("Could not create torrent: ", err)
+	}
+	sub := tor.Subscribe(StatusEvents)
+	defer sub.Close()
+	tor.Start()
+
+	timeout := time.After(10 * time.Second)
+	for tor.State() != Seeding {
+		select {
+		case <-sub.C:
+		case <-timeout:
+			tor.Stop()
+			removeDir()
+			t.Fatal("Timed out waiting for web seed download")
+		}
+	}
+
+	infos := tor.Peers()
+	if len(infos) == 0 || infos[0].Source != SourceWebSeed || infos[0].Transport != "http" || infos[0].Downloaded == 0 {
+		t.Errorf("Incorrect web seed info: %#v", infos)
+	}
+	return tmpDir, func() {
+		tor.Stop()
+		removeDir()
+	}
+}
+
+func TestWebSeedSingleFile(t *testing.T) {
+	data := testData(t)
+	var ranged int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/files/test.txt" {
+			http.NotFound(w, req)
+			return
+		}
+		if req.Header.Get("Range") != "" {
+			atomic.AddInt32(&ranged, 1)
+		}
+		http.ServeContent(w, req, "test.txt", time.Time{}, bytes.NewReader(data))
+	}))
+	defer server.Close()
+
+	m := testMetainfo()
+	m.URLList = []string{server.URL + "/files/"}
+	tmpDir, cleanup := runWebSeedTorrent(t, m)
+	defer cleanup()
+
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "test.txt")); !bytes.Equal(b, data) {
+		t.Error("Downloaded file incorrect")
+	}
+	if atomic.LoadInt32(&ranged) == 0 {
+		t.Error("No range requests made")
+	}
+}
+
+func TestWebSeedMultiFile(t *testing.T) {
+	data := testData(t)
+	files := map[string][]byte{
+		"/seed/multi/a file.txt": data[:20000],
+		"/seed/multi/sub/b.txt":  data[20000:],
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		content, ok := files[req.URL.Path]
+		if !ok {
+			http.NotFound(w, req)
+			return
+		}
+		http.ServeContent(w, req, "", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	// The files split the test data, so the piece hashes are unchanged
+	m := testMetainfo()
+	m.Name = "multi"
+	m.Files[0].Path = filepath.Join("multi", "a file.txt")
+	m.Files[0].Length = 20000
+	m.Files = append(m.Files, m.Files[0])
+	m.Files[1].Path = filepath.Join("multi", "sub", "b.txt")
+	m.Files[1].Length = 16880
+	m.URLList = []string{server.URL + "/seed"}
+	tmpDir, cleanup := runWebSeedTorrent(t, m)
+	defer cleanup()
+
+	a, _ := ioutil.ReadFile(filepath.Join(tmpDir, "multi", "a file.txt"))
+	b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "multi", "sub", "b.txt"))
+	if !bytes.Equal(append(a, b...), data) {
+		t.Error("Downloaded files incorrect")
+	}
+}
+
+func TestHTTPSeed(t *testing.T) {
+	data := testData(t)
+	m := testMetainfo()
+	var busy int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		q := req.URL.Query()
+		if q.Get("info_hash") != string(m.InfoHash) || q.Get("token") != "abc" {
+			http.NotFound(w, req)
+			return
+		}
+		// Turn away the first request
+		if atomic.AddInt32(&busy, 1) == 1 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			w.Write([]byte("0"))
+			return
+		}
+
+		piece, _ := strconv.Atoi(q.Get("piece"))
+		start := int64(piece) * m.PieceLength
+		end := start + m.PieceLength
+		if end > int64(len(data)) {
+			end = int64(len(data))
+		}
+		if ranges := q.Get("ranges"); ranges != "" {
+			bounds := strings.Split(ranges, "-")
+			from, _ := strconv.ParseInt(bounds[0], 10, 64)
+			to, _ := strconv.ParseInt(bounds[1], 10, 64)
+			start, end = start+from, start+to+1
+		}
+		w.Write(data[start:end])
+	}))
+	defer server.Close()
+
+	m.HTTPSeeds = []string{server.URL + "/seed?token=abc"}
+	tmpDir, cleanup := runWebSeedTorrent(t, m)
+	defer cleanup()
+
+	if b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "test.txt")); !bytes.Equal(b, data) {
+		t.Error("Downloaded file incorrect")
+	}
+	if atomic.LoadInt32(&busy) < 2 {
+		t.Error("Busy seed not retried")
+	}
+}
+
+func TestWebSeedFailure(t *testing.T) {
+	retry := webSeedRetry
+	webSeedRetry = time.Millisecond
+	defer func() { webSeedRetry = retry }()
+
+	var requests int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		atomic.AddInt32(&requests, 1)
+		http.Error(w, "Gone", http.StatusGone)
+	}))
+	defer server.Close()
+
+	m := testMetainfo()
+	m.URLList = []string{server.URL + "/test.txt"}
+	tor, cleanup := newTestTorrentWith(t, m)
+	defer cleanup()
+	tor.Start()
+
+	waitFor(t, "failing web seed to be dropped", func() bool {
+		return len(tor.Peers()) == 0
+	})
+	if n := atomic.LoadInt32(&requests); n != webSeedMaxFailures {
+		t.Errorf("Expected %d requests, got %d", webSeedMaxFailures, n)
+	}
+	if tor.picker.InEndgame() || len(tor.picker.Pick(&peer{}, fullBitfield(2), 10)) != 3 {
+		t.Error("Blocks not handed back by failed web seed")
+	}
+}
+
+func TestWebSeedHashFailure(t *testing.T) {
+	data := testData(t)
+	bad := append([]byte(nil), data...)
+	bad[100] ^= 0xff
+	var served int32
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		content := data
+		if atomic.AddInt32(&served, 1) == 1 {
+			content = bad
+		}
+		http.ServeContent(w, req, "test.txt", time.Time{}, bytes.NewReader(content))
+	}))
+	defer server.Close()
+
+	m := testMetainfo()
+	m.URLList = []string{server.URL + "/test.txt"}
+	tmpDir, cleanup := runWebSeedTorrent(t, m)
+	defer cleanup()
+
+	b, _ := ioutil.ReadFile(filepath.Join(tmpDir, "test.txt"))
+	if sha1.Sum(b) != sha1.Sum(data) {
+		t.Error("Downloaded file incorrect")
+	}
+}